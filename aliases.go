@@ -0,0 +1,406 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/liudanking/goutil/encodingutil"
+	log "github.com/liudanking/goutil/logutil"
+	"github.com/olekukonko/tablewriter"
+	"github.com/urfave/cli"
+)
+
+// CarModelName is the canonical name of a car model.
+type CarModelName struct {
+	Brand      string `json:"brand"`
+	Model      string `json:"model"`
+	Generation string `json:"generation,omitempty"`
+}
+
+// String returns name used in rankings, generations of a model are ranked together.
+func (n CarModelName) String() string {
+	return n.Brand + n.Model
+}
+
+// CarAliases is the content of alias file, it is merged into built-in aliases.
+type CarAliases struct {
+	Brands map[string]string       `json:"brands,omitempty"`
+	Models map[string]CarModelName `json:"models,omitempty"`
+}
+
+// builtinAliasesJSON is the built-in alias dictionary, raw brand prefixes of car model
+// names map to canonical brands, and canonical brands map to themselves.
+//
+//go:embed aliases_builtin.json
+var builtinAliasesJSON []byte
+
+var builtinAliases = func() CarAliases {
+	aliases := CarAliases{}
+	if err := json.Unmarshal(builtinAliasesJSON, &aliases); err != nil {
+		panic(fmt.Sprintf("invalid aliases_builtin.json:%v", err))
+	}
+	return aliases
+}()
+
+// aliasesFileName is the alias file in data directory, loaded if it exists
+const aliasesFileName = "aliases.json"
+
+var (
+	aliasesFlag = cli.StringFlag{
+		Name:  "aliases",
+		Usage: "car model alias file merged into built-in aliases and <dir>/" + aliasesFileName + ", see aliases dump",
+	}
+	rawModelsFlag = cli.BoolFlag{
+		Name:  "raw-models",
+		Usage: "rank car models by raw names without normalization",
+	}
+)
+
+var aliasFlags = []cli.Flag{aliasesFlag, rawModelsFlag}
+
+// CarModelNormalizer maps raw car model names to canonical names.
+type CarModelNormalizer struct {
+	// brand prefixes sorted by length, longest first
+	brandPrefixes []string
+	brands        map[string]string
+	models        map[string]CarModelName
+}
+
+func NewCarModelNormalizer(aliases ...CarAliases) *CarModelNormalizer {
+	cn := &CarModelNormalizer{
+		brands: map[string]string{},
+		models: map[string]CarModelName{},
+	}
+	for _, a := range append([]CarAliases{builtinAliases}, aliases...) {
+		for prefix, brand := range a.Brands {
+			cn.brands[aliasKey(prefix)] = brand
+		}
+		for raw, name := range a.Models {
+			cn.models[aliasKey(raw)] = name
+		}
+	}
+	for prefix := range cn.brands {
+		cn.brandPrefixes = append(cn.brandPrefixes, prefix)
+	}
+	sort.Slice(cn.brandPrefixes, func(i, j int) bool {
+		if len(cn.brandPrefixes[i]) != len(cn.brandPrefixes[j]) {
+			return len(cn.brandPrefixes[i]) > len(cn.brandPrefixes[j])
+		}
+		return cn.brandPrefixes[i] < cn.brandPrefixes[j]
+	})
+	return cn
+}
+
+// carModelNormalizerFromContext returns nil if --raw-models is set. Aliases of
+// <dir>/aliases.json override built-in ones, and --aliases overrides both.
+func carModelNormalizerFromContext(c *cli.Context) (*CarModelNormalizer, error) {
+	if c.Bool("raw-models") {
+		return nil, nil
+	}
+	files := []string{}
+	if dir := c.String("dir"); dir != "" {
+		fn := filepath.Join(dir, aliasesFileName)
+		if _, err := os.Stat(fn); err == nil {
+			files = append(files, fn)
+		}
+	}
+	if fn := c.String("aliases"); fn != "" {
+		files = append(files, fn)
+	}
+	overrides := []CarAliases{}
+	for _, fn := range files {
+		aliases := CarAliases{}
+		if err := encodingutil.UnmarshalJSONFromFile(fn, &aliases); err != nil {
+			return nil, fmt.Errorf("load aliases from %s failed:%v", fn, err)
+		}
+		log.Info("loaded %d brand and %d model aliases from %s", len(aliases.Brands), len(aliases.Models), fn)
+		overrides = append(overrides, aliases)
+	}
+	return NewCarModelNormalizer(overrides...), nil
+}
+
+// cleanModelName removes spaces and hyphens and converts full-width
+// parentheses, so that spelling variants share one form.
+func cleanModelName(raw string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsSpace(r), r == '-':
+			return -1
+		case r == '（':
+			return '('
+		case r == '）':
+			return ')'
+		}
+		return r
+	}, raw)
+}
+
+// aliasKey is the lookup key of raw name, cleaned and with ASCII letters upper cased.
+// Upper casing only ASCII keeps byte offsets of key and cleaned name identical.
+func aliasKey(raw string) string {
+	return strings.Map(func(r rune) rune {
+		if 'a' <= r && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		return r
+	}, cleanModelName(raw))
+}
+
+const importedSuffix = "(进口)"
+
+// Normalize returns canonical name of raw, known is false if neither
+// an alias nor a brand prefix matches, the cleaned raw name is returned then.
+func (cn *CarModelNormalizer) Normalize(raw string) (name CarModelName, known bool) {
+	cleaned, key := cleanModelName(raw), aliasKey(raw)
+	if name, ok := cn.models[key]; ok {
+		return name, true
+	}
+
+	generation := ""
+	if strings.HasSuffix(key, importedSuffix) {
+		generation = "进口"
+		cleaned = strings.TrimSuffix(cleaned, importedSuffix)
+		key = strings.TrimSuffix(key, importedSuffix)
+		if name, ok := cn.models[key]; ok {
+			name.Generation = generation
+			return name, true
+		}
+	}
+
+	for _, prefix := range cn.brandPrefixes {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		brand := cn.brands[prefix]
+		model := key[len(prefix):]
+		// e.g. 宝骏宝骏510
+		if strings.HasPrefix(model, aliasKey(brand)) && len(model) > len(aliasKey(brand)) {
+			model = model[len(aliasKey(brand)):]
+		}
+		if name, ok := cn.models[aliasKey(brand)+model]; ok {
+			if generation != "" {
+				name.Generation = generation
+			}
+			return name, true
+		}
+		// ASCII letters of model are upper cased, e.g. 宋max is ranked as 宋MAX
+		return CarModelName{Brand: brand, Model: model, Generation: generation}, true
+	}
+	return CarModelName{Model: cleaned}, false
+}
+
+// NormalizeName returns canonical ranking name of raw.
+func (cn *CarModelNormalizer) NormalizeName(raw string) string {
+	if cn == nil || raw == "" {
+		return raw
+	}
+	name, _ := cn.Normalize(raw)
+	return name.String()
+}
+
+func dumpAliases(c *cli.Context) error {
+	aliases := builtinAliases
+	if fn := c.String("output"); fn != "" {
+		return jsonMarshalIndentToFile(fn, &aliases)
+	}
+	data, err := json.MarshalIndent(&aliases, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+// modelNameGroup is a canonical name and the raw names normalized to it.
+type modelNameGroup struct {
+	name  CarModelName
+	known bool
+	raws  []string
+	count int
+}
+
+// suggestAliases clusters car model names whose canonical names are within
+// --max-distance edits of each other, for review before adding them to the alias file.
+func suggestAliases(c *cli.Context) error {
+	store, err := openDataStore(c)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	cn, err := carModelNormalizerFromContext(c)
+	if err != nil {
+		return err
+	}
+	cities, err := resolveCities(store, c.String("city"))
+	if err != nil {
+		return err
+	}
+
+	rawCount := map[string]int{}
+	for _, city := range cities {
+		if err := store.ForEachCurrentOrder(city, func(storeID string, rec CurrentOrderRecord) error {
+			rawCount[rec.CarModel]++
+			return nil
+		}); err != nil {
+			return err
+		}
+		if err := store.ForEachRepurchaseSnapshot(city, func(storeID string, snap RepurchaseSnapshot) error {
+			rawCount[snap.CarModel]++
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	groups := map[string]*modelNameGroup{}
+	for raw, count := range rawCount {
+		if raw == "" {
+			continue
+		}
+		name, known := cn.Normalize(raw)
+		g, ok := groups[name.String()]
+		if !ok {
+			g = &modelNameGroup{name: name, known: known}
+			groups[name.String()] = g
+		}
+		g.raws = append(g.raws, raw)
+		g.count += count
+	}
+	names := []string{}
+	for name, g := range groups {
+		sort.Strings(g.raws)
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	clusters := clusterModelNames(names, groups, c.Int("max-distance"))
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"分组", "车型", "品牌", "原始名称", "数量"})
+	suggestion := CarAliases{Models: map[string]CarModelName{}}
+	for i, cluster := range clusters {
+		// the most frequent name of cluster is suggested as canonical
+		sort.Slice(cluster, func(a, b int) bool {
+			if groups[cluster[a]].count != groups[cluster[b]].count {
+				return groups[cluster[a]].count > groups[cluster[b]].count
+			}
+			return cluster[a] < cluster[b]
+		})
+		canonical := groups[cluster[0]].name
+		for _, name := range cluster {
+			g := groups[name]
+			brand := g.name.Brand
+			if !g.known {
+				brand = "未知品牌"
+			}
+			table.Append([]string{fmt.Sprint(i + 1), name, brand, strings.Join(g.raws, ", "), fmt.Sprint(g.count)})
+			if name == cluster[0] {
+				continue
+			}
+			for _, raw := range g.raws {
+				suggestion.Models[raw] = canonical
+			}
+		}
+	}
+	table.Render()
+	log.Info("%d similar groups found in %d car models", len(clusters), len(names))
+
+	if fn := c.String("output"); fn != "" {
+		return jsonMarshalIndentToFile(fn, &suggestion)
+	}
+	return nil
+}
+
+// clusterModelNames groups names of the same brand whose models are within maxDistance
+// edits and keep more than half of the longer model, names with different digits
+// such as 宝骏510 and 宝骏530 are never grouped. Only groups of more than one name are returned.
+func clusterModelNames(names []string, groups map[string]*modelNameGroup, maxDistance int) [][]string {
+	parent := make([]int, len(names))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	keys := make([][]rune, len(names))
+	digits := make([]string, len(names))
+	for i, name := range names {
+		keys[i] = []rune(aliasKey(groups[name].name.Model))
+		digits[i] = strings.Map(func(r rune) rune {
+			if unicode.IsDigit(r) {
+				return r
+			}
+			return -1
+		}, name)
+	}
+	for i := range names {
+		for j := i + 1; j < len(names); j++ {
+			if groups[names[i]].name.Brand != groups[names[j]].name.Brand || digits[i] != digits[j] {
+				continue
+			}
+			d := levenshtein(keys[i], keys[j])
+			if d <= maxDistance && d*2 < maxInt(len(keys[i]), len(keys[j])) {
+				parent[find(i)] = find(j)
+			}
+		}
+	}
+
+	members := map[int][]string{}
+	for i, name := range names {
+		root := find(i)
+		members[root] = append(members[root], name)
+	}
+	clusters := [][]string{}
+	for i := range names {
+		if len(members[i]) > 1 {
+			clusters = append(clusters, members[i])
+		}
+	}
+	sort.Slice(clusters, func(i, j int) bool { return clusters[i][0] < clusters[j][0] })
+	return clusters
+}
+
+func levenshtein(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(minInt(prev[j]+1, cur[j-1]+1), prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
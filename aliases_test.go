@@ -0,0 +1,168 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/urfave/cli"
+)
+
+func TestCarModelNormalizer(t *testing.T) {
+	cn := NewCarModelNormalizer(CarAliases{
+		Brands: map[string]string{"腾势汽车": "腾势"},
+		Models: map[string]CarModelName{"比亚迪秦EV300": {Brand: "比亚迪", Model: "秦EV"}},
+	})
+	tests := []struct {
+		raw   string
+		name  CarModelName
+		known bool
+	}{
+		{"比亚迪 宋max", CarModelName{Brand: "比亚迪", Model: "宋MAX"}, true},
+		{"比亚迪宋-MAX", CarModelName{Brand: "比亚迪", Model: "宋MAX"}, true},
+		{"宝骏宝骏510", CarModelName{Brand: "宝骏", Model: "510"}, true},
+		{"上汽通用五菱宝骏 510", CarModelName{Brand: "宝骏", Model: "510"}, true},
+		{"大众新捷达", CarModelName{Brand: "大众", Model: "捷达", Generation: "新"}, true},
+		{"三菱LANCER（进口）", CarModelName{Brand: "三菱", Model: "蓝瑟", Generation: "进口"}, true},
+		{"丰田卡罗拉(进口)", CarModelName{Brand: "丰田", Model: "卡罗拉", Generation: "进口"}, true},
+		// aliases given override built-in ones
+		{"腾势汽车腾势400", CarModelName{Brand: "腾势", Model: "400"}, true},
+		{"比亚迪秦 EV300", CarModelName{Brand: "比亚迪", Model: "秦EV"}, true},
+		{"某某 X1", CarModelName{Model: "某某X1"}, false},
+	}
+	for _, tt := range tests {
+		name, known := cn.Normalize(tt.raw)
+		if name != tt.name || known != tt.known {
+			t.Errorf("Normalize(%q) = %+v, %v, want %+v, %v", tt.raw, name, known, tt.name, tt.known)
+		}
+	}
+
+	var raw *CarModelNormalizer
+	if got := raw.NormalizeName("比亚迪 宋max"); got != "比亚迪 宋max" {
+		t.Errorf("NormalizeName of nil normalizer = %q", got)
+	}
+	if got := cn.NormalizeName("比亚迪 宋max"); got != "比亚迪宋MAX" {
+		t.Errorf("NormalizeName = %q", got)
+	}
+}
+
+func TestLevenshtein(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"秦", "", 1},
+		{"", "秦EV", 3},
+		{"轩逸", "轩逸", 0},
+		{"宋MAX", "宋MAXDM", 2},
+		{"KITTEN", "SITTING", 3},
+		{"帝豪GL", "帝豪GS", 1},
+	}
+	for _, tt := range tests {
+		if got := levenshtein([]rune(tt.a), []rune(tt.b)); got != tt.want {
+			t.Errorf("levenshtein(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := levenshtein([]rune(tt.b), []rune(tt.a)); got != tt.want {
+			t.Errorf("levenshtein(%q, %q) = %d, want %d", tt.b, tt.a, got, tt.want)
+		}
+	}
+}
+
+func TestClusterModelNames(t *testing.T) {
+	groups := map[string]*modelNameGroup{}
+	names := []string{}
+	for _, name := range []CarModelName{
+		{Brand: "丰田", Model: "卡罗拉"},
+		{Brand: "丰田", Model: "卡洛拉"},
+		{Brand: "大众", Model: "朗逸"},
+		{Brand: "大众", Model: "郎逸"},
+		{Brand: "宝骏", Model: "510"},
+		{Brand: "宝骏", Model: "530"},
+		{Brand: "日产", Model: "轩逸经典"},
+		{Brand: "日产", Model: "新轩逸经典"},
+		{Brand: "比亚迪", Model: "宋MAX"},
+		{Brand: "比亚迪", Model: "宋MAS"},
+		{Brand: "比亚迪", Model: "宋MAXDM"},
+		{Brand: "吉利", Model: "宋MAX"},
+	} {
+		groups[name.String()] = &modelNameGroup{name: name, known: true}
+		names = append(names, name.String())
+	}
+	sort.Strings(names)
+
+	tests := []struct {
+		maxDistance int
+		want        [][]string
+	}{
+		{0, [][]string{}},
+		// 宝骏510 and 宝骏530 differ in digits, 郎逸 keeps only half of 朗逸,
+		// 吉利宋MAX is of another brand
+		{1, [][]string{{"丰田卡洛拉", "丰田卡罗拉"}, {"日产新轩逸经典", "日产轩逸经典"}, {"比亚迪宋MAS", "比亚迪宋MAX"}}},
+		{2, [][]string{{"丰田卡洛拉", "丰田卡罗拉"}, {"日产新轩逸经典", "日产轩逸经典"}, {"比亚迪宋MAS", "比亚迪宋MAX", "比亚迪宋MAXDM"}}},
+	}
+	for _, tt := range tests {
+		if got := clusterModelNames(names, groups, tt.maxDistance); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("clusterModelNames(max distance %d) = %v, want %v", tt.maxDistance, got, tt.want)
+		}
+	}
+}
+
+func TestCarModelNormalizerFromContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "didi-car-rank")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dataDir, emptyDir := filepath.Join(dir, "data"), filepath.Join(dir, "empty")
+	extra := filepath.Join(dir, "extra.json")
+	for fn, aliases := range map[string]CarAliases{
+		filepath.Join(dataDir, aliasesFileName): {Models: map[string]CarModelName{
+			"神车": {Brand: "大众", Model: "捷达"},
+			"老秦": {Brand: "比亚迪", Model: "秦"},
+		}},
+		extra: {Models: map[string]CarModelName{"神车": {Brand: "大众", Model: "桑塔纳"}}},
+	} {
+		if err := os.MkdirAll(filepath.Dir(fn), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := jsonMarshalIndentToFile(fn, &aliases); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		args []string
+		// names of 神车 and 老秦, empty if normalizer is nil
+		names []string
+	}{
+		{[]string{"-d", emptyDir}, []string{"神车", "老秦"}},
+		{[]string{"-d", dataDir}, []string{"大众捷达", "比亚迪秦"}},
+		// --aliases overrides <dir>/aliases.json
+		{[]string{"-d", dataDir, "--aliases", extra}, []string{"大众桑塔纳", "比亚迪秦"}},
+		{[]string{"-d", emptyDir, "--aliases", extra}, []string{"大众桑塔纳", "老秦"}},
+		{[]string{"-d", dataDir, "--raw-models"}, nil},
+	}
+	for _, tt := range tests {
+		var names []string
+		app := cli.NewApp()
+		app.Flags = append([]cli.Flag{cli.StringFlag{Name: "dir, d"}}, aliasFlags...)
+		app.Action = func(c *cli.Context) error {
+			cn, err := carModelNormalizerFromContext(c)
+			if err != nil || cn == nil {
+				return err
+			}
+			names = []string{cn.NormalizeName("神车"), cn.NormalizeName("老秦")}
+			return nil
+		}
+		if err := app.Run(append([]string{"didi-car-rank"}, tt.args...)); err != nil {
+			t.Fatalf("%v: %v", tt.args, err)
+		}
+		if !reflect.DeepEqual(names, tt.names) {
+			t.Errorf("%v: names = %v, want %v", tt.args, names, tt.names)
+		}
+	}
+}
@@ -3,40 +3,183 @@ package main
 import (
 	"errors"
 	"fmt"
-	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 
-	"github.com/olekukonko/tablewriter"
-
-	"github.com/liudanking/goutil/encodingutil"
 	log "github.com/liudanking/goutil/logutil"
 	"github.com/urfave/cli"
 )
 
 func analysisCity(c *cli.Context) error {
-	dir := c.String("dir")
-	city := c.String("city")
-	analylizer := NewCityAnalyzer(dir, city)
-	if _, err := os.Lstat(analylizer.cityDataDir); err != nil {
-		return errors.New("未找到城市数据")
+	store, err := openDataStore(c)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	cities, err := resolveCities(store, c.String("city"))
+	if err != nil {
+		return err
+	}
+	opts, err := analysisOptionsFromContext(c)
+	if err != nil {
+		return err
+	}
+	topn, minSamples := c.Int("top"), c.Int("min-samples")
+	switch c.String("mode") {
+	case modeRank:
+		result := NewAnalysisResult(cities, opts.GroupBy, opts.Weighting)
+		for _, city := range cities {
+			analylizer := NewCityAnalyzer(store, city, opts)
+			modelCount, modelSamples, weights := analylizer.analysisCurrentOrder()
+			result.Add(city, modelCount, modelSamples, weights, analylizer.analysisRepurchase())
+		}
+		return writeReport(result.Report(topn, minSamples), c.String("format"), c.String("output"))
+	case modeTCO:
+		result := NewTCOResult(cities, opts.GroupBy)
+		for _, city := range cities {
+			analylizer := NewCityAnalyzer(store, city, opts)
+			result.Add(analylizer.analysisPrices(), analylizer.analysisRepurchase())
+		}
+		return writeReport(result.Report(topn, minSamples), c.String("format"), c.String("output"))
+	default:
+		return fmt.Errorf("unknown analysis mode: %s", c.String("mode"))
+	}
+}
+
+// resolveCities expands city spec, a comma-separated list of city names,
+// glob patterns such as "*州市" or "all", into cities found in store.
+// Names not found are normalized as didi city names, e.g. 上海 is 上海市.
+func resolveCities(store DataStore, spec string) ([]string, error) {
+	available, err := store.Cities()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(available)
+
+	cities := []string{}
+	seen := map[string]bool{}
+	add := func(city string) {
+		if !seen[city] {
+			seen[city] = true
+			cities = append(cities, city)
+		}
+	}
+	for _, pattern := range strings.Split(spec, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if i := sort.SearchStrings(available, pattern); pattern != "all" && !strings.ContainsAny(pattern, "*?[") &&
+			(i == len(available) || available[i] != pattern) {
+			// e.g. 上海 for 上海市
+			pattern = normalizeCityName(pattern)
+		}
+		matched := false
+		for _, city := range available {
+			ok := pattern == "all" || pattern == city
+			if !ok {
+				if ok, err = filepath.Match(pattern, city); err != nil {
+					return nil, fmt.Errorf("invalid city pattern %s:%v", pattern, err)
+				}
+			}
+			if ok {
+				add(city)
+				matched = true
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("未找到城市数据: %s", pattern)
+		}
+	}
+	if len(cities) == 0 {
+		return nil, errors.New("未找到城市数据")
+	}
+	return cities, nil
+}
+
+// AnalysisOptions controls which collected data is analysed.
+type AnalysisOptions struct {
+	Window   TimeWindow
+	Snapshot SnapshotSelector
+	// Normalizer merges car model name variants, nil keeps raw names
+	Normalizer *CarModelNormalizer
+	// GroupBy rolls car models up to brand, segment, fuel or origin with CarMeta
+	GroupBy string
+	CarMeta *CarMetaTable
+	// Weighting is how current orders are counted, see weightingStation
+	Weighting string
+}
+
+func analysisOptionsFromContext(c *cli.Context) (AnalysisOptions, error) {
+	opts := AnalysisOptions{}
+	var err error
+	if opts.Window, err = timeWindowFromContext(c); err != nil {
+		return opts, err
+	}
+	if opts.Snapshot, err = snapshotSelectorFromContext(c); err != nil {
+		return opts, err
+	}
+	if opts.Normalizer, err = carModelNormalizerFromContext(c); err != nil {
+		return opts, err
+	}
+	opts.GroupBy = c.String("group-by")
+	if _, ok := groupByLabels[opts.GroupBy]; !ok {
+		return opts, fmt.Errorf("unknown group-by: %s", opts.GroupBy)
+	}
+	if opts.GroupBy != groupByModel && opts.Normalizer == nil {
+		return opts, fmt.Errorf("--raw-models can not be used with --group-by %s", opts.GroupBy)
+	}
+	if opts.CarMeta, err = carMetaTableFromContext(c); err != nil {
+		return opts, err
+	}
+	if opts.Weighting, err = weightingFromContext(c); err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
+// modelKey returns the ranking key of raw car model name, models are not
+// grouped without GroupBy or Normalizer.
+func (opts AnalysisOptions) modelKey(raw string) string {
+	if opts.GroupBy == "" || opts.GroupBy == groupByModel || opts.Normalizer == nil || raw == "" {
+		return opts.Normalizer.NormalizeName(raw)
+	}
+	name, _ := opts.Normalizer.Normalize(raw)
+	return opts.CarMeta.Group(name, opts.GroupBy)
+}
+
+// regroupCount merges counts of raw car model names by key.
+func regroupCount(modelCount map[string]int, key func(raw string) string) map[string]int {
+	grouped := map[string]int{}
+	for model, count := range modelCount {
+		grouped[key(model)] += count
+	}
+	return grouped
+}
+
+// regroupScores merges per driver scores of raw car model names by key.
+func regroupScores(modelScores map[string][]float64, key func(raw string) string) map[string][]float64 {
+	grouped := map[string][]float64{}
+	for model, scores := range modelScores {
+		k := key(model)
+		grouped[k] = append(grouped[k], scores...)
 	}
-	modelCount := analylizer.analysisCurrentOrder()
-	modelScore := analylizer.analysisRepurchase()
-	topn := c.Int("top")
-	analylizer.Output(modelCount, modelScore, topn)
-	return nil
+	return grouped
 }
 
 type CityAnalyzer struct {
-	cityName    string
-	cityDataDir string
+	cityName string
+	store    DataStore
+	opts     AnalysisOptions
 }
 
-func NewCityAnalyzer(dir, city string) *CityAnalyzer {
+func NewCityAnalyzer(store DataStore, city string, opts AnalysisOptions) *CityAnalyzer {
 	return &CityAnalyzer{
-		cityName:    city,
-		cityDataDir: filepath.Join(dir, city),
+		cityName: city,
+		store:    store,
+		opts:     opts,
 	}
 }
 
@@ -45,122 +188,181 @@ type CarModelCount struct {
 	Count int
 }
 
-func (ca *CityAnalyzer) analysisCurrentOrder() map[string]int {
-	currentOrderDir := filepath.Join(ca.cityDataDir, "currentorder")
-
-	modelCount := map[string]int{}
-	filepath.Walk(currentOrderDir, func(path string, info os.FileInfo, err error) error {
-		if info.IsDir() {
-			return nil
-		}
-
-		items := map[string]CurrentOrderItem{}
-		if err := encodingutil.UnmarshalJSONFromFile(path, &items); err != nil {
-			log.Warning("unmarshal from %s failed:%v", path, err)
-			return nil
+// analysisCurrentOrder returns current orders of every car model counted by weighting
+// and the number of sampled orders, both are the same if not weighted by station,
+// and weights of sampled orders if weighted by station.
+func (ca *CityAnalyzer) analysisCurrentOrder() (modelCount, modelSamples map[string]int, weights SampleWeights) {
+	if ca.opts.Weighting == weightingStation {
+		return ca.analysisStationWeightedCurrentOrder()
+	}
+	if agg, ok := ca.store.(ModelAggregator); ok {
+		modelCount, err := agg.CountCurrentOrdersByModel(ca.cityName, ca.opts.Window)
+		if err != nil {
+			log.Warning("count %s current order failed:%v", ca.cityName, err)
 		}
+		modelCount = regroupCount(modelCount, ca.opts.modelKey)
+		return modelCount, modelCount, weights
+	}
 
-		for _, item := range items {
-			if item.CarModel != "" {
-				modelCount[item.CarModel]++
-			}
+	modelCount = map[string]int{}
+	err := ca.store.ForEachCurrentOrder(ca.cityName, func(storeID string, rec CurrentOrderRecord) error {
+		if rec.CarModel != "" && ca.opts.Window.ContainsUnix(int64(rec.PayTime)) {
+			modelCount[rec.CarModel]++
 		}
-
 		return nil
 	})
+	if err != nil {
+		log.Warning("read %s current order failed:%v", ca.cityName, err)
+	}
 
-	return modelCount
+	modelCount = regroupCount(modelCount, ca.opts.modelKey)
+	return modelCount, modelCount, weights
 
 }
 
 type CarModelScore struct {
 	Model string
-	Score int
+	Score float64
 }
 
-func (ca *CityAnalyzer) analysisRepurchase() map[string]int {
-	repurchaseDir := filepath.Join(ca.cityDataDir, "repurchase")
-
-	modelScore := map[string]int{}
-	filepath.Walk(repurchaseDir, func(path string, info os.FileInfo, err error) error {
-		if info.IsDir() {
-			return nil
+// analysisRepurchase returns score of every driver grouped by car model.
+func (ca *CityAnalyzer) analysisRepurchase() map[string][]float64 {
+	if agg, ok := ca.store.(ModelAggregator); ok {
+		modelScores, err := agg.RepurchaseScoresByModel(ca.cityName, ca.opts.Window, ca.opts.Snapshot)
+		if err != nil {
+			log.Warning("read %s repurchase scores failed:%v", ca.cityName, err)
 		}
+		return regroupScores(modelScores, ca.opts.modelKey)
+	}
 
-		items := map[string]RepurchaseItem{}
-		if err := encodingutil.UnmarshalJSONFromFile(path, &items); err != nil {
-			log.Warning("unmarshal from %s failed:%v", path, err)
+	type driverKey struct {
+		storeID  string
+		driverID string
+	}
+	driverSnaps := map[driverKey][]RepurchaseSnapshot{}
+	err := ca.store.ForEachRepurchaseSnapshot(ca.cityName, func(storeID string, snap RepurchaseSnapshot) error {
+		if !ca.opts.Window.Contains(snap.CapturedAt) {
 			return nil
 		}
+		key := driverKey{storeID, snap.DriverID}
+		driverSnaps[key] = append(driverSnaps[key], snap)
+		return nil
+	})
+	if err != nil {
+		log.Warning("read %s repurchase failed:%v", ca.cityName, err)
+	}
 
-		for _, item := range items {
-			if item.CarModel != "" {
-				modelScore[item.CarModel] += item.OrderCount1M
-			}
+	modelScores := map[string][]float64{}
+	for _, snaps := range driverSnaps {
+		model, score, ok := ca.opts.Snapshot.Select(snaps)
+		if ok && model != "" {
+			modelScores[model] = append(modelScores[model], score)
 		}
+	}
+	return regroupScores(modelScores, ca.opts.modelKey)
+}
 
-		return nil
-	})
+// AnalysisResult holds per-city analysis results and their combination.
+type AnalysisResult struct {
+	Cities     []string
+	GroupBy    string
+	Weighting  string
+	ModelCount map[string]int
+	// ModelSamples is number of sampled current orders, it differs from ModelCount if weighted by station
+	ModelSamples map[string]int
+	// SampleWeights is weights of sampled current orders if weighted by station
+	SampleWeights SampleWeights
+	ModelScore    map[string]float64
+	ModelScores   map[string][]float64
+	CityCount     map[string]map[string]int
+	CityScore     map[string]map[string]float64
+}
 
-	return modelScore
+func NewAnalysisResult(cities []string, groupBy, weighting string) *AnalysisResult {
+	return &AnalysisResult{
+		Cities:       cities,
+		GroupBy:      groupBy,
+		Weighting:    weighting,
+		ModelCount:   map[string]int{},
+		ModelSamples: map[string]int{},
+		ModelScore:   map[string]float64{},
+		ModelScores:  map[string][]float64{},
+		CityCount:    map[string]map[string]int{},
+		CityScore:    map[string]map[string]float64{},
+	}
 }
 
-func (ca *CityAnalyzer) Output(modelCount, modelScore map[string]int, topn int) {
+// Add merges analysis result of city into the combined ranking,
+// modelSamples holds sampled current orders, weights their weights if weighted by station
+// and modelScores score of every driver of each model.
+func (ar *AnalysisResult) Add(city string, modelCount, modelSamples map[string]int, weights SampleWeights, modelScores map[string][]float64) {
+	ar.CityCount[city] = modelCount
+	ar.SampleWeights.Merge(weights)
+	ar.CityScore[city] = map[string]float64{}
+	for model, count := range modelCount {
+		ar.ModelCount[model] += count
+	}
+	for model, samples := range modelSamples {
+		ar.ModelSamples[model] += samples
+	}
+	for model, scores := range modelScores {
+		sum := 0.0
+		for _, score := range scores {
+			sum += score
+		}
+		ar.CityScore[city][model] = sum
+		ar.ModelScore[model] += sum
+		ar.ModelScores[model] = append(ar.ModelScores[model], scores...)
+	}
+}
 
-	carModelCountList := []CarModelCount{}
+func sortModelCount(modelCount map[string]int) []CarModelCount {
+	list := []CarModelCount{}
 	for model, count := range modelCount {
-		carModelCountList = append(carModelCountList, CarModelCount{
+		list = append(list, CarModelCount{
 			Model: model,
 			Count: count,
 		})
 	}
-
-	sort.Slice(carModelCountList, func(i, j int) bool { return carModelCountList[i].Count > carModelCountList[j].Count })
-
-	log.Notice("\n车型订单数量排名:")
-	table := tablewriter.NewWriter(os.Stdout)
-	table.SetHeader([]string{"排名", "车型", "实时订单数"})
-	for i, mc := range carModelCountList {
-		if i >= topn {
-			break
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Count != list[j].Count {
+			return list[i].Count > list[j].Count
 		}
-		table.Append([]string{
-			fmt.Sprint(i + 1),
-			mc.Model,
-			fmt.Sprint(mc.Count),
-		})
-	}
-	table.Render()
+		return list[i].Model < list[j].Model
+	})
+	return list
+}
 
-	carModelScoreList := []CarModelScore{}
+func sortModelScore(modelScore map[string]float64) []CarModelScore {
+	list := []CarModelScore{}
 	for model, score := range modelScore {
-		carModelScoreList = append(carModelScoreList, CarModelScore{
+		list = append(list, CarModelScore{
 			Model: model,
 			Score: score,
 		})
 	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Score != list[j].Score {
+			return list[i].Score > list[j].Score
+		}
+		return list[i].Model < list[j].Model
+	})
+	return list
+}
 
-	sort.Slice(carModelScoreList, func(i, j int) bool { return carModelScoreList[i].Score > carModelScoreList[j].Score })
-
-	log.Notice("\n车型加油积分排名:")
-	table = tablewriter.NewWriter(os.Stdout)
-	table.SetHeader([]string{"排名", "车型", "加油积分", "平均积分"})
-	for i, ms := range carModelScoreList {
-		if i >= topn {
-			break
+// cityRanks returns rank of every model in each city, starting from 1.
+func (ar *AnalysisResult) cityRanks() (countRank, scoreRank map[string]map[string]int) {
+	countRank = map[string]map[string]int{}
+	scoreRank = map[string]map[string]int{}
+	for _, city := range ar.Cities {
+		countRank[city] = map[string]int{}
+		for i, mc := range sortModelCount(ar.CityCount[city]) {
+			countRank[city][mc.Model] = i + 1
 		}
-		avgScore := ""
-		if count, found := modelCount[ms.Model]; found && count != 0 {
-			avgScore = fmt.Sprintf("%.02f", float64(ms.Score)/float64(count))
-		} else {
-			avgScore = "N/A"
+		scoreRank[city] = map[string]int{}
+		for i, ms := range sortModelScore(ar.CityScore[city]) {
+			scoreRank[city][ms.Model] = i + 1
 		}
-		table.Append([]string{
-			fmt.Sprint(i + 1),
-			ms.Model,
-			fmt.Sprint(ms.Score),
-			avgScore,
-		})
 	}
-	table.Render()
+	return countRank, scoreRank
 }
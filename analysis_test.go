@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// sortedScores sorts driver scores of every model, which storage returns in any order.
+func sortedScores(modelScores map[string][]float64) map[string][]float64 {
+	for _, scores := range modelScores {
+		sort.Float64s(scores)
+	}
+	return modelScores
+}
+
+func TestResolveCities(t *testing.T) {
+	dir, err := ioutil.TempDir("", "didi-car-rank")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewFileStore(dir)
+	for _, city := range []string{"深圳市", "成都市", "杭州市", "广州市"} {
+		if err := store.UpsertStations(city, []Store{{StoreID: city}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		spec   string
+		cities []string
+		ok     bool
+	}{
+		{"成都市", []string{"成都市"}, true},
+		{"成都市,深圳市", []string{"成都市", "深圳市"}, true},
+		// duplicates and spaces
+		{" 深圳市 , 成都市,深圳市,", []string{"深圳市", "成都市"}, true},
+		{"*州市", []string{"广州市", "杭州市"}, true},
+		// names without 市
+		{"成都, 深圳", []string{"成都市", "深圳市"}, true},
+		{"成都市,成都", []string{"成都市"}, true},
+		{"成都市,*州市", []string{"成都市", "广州市", "杭州市"}, true},
+		{"all", []string{"广州市", "成都市", "杭州市", "深圳市"}, true},
+		{"北京市", nil, false},
+		{"成都市,北京市", nil, false},
+		{"[", nil, false},
+		{"", nil, false},
+	}
+	for _, tt := range tests {
+		cities, err := resolveCities(store, tt.spec)
+		if (err == nil) != tt.ok || !reflect.DeepEqual(cities, tt.cities) {
+			t.Errorf("resolveCities(%q) = %v, %v, want %v", tt.spec, cities, err, tt.cities)
+		}
+	}
+}
+
+func TestAnalysisResult(t *testing.T) {
+	ar := NewAnalysisResult([]string{"成都市", "深圳市"}, groupByModel, weightingOrder)
+	ar.Add("成都市", map[string]int{"比亚迪秦": 3, "丰田卡罗拉": 3, "日产轩逸": 1}, map[string]int{"比亚迪秦": 3, "丰田卡罗拉": 3, "日产轩逸": 1}, SampleWeights{}, map[string][]float64{"比亚迪秦": {4, 6}, "日产轩逸": {20}})
+	ar.Add("深圳市", map[string]int{"比亚迪秦": 1, "日产轩逸": 5}, map[string]int{"比亚迪秦": 1, "日产轩逸": 5}, SampleWeights{}, map[string][]float64{"比亚迪秦": {5.5}})
+
+	if want := map[string]int{"比亚迪秦": 4, "丰田卡罗拉": 3, "日产轩逸": 6}; !reflect.DeepEqual(ar.ModelCount, want) {
+		t.Errorf("ModelCount = %v, want %v", ar.ModelCount, want)
+	}
+	if want := map[string]float64{"比亚迪秦": 15.5, "日产轩逸": 20}; !reflect.DeepEqual(ar.ModelScore, want) {
+		t.Errorf("ModelScore = %v, want %v", ar.ModelScore, want)
+	}
+	if want := map[string][]float64{"比亚迪秦": {4, 5.5, 6}, "日产轩逸": {20}}; !reflect.DeepEqual(sortedScores(ar.ModelScores), want) {
+		t.Errorf("ModelScores = %v, want %v", ar.ModelScores, want)
+	}
+	if want := map[string]float64{"比亚迪秦": 10, "日产轩逸": 20}; !reflect.DeepEqual(ar.CityScore["成都市"], want) {
+		t.Errorf("CityScore = %v, want %v", ar.CityScore["成都市"], want)
+	}
+
+	// ties are ranked by model name
+	countRank, scoreRank := ar.cityRanks()
+	wantCount := map[string]map[string]int{
+		"成都市": {"丰田卡罗拉": 1, "比亚迪秦": 2, "日产轩逸": 3},
+		"深圳市": {"日产轩逸": 1, "比亚迪秦": 2},
+	}
+	wantScore := map[string]map[string]int{
+		"成都市": {"日产轩逸": 1, "比亚迪秦": 2},
+		"深圳市": {"比亚迪秦": 1},
+	}
+	if !reflect.DeepEqual(countRank, wantCount) {
+		t.Errorf("count rank = %v, want %v", countRank, wantCount)
+	}
+	if !reflect.DeepEqual(scoreRank, wantScore) {
+		t.Errorf("score rank = %v, want %v", scoreRank, wantScore)
+	}
+}
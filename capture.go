@@ -0,0 +1,36 @@
+package main
+
+import "time"
+
+// hooks records are captured from
+const (
+	captureSourceGasstation = "gasstation"
+	captureSourceNearStore  = "near_store"
+)
+
+// CaptureMeta is the provenance of a collected record.
+type CaptureMeta struct {
+	CapturedAt time.Time `json:"captured_at"`
+	// Source is the hook intercepting the station query
+	Source    string `json:"source"`
+	AmChannel int    `json:"am_channel"`
+	// QueryLng and QueryLat are the map center of the station query
+	QueryLng string `json:"query_lng"`
+	QueryLat string `json:"query_lat"`
+	StoreID  string `json:"store_id"`
+}
+
+// orNil returns nil for meta without provenance, e.g. migrated legacy data.
+func (m CaptureMeta) orNil() *CaptureMeta {
+	if m.Source == "" {
+		return nil
+	}
+	return &m
+}
+
+// CurrentOrderRecord is a CurrentOrderItem with the provenance of its first capture,
+// Capture is nil for data collected before provenance was recorded.
+type CurrentOrderRecord struct {
+	CurrentOrderItem
+	Capture *CaptureMeta `json:"capture,omitempty"`
+}
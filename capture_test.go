@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCaptureProvenance(t *testing.T) {
+	first := CaptureMeta{
+		CapturedAt: time.Date(2018, 6, 10, 12, 0, 0, 0, time.Local),
+		Source:     captureSourceGasstation,
+		AmChannel:  10001,
+		QueryLng:   "104.06",
+		QueryLat:   "30.57",
+		StoreID:    "s1",
+	}
+	second := first
+	second.CapturedAt, second.Source = first.CapturedAt.Add(time.Hour), captureSourceNearStore
+
+	forEachBackend(t, func(backend string, store DataStore) {
+		// o1 is seen again by the second capture, o3 has no provenance like migrated data
+		for _, records := range [][]CurrentOrderRecord{
+			{{CurrentOrderItem: CurrentOrderItem{ID: "o1"}, Capture: &first}, {CurrentOrderItem: CurrentOrderItem{ID: "o3"}}},
+			{{CurrentOrderItem: CurrentOrderItem{ID: "o1"}, Capture: &second}, {CurrentOrderItem: CurrentOrderItem{ID: "o2"}, Capture: &second}},
+		} {
+			if err := store.MergeCurrentOrders("成都市", "s1", records); err != nil {
+				t.Fatalf("%s: %v", backend, err)
+			}
+		}
+		captures := map[string]*CaptureMeta{}
+		if err := store.ForEachCurrentOrder("成都市", func(storeID string, rec CurrentOrderRecord) error {
+			captures[rec.ID] = rec.Capture
+			return nil
+		}); err != nil {
+			t.Fatalf("%s: %v", backend, err)
+		}
+		tests := []struct {
+			id   string
+			want *CaptureMeta
+		}{
+			{"o1", &first},
+			{"o2", &second},
+			{"o3", nil},
+		}
+		for _, tt := range tests {
+			got := captures[tt.id]
+			if (got == nil) != (tt.want == nil) || (got != nil && !sameCapture(*got, *tt.want)) {
+				t.Errorf("%s: capture of %s = %+v, want %+v", backend, tt.id, got, tt.want)
+			}
+		}
+
+		if err := store.SaveRepurchaseSnapshot("成都市", "s1", second, []RepurchaseItem{{DriverID: "d1", OrderCount1M: 3}}); err != nil {
+			t.Fatalf("%s: %v", backend, err)
+		}
+		n := 0
+		if err := store.ForEachRepurchaseSnapshot("成都市", func(storeID string, snap RepurchaseSnapshot) error {
+			n++
+			if !snap.CapturedAt.Equal(second.CapturedAt) || snap.Capture == nil || !sameCapture(*snap.Capture, second) {
+				t.Errorf("%s: snapshot = %+v, want capture %+v", backend, snap, second)
+			}
+			return nil
+		}); err != nil {
+			t.Fatalf("%s: %v", backend, err)
+		}
+		if n != 1 {
+			t.Errorf("%s: %d snapshots", backend, n)
+		}
+	})
+}
+
+func sameCapture(a, b CaptureMeta) bool {
+	return a.CapturedAt.Equal(b.CapturedAt) && a.Source == b.Source && a.AmChannel == b.AmChannel &&
+		a.QueryLng == b.QueryLng && a.QueryLat == b.QueryLat && a.StoreID == b.StoreID
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/liudanking/goutil/encodingutil"
+	log "github.com/liudanking/goutil/logutil"
+	"github.com/urfave/cli"
+)
+
+// group-by dimensions of analysis
+const (
+	groupByModel   = "model"
+	groupByBrand   = "brand"
+	groupBySegment = "segment"
+	groupByFuel    = "fuel"
+	groupByOrigin  = "origin"
+)
+
+// groupByLabels are ranking column names of group-by dimensions.
+var groupByLabels = map[string]string{
+	groupByModel:   "车型",
+	groupByBrand:   "品牌",
+	groupBySegment: "级别",
+	groupByFuel:    "能源类型",
+	groupByOrigin:  "车系",
+}
+
+const unknownGroup = "未知"
+
+// car segments
+const (
+	segmentSmall     = "小型车"
+	segmentCompact   = "紧凑型车"
+	segmentMidsize   = "中型车"
+	segmentFullsize  = "中大型车"
+	segmentSUV       = "SUV"
+	segmentMPV       = "MPV"
+	segmentSportsCar = "跑车"
+)
+
+// energy types
+const (
+	fuelICE    = "燃油"
+	fuelHybrid = "混动"
+	fuelEV     = "纯电"
+)
+
+// car origins
+const (
+	originGerman   = "德系"
+	originJapanese = "日系"
+	originAmerican = "美系"
+	originKorean   = "韩系"
+	originFrench   = "法系"
+	originEuropean = "欧系"
+	originDomestic = "自主"
+)
+
+// CarMeta is metadata of a canonical car model.
+type CarMeta struct {
+	Segment string `json:"segment,omitempty"`
+	Fuel    string `json:"fuel,omitempty"`
+}
+
+// CarMetaFile is the content of car metadata file, it is merged into built-in metadata.
+type CarMetaFile struct {
+	BrandOrigins map[string]string  `json:"brand_origins,omitempty"`
+	Models       map[string]CarMeta `json:"models,omitempty"`
+}
+
+// builtinCarMetaJSON is the built-in car metadata, origins of foreign brands and
+// segment and energy type of canonical car models, energy type is guessed from
+// name when empty.
+//
+//go:embed carmeta_builtin.json
+var builtinCarMetaJSON []byte
+
+var builtinCarMeta = func() CarMetaFile {
+	f := CarMetaFile{}
+	if err := json.Unmarshal(builtinCarMetaJSON, &f); err != nil {
+		panic(fmt.Sprintf("invalid carmeta_builtin.json:%v", err))
+	}
+	return f
+}()
+
+// carMetaFileName is the car metadata file in data directory, loaded if it exists
+const carMetaFileName = "carmeta.json"
+
+var groupByFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "group-by",
+		Usage: "rank by model, brand, segment, fuel or origin",
+		Value: groupByModel,
+	},
+	cli.StringFlag{
+		Name:  "car-meta",
+		Usage: "car metadata file merged into built-in segment, fuel and origin table and <dir>/" + carMetaFileName,
+	},
+}
+
+// CarMetaTable joins canonical car models with segment, energy type and origin.
+type CarMetaTable struct {
+	origins map[string]string
+	models  map[string]CarMeta
+}
+
+func NewCarMetaTable(files ...CarMetaFile) *CarMetaTable {
+	t := &CarMetaTable{
+		origins: map[string]string{},
+		models:  map[string]CarMeta{},
+	}
+	for _, f := range append([]CarMetaFile{builtinCarMeta}, files...) {
+		for brand, origin := range f.BrandOrigins {
+			t.origins[brand] = origin
+		}
+		for model, meta := range f.Models {
+			t.models[model] = meta
+		}
+	}
+	return t
+}
+
+// carMetaTableFromContext merges <dir>/carmeta.json into built-in metadata,
+// and --car-meta overrides both.
+func carMetaTableFromContext(c *cli.Context) (*CarMetaTable, error) {
+	files := []string{}
+	if dir := c.String("dir"); dir != "" {
+		fn := filepath.Join(dir, carMetaFileName)
+		if _, err := os.Stat(fn); err == nil {
+			files = append(files, fn)
+		}
+	}
+	if fn := c.String("car-meta"); fn != "" {
+		files = append(files, fn)
+	}
+	overrides := []CarMetaFile{}
+	for _, fn := range files {
+		f := CarMetaFile{}
+		if err := encodingutil.UnmarshalJSONFromFile(fn, &f); err != nil {
+			return nil, fmt.Errorf("load car metadata from %s failed:%v", fn, err)
+		}
+		log.Info("loaded %d brand origins and %d car models from %s", len(f.BrandOrigins), len(f.Models), fn)
+		overrides = append(overrides, f)
+	}
+	return NewCarMetaTable(overrides...), nil
+}
+
+// Origin returns origin of brand, brands not in the table are domestic
+// as the table lists every foreign brand sold in China.
+func (t *CarMetaTable) Origin(brand string) string {
+	if brand == "" {
+		return unknownGroup
+	}
+	if origin, ok := t.origins[brand]; ok {
+		return origin
+	}
+	return originDomestic
+}
+
+// Segment returns segment of model, unknownGroup if not in the table.
+func (t *CarMetaTable) Segment(name CarModelName) string {
+	if meta, ok := t.models[name.String()]; ok && meta.Segment != "" {
+		return meta.Segment
+	}
+	return unknownGroup
+}
+
+// Fuel returns energy type of model, guessed from name if not in the table.
+func (t *CarMetaTable) Fuel(name CarModelName) string {
+	if name.Brand == "" {
+		return unknownGroup
+	}
+	if meta, ok := t.models[name.String()]; ok && meta.Fuel != "" {
+		return meta.Fuel
+	}
+	key := aliasKey(name.Model + name.Generation)
+	for _, kw := range []string{"EV", "新能源", "纯电"} {
+		if strings.Contains(key, kw) {
+			return fuelEV
+		}
+	}
+	for _, kw := range []string{"双擎", "混动", "PHEV", "PLUGIN", "DM"} {
+		if strings.Contains(key, kw) {
+			return fuelHybrid
+		}
+	}
+	return fuelICE
+}
+
+// Group returns the group of car model in dimension groupBy.
+func (t *CarMetaTable) Group(name CarModelName, groupBy string) string {
+	switch groupBy {
+	case groupByBrand:
+		if name.Brand == "" {
+			return unknownGroup
+		}
+		return name.Brand
+	case groupBySegment:
+		return t.Segment(name)
+	case groupByFuel:
+		return t.Fuel(name)
+	case groupByOrigin:
+		return t.Origin(name.Brand)
+	default:
+		return name.String()
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/urfave/cli"
+)
+
+func TestCarMetaTableGroup(t *testing.T) {
+	cn := NewCarModelNormalizer()
+	table := NewCarMetaTable(CarMetaFile{
+		BrandOrigins: map[string]string{"北汽": originEuropean},
+		Models:       map[string]CarMeta{"宝马X1": {Segment: segmentSUV}},
+	})
+	tests := []struct {
+		raw                                 string
+		brand, segment, fuel, origin, model string
+	}{
+		{"丰田卡罗拉", "丰田", segmentCompact, fuelICE, originJapanese, "丰田卡罗拉"},
+		{"大众新捷达", "大众", segmentCompact, fuelICE, originGerman, "大众捷达"},
+		{"比亚迪秦", "比亚迪", segmentCompact, fuelHybrid, originDomestic, "比亚迪秦"},
+		// energy type guessed from name
+		{"比亚迪秦EV300", "比亚迪", segmentCompact, fuelEV, originDomestic, "比亚迪秦EV300"},
+		{"荣威ei6", "荣威", segmentCompact, fuelHybrid, originDomestic, "荣威ei6"},
+		// metadata file overrides built-in table
+		{"宝马X1", "宝马", segmentSUV, fuelICE, originGerman, "宝马X1"},
+		{"北汽EU260", "北汽", unknownGroup, fuelICE, originEuropean, "北汽EU260"},
+		// brand not recognized
+		{"某某车", unknownGroup, unknownGroup, unknownGroup, unknownGroup, "某某车"},
+	}
+	for _, tt := range tests {
+		name, _ := cn.Normalize(tt.raw)
+		for groupBy, want := range map[string]string{
+			groupByModel:   tt.model,
+			groupByBrand:   tt.brand,
+			groupBySegment: tt.segment,
+			groupByFuel:    tt.fuel,
+			groupByOrigin:  tt.origin,
+		} {
+			if got := table.Group(name, groupBy); got != want {
+				t.Errorf("Group(%q, %s) = %s, want %s", tt.raw, groupBy, got, want)
+			}
+		}
+	}
+}
+
+func TestAnalysisGroupBy(t *testing.T) {
+	tests := []struct {
+		groupBy string
+		count   map[string]int
+		scores  map[string][]float64
+	}{
+		{groupByModel, map[string]int{"比亚迪秦": 2, "丰田卡罗拉": 1}, map[string][]float64{"比亚迪秦": {5, 7}, "丰田卡罗拉": {3}}},
+		{groupByBrand, map[string]int{"比亚迪": 2, "丰田": 1}, map[string][]float64{"比亚迪": {5, 7}, "丰田": {3}}},
+		{groupByFuel, map[string]int{fuelHybrid: 2, fuelICE: 1}, map[string][]float64{fuelHybrid: {5, 7}, fuelICE: {3}}},
+		{groupByOrigin, map[string]int{originDomestic: 2, originJapanese: 1}, map[string][]float64{originDomestic: {5, 7}, originJapanese: {3}}},
+	}
+	forEachBackend(t, func(backend string, store DataStore) {
+		fillAggregateData(t, store)
+		for _, tt := range tests {
+			ca := NewCityAnalyzer(store, "成都市", AnalysisOptions{
+				Snapshot:   SnapshotSelector{Mode: SnapshotLatest},
+				Normalizer: NewCarModelNormalizer(),
+				GroupBy:    tt.groupBy,
+				CarMeta:    NewCarMetaTable(),
+			})
+			// orders and drivers without car model are not counted
+			if got, _, _ := ca.analysisCurrentOrder(); !reflect.DeepEqual(got, tt.count) {
+				t.Errorf("%s: %s current order count = %v, want %v", backend, tt.groupBy, got, tt.count)
+			}
+			if got := sortedScores(ca.analysisRepurchase()); !reflect.DeepEqual(got, tt.scores) {
+				t.Errorf("%s: %s repurchase scores = %v, want %v", backend, tt.groupBy, got, tt.scores)
+			}
+		}
+	})
+}
+
+func TestCarMetaTableFromContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "didi-car-rank")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dataDir, emptyDir := filepath.Join(dir, "data"), filepath.Join(dir, "empty")
+	extra := filepath.Join(dir, "extra.json")
+	for fn, f := range map[string]CarMetaFile{
+		filepath.Join(dataDir, carMetaFileName): {
+			BrandOrigins: map[string]string{"北汽": originEuropean},
+			Models:       map[string]CarMeta{"宝马X1": {Segment: segmentSUV}},
+		},
+		extra: {Models: map[string]CarMeta{"宝马X1": {Segment: segmentMidsize}}},
+	} {
+		if err := os.MkdirAll(filepath.Dir(fn), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := jsonMarshalIndentToFile(fn, &f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bmw := CarModelName{Brand: "宝马", Model: "X1"}
+	tests := []struct {
+		args            []string
+		origin, segment string
+	}{
+		// built-in metadata, 北汽 is domestic and 宝马X1 is not in the table
+		{[]string{"-d", emptyDir}, originDomestic, unknownGroup},
+		{[]string{"-d", dataDir}, originEuropean, segmentSUV},
+		// --car-meta overrides <dir>/carmeta.json
+		{[]string{"-d", dataDir, "--car-meta", extra}, originEuropean, segmentMidsize},
+		{[]string{"-d", emptyDir, "--car-meta", extra}, originDomestic, segmentMidsize},
+	}
+	for _, tt := range tests {
+		var table *CarMetaTable
+		app := cli.NewApp()
+		app.Flags = append([]cli.Flag{cli.StringFlag{Name: "dir, d"}}, groupByFlags...)
+		app.Action = func(c *cli.Context) (err error) {
+			table, err = carMetaTableFromContext(c)
+			return err
+		}
+		if err := app.Run(append([]string{"didi-car-rank"}, tt.args...)); err != nil {
+			t.Fatalf("%v: %v", tt.args, err)
+		}
+		if origin, segment := table.Origin("北汽"), table.Segment(bmw); origin != tt.origin || segment != tt.segment {
+			t.Errorf("%v: origin = %s, segment = %s, want %s, %s", tt.args, origin, segment, tt.origin, tt.segment)
+		}
+		// built-in entries are kept
+		if origin := table.Origin("丰田"); origin != originJapanese {
+			t.Errorf("%v: origin of 丰田 = %s", tt.args, origin)
+		}
+	}
+}
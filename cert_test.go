@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGenerateCA(t *testing.T) {
+	tests := []struct {
+		keyType string
+		ok      bool
+	}{
+		{"", true},
+		{"ecdsa", true},
+		{"RSA", true},
+		{"dsa", false},
+	}
+	for _, tt := range tests {
+		certPEM, keyPEM, err := generateCA(tt.keyType)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: err = %v, want ok %v", tt.keyType, err, tt.ok)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		pair, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			t.Errorf("%q: %v", tt.keyType, err)
+			continue
+		}
+		cert, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			t.Errorf("%q: %v", tt.keyType, err)
+			continue
+		}
+		if !cert.IsCA || cert.KeyUsage&x509.KeyUsageCertSign == 0 {
+			t.Errorf("%q: IsCA = %v, KeyUsage = %v", tt.keyType, cert.IsCA, cert.KeyUsage)
+		}
+	}
+}
+
+func TestLoadCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "didi-car-rank")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caDir := filepath.Join(dir, "ca")
+
+	certPEM, keyPEM, err := loadCA(caDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fn := range []string{caCertPEMFile, caKeyPEMFile, caCertDERFile, caMobileconfigFile, caP12File} {
+		if _, err := os.Stat(filepath.Join(caDir, fn)); err != nil {
+			t.Errorf("%s not exported: %v", fn, err)
+		}
+	}
+	if err := setCA(certPEM, keyPEM); err != nil {
+		t.Fatal(err)
+	}
+
+	// the CA generated on first run is reused
+	certPEM2, keyPEM2, err := loadCA(caDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(certPEM, certPEM2) || !bytes.Equal(keyPEM, keyPEM2) {
+		t.Errorf("loadCA generated a new CA instead of loading the existing one")
+	}
+
+	mobileconfig, err := ioutil.ReadFile(filepath.Join(caDir, caMobileconfigFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(mobileconfig, []byte("com.apple.security.root")) {
+		t.Errorf("mobileconfig does not install a root CA:\n%s", mobileconfig)
+	}
+}
@@ -4,17 +4,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"os"
-	"path/filepath"
+	"os/signal"
 	"strconv"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 
-	"github.com/liudanking/goutil/encodingutil"
-
 	"github.com/liudanking/goutil/netutil"
 
 	log "github.com/liudanking/goutil/logutil"
@@ -24,8 +21,12 @@ import (
 )
 
 func collectData(c *cli.Context) error {
+	caCert, caKey, err := loadCA(c.String("ca-dir"))
+	if err != nil {
+		return fmt.Errorf("load CA failed:%v", err)
+	}
 	if err := setCA(caCert, caKey); err != nil {
-		log.Error("setCA failed:%v", err)
+		return fmt.Errorf("setCA failed:%v", err)
 	}
 	proxy := goproxy.NewProxyHttpServer()
 	// proxy.Verbose = true
@@ -34,10 +35,49 @@ func collectData(c *cli.Context) error {
 	if listenAddr == "" {
 		return errors.New("listen address is empty")
 	}
-	dh := NewDidiHooker(c.String("dir"))
+	store, err := openDataStore(c)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	geocoder, err := geocoderFromContext(c, store)
+	if err != nil {
+		return err
+	}
+	didiCities, err := NewDidiCityTable(store)
+	if err != nil {
+		return err
+	}
+	cfg := configFromContext(c)
+	dh := NewDidiHooker(store, geocoder, didiCities, cfg.Didi)
+	dh.logUnmatched = c.Bool("log-unmatched")
 	dh.RegisterHook(proxy)
 
-	log.Info("start serving %s", listenAddr)
+	ss, err := NewSetupServer(caCert, listenAddr)
+	if err != nil {
+		return err
+	}
+	ss.RegisterHook(proxy, cfg.Didi.Host)
+
+	if dashboardAddr := c.String("dashboard"); dashboardAddr != "" {
+		go func() {
+			if err := NewDashboard(dh.stats, geocoder).ListenAndServe(dashboardAddr); err != nil {
+				log.Error("dashboard listen %s failed:%v", dashboardAddr, err)
+			}
+		}()
+	}
+
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		<-sigs
+		log.Info("stop collecting, saving records intercepted")
+		dh.Close()
+		store.Close()
+		os.Exit(0)
+	}()
+
+	log.Info("start serving %s, open %s or http://%s/ on your phone for setup", listenAddr, ss.SetupURL(), setupHost)
 	if err := http.ListenAndServe(listenAddr, proxy); err != nil {
 		log.Error("listen %s failed:%v", listenAddr, err)
 		os.Exit(1)
@@ -46,204 +86,342 @@ func collectData(c *cli.Context) error {
 }
 
 type DidiHooker struct {
-	dataMtx sync.Mutex
-	dataDir string
+	didi DidiConfig
+	// logUnmatched logs requests to didi not handled by any hook
+	logUnmatched bool
+	store        DataStore
+	geocoder     *CachedGeocoder
+	didiCities   *DidiCityTable
+	stats        *CollectStats
+	prices       *priceRecorder
+	hooks        *HookRegistry
 }
 
-func NewDidiHooker(dataDir string) *DidiHooker {
+func NewDidiHooker(store DataStore, geocoder *CachedGeocoder, didiCities *DidiCityTable, didi DidiConfig) *DidiHooker {
 	return &DidiHooker{
-		dataDir: dataDir,
+		didi:       didi,
+		store:      store,
+		geocoder:   geocoder,
+		didiCities: didiCities,
+		stats:      NewCollectStats(),
+		prices:     newPriceRecorder(),
 	}
 }
 
+// RegisterHook intercepts didi pages of rules, supporting a new page is registering
+// a HookHandler of it.
 func (dh *DidiHooker) RegisterHook(p *goproxy.ProxyHttpServer) {
-	dstHost := "devcon-go.am.xiaojukeji.com:443"
-	p.OnRequest(goproxy.DstHostIs(dstHost)).HandleConnect(goproxy.AlwaysMitm)
-	p.OnResponse(goproxy.DstHostIs(dstHost)).DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
-
-		if strings.HasPrefix(ctx.Req.URL.Path, "/front/gasstation/index") {
-			log.Info("gasstation hook!")
-			return dh.hookGasstation(resp, ctx)
-		} else if strings.HasPrefix(ctx.Req.URL.Path, "/map/store/near") {
-			log.Info("near store hook!")
-			return dh.hookNearStore(resp, ctx)
-		}
+	hr := NewHookRegistry(dh.logUnmatched)
+	hr.Register(HookRule{Host: dh.didi.Host, Path: dh.didi.GasstationPath, Handler: gasstationHandler{}})
+	hr.Register(HookRule{Host: dh.didi.Host, Path: dh.didi.NearStorePath, Handler: nearStoreHandler{}})
+	hr.Install(p, dh)
+	dh.hooks = hr
+}
 
-		return resp
-	})
+// Close waits until records of intercepted pages are saved.
+func (dh *DidiHooker) Close() {
+	if dh.hooks != nil {
+		dh.hooks.Close()
+	}
 }
 
-func (dh *DidiHooker) hookGasstation(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
-	data, err := repeatReadBody(resp)
-	if err != nil {
-		log.Error("read gasstation rsp failed:%v", err)
-		return resp
+// StationQuery is the stations didi returns for a station query around QueryLng and QueryLat.
+type StationQuery struct {
+	Source           string
+	Stores           []Store
+	List             []StoreListItem
+	FuelCategory     string
+	FuelCategoryName string
+	// AmChannel is 0 if unknown
+	AmChannel          int
+	QueryLng, QueryLat string
+	// DidiCity is the city didi supplies with the query, Name is empty if none
+	DidiCity DidiCity
+	// SaveStations saves Stores as the station list
+	SaveStations bool
+}
+
+func (q *StationQuery) save(dh *DidiHooker) {
+	didiCity := normalizeCityName(q.DidiCity.Name)
+	if didiCity != "" {
+		dh.didiCities.Learn(q.DidiCity)
+	} else {
+		didiCity, _ = dh.didiCities.Name(q.DidiCity.CityID, q.DidiCity.GulfstreamCityID)
+	}
+	cities := dh.splitByCity(q.QueryLng, q.QueryLat, didiCity, q.Stores, q.List)
+	now := time.Now()
+	for city, cs := range cities {
+		dh.stats.StationsSeen(city, cs.stores)
+		if q.SaveStations {
+			if err := dh.store.UpsertStations(city, cs.stores); err != nil {
+				log.Error("update gasstation data failed:%v", err)
+			}
+		}
+		dh.saveStationDetails(city, cs.list, q.Source)
+		dh.recordPrices(city, listPriceObservations(cs.list, cs.stores, q.FuelCategory,
+			q.FuelCategoryName, q.Source, now))
 	}
 
+	meta := CaptureMeta{
+		Source:    q.Source,
+		AmChannel: q.AmChannel,
+		QueryLng:  q.QueryLng,
+		QueryLat:  q.QueryLat,
+	}
+	if meta.AmChannel == 0 {
+		meta.AmChannel = dh.didi.AmChannel
+	}
+	go func() {
+		for city, cs := range cities {
+			dh.doCollectData(city, cs.stores, meta)
+		}
+	}()
+}
+
+// gasstationHandler parses the gasstation page, data is the JSON in $CONFIG = JSON.parse(...).
+type gasstationHandler struct{}
+
+func (gasstationHandler) Name() string {
+	return "gasstation"
+}
+
+func (gasstationHandler) Parse(req *http.Request, data []byte) ([]HookRecord, error) {
 	s := string(data)
 
 	startStr := `$CONFIG = JSON.parse(`
 	start := strings.Index(s, startStr)
 	if start < 0 {
-		log.Warning("gasstation data start index not found")
-		return resp
+		return nil, errors.New("gasstation data start index not found")
 	}
 	end := strings.Index(s[start:], ");\n")
 	if end < 0 {
-		log.Warning("gasstation data end index not found")
-		return resp
+		return nil, errors.New("gasstation data end index not found")
 	}
 
 	subs := s[start+len(startStr) : start+end]
 	gasstationStr, err := strconv.Unquote(subs)
 	if err != nil {
-		log.Warning("unquote [%s] failed:%v", subs, err)
-		return resp
+		return nil, fmt.Errorf("unquote [%s] failed:%v", subs, err)
 	}
 
 	rsp := &ListGasstationRsp{}
 	if err := json.Unmarshal([]byte(gasstationStr), rsp); err != nil {
-		log.Error("unmarshal [%s] failed:%v", gasstationStr, err)
-		return resp
-	}
-
-	lng, lat := ctx.Req.URL.Query().Get("lng"), ctx.Req.URL.Query().Get("lat")
-	city := GetCityByPosition(lng, lat)
-
-	dh.dataMtx.Lock()
-	if err := rsp.updateToFile(dh.cityDataDir(city)); err != nil {
-		log.Error("update gasstation data failed:%v", err)
+		return nil, fmt.Errorf("unmarshal [%s] failed:%v", gasstationStr, err)
 	}
-	dh.dataMtx.Unlock()
-
-	go func() {
-		dh.doCollectData(city, rsp.StoreForMap, rsp.AmChannel)
-	}()
-
-	return resp
 
+	return []HookRecord{&StationQuery{
+		Source:           captureSourceGasstation,
+		Stores:           rsp.StoreForMap,
+		List:             rsp.StoreList,
+		FuelCategory:     rsp.SelectedFuelCategory,
+		FuelCategoryName: rsp.FuelCategoryName,
+		AmChannel:        rsp.AmChannel,
+		QueryLng:         req.URL.Query().Get("lng"),
+		QueryLat:         req.URL.Query().Get("lat"),
+		DidiCity:         DidiCity{CityID: rsp.CityID, GulfstreamCityID: rsp.GulfstreamCityID, Name: rsp.CityName},
+		SaveStations:     true,
+	}}, nil
 }
 
 type NearStoreRsp struct {
 	Status int    `json:"status"`
 	Msg    string `json:"msg"`
 	Data   struct {
-		StoreCount            int           `json:"store_count"`
-		StoreType             int           `json:"store_type"`
-		StoreForMap           []Store       `json:"store_for_map"`
-		StoreList             []interface{} `json:"store_list"`
-		FilterCondition       interface{}   `json:"filter_condition"`
-		SelectedFuelCategory  string        `json:"selected_fuel_category"`
-		SelectedGoodsCategory string        `json:"selected_goods_category"`
-		SelectedBrand         string        `json:"selected_brand"`
-		FuelCategoryName      string        `json:"fuel_category_name"`
-		GoodsCategoryName     string        `json:"goods_category_name"`
-		BrandName             string        `json:"brand_name"`
-		TotalScore            string        `json:"total_score"`
+		StoreCount            int             `json:"store_count"`
+		StoreType             int             `json:"store_type"`
+		StoreForMap           []Store         `json:"store_for_map"`
+		StoreList             []StoreListItem `json:"store_list"`
+		FilterCondition       interface{}     `json:"filter_condition"`
+		SelectedFuelCategory  string          `json:"selected_fuel_category"`
+		SelectedGoodsCategory string          `json:"selected_goods_category"`
+		SelectedBrand         string          `json:"selected_brand"`
+		FuelCategoryName      string          `json:"fuel_category_name"`
+		GoodsCategoryName     string          `json:"goods_category_name"`
+		BrandName             string          `json:"brand_name"`
+		TotalScore            string          `json:"total_score"`
 	} `json:"data"`
 }
 
-func (dh *DidiHooker) hookNearStore(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
-	data, err := repeatReadBody(resp)
-	if err != nil {
-		log.Warning("read near store body failed:%v", err)
-		return resp
-	}
+// nearStoreHandler parses the JSON near store API.
+type nearStoreHandler struct{}
+
+func (nearStoreHandler) Name() string {
+	return "near store"
+}
 
+func (nearStoreHandler) Parse(req *http.Request, data []byte) ([]HookRecord, error) {
 	rsp := &NearStoreRsp{}
 	if err := json.Unmarshal(data, rsp); err != nil {
-		log.Warning("unmarshal near store rsp failed:%v", err)
-		return resp
+		return nil, err
 	}
 
-	lng, lat := ctx.Req.URL.Query().Get("lng"), ctx.Req.URL.Query().Get("lat")
-	city := GetCityByPosition(lng, lat)
-	go func() {
-		dh.doCollectData(city, rsp.Data.StoreForMap, 10001)
-	}()
+	query := req.URL.Query()
+	// near store response has no city, the request may carry didi city ID
+	gulfstreamCityID, _ := strconv.Atoi(query.Get("gulfstream_city_id"))
+	return []HookRecord{&StationQuery{
+		Source:           captureSourceNearStore,
+		Stores:           rsp.Data.StoreForMap,
+		List:             rsp.Data.StoreList,
+		FuelCategory:     rsp.Data.SelectedFuelCategory,
+		FuelCategoryName: rsp.Data.FuelCategoryName,
+		QueryLng:         query.Get("lng"),
+		QueryLat:         query.Get("lat"),
+		DidiCity:         DidiCity{CityID: query.Get("city_id"), GulfstreamCityID: gulfstreamCityID},
+	}}, nil
+}
+
+// cityStations is the stations of a station query located in one city.
+type cityStations struct {
+	stores []Store
+	list   []StoreListItem
+}
 
-	return resp
+// splitByCity groups stores and list by city of every station's own position resolved
+// in one batch, stations geocoders fail to resolve are in didiCity, the city didi
+// supplies with the query, if any. Stations without position are in didiCity, or the
+// city of query position lng and lat, the map center.
+func (dh *DidiHooker) splitByCity(lng, lat, didiCity string, stores []Store, list []StoreListItem) map[string]*cityStations {
+	ids := []string{}
+	points := []point{}
+	seen := map[string]bool{}
+	add := func(storeID string, lng, lat float64) {
+		if seen[storeID] || (lng == 0 && lat == 0) {
+			return
+		}
+		seen[storeID] = true
+		ids = append(ids, storeID)
+		points = append(points, point{lng, lat})
+	}
+	for _, s := range stores {
+		add(s.StoreID, s.Lng, s.Lat)
+	}
+	for _, item := range list {
+		add(item.StoreID, item.Lng, item.Lat)
+	}
 
+	storeCity := map[string]string{}
+	regions, errs := dh.geocoder.ResolveBatch(points, didiCity)
+	failed := 0
+	for i, storeID := range ids {
+		if errs[i] != nil {
+			failed++
+			continue
+		}
+		storeCity[storeID] = regions[i].City
+	}
+	if failed > 0 {
+		log.Warning("reverse geocode %d of %d stations failed, use city of query position", failed, len(ids))
+	}
+
+	queryCity := ""
+	cityOf := func(storeID string) string {
+		if city, ok := storeCity[storeID]; ok {
+			return city
+		}
+		if queryCity == "" {
+			queryCity = didiCity
+		}
+		if queryCity == "" {
+			queryCity = cityByPosition(dh.geocoder, lng, lat)
+		}
+		return queryCity
+	}
+	cities := map[string]*cityStations{}
+	get := func(city string) *cityStations {
+		cs, ok := cities[city]
+		if !ok {
+			cs = &cityStations{}
+			cities[city] = cs
+		}
+		return cs
+	}
+	for _, s := range stores {
+		cs := get(cityOf(s.StoreID))
+		cs.stores = append(cs.stores, s)
+	}
+	for _, item := range list {
+		cs := get(cityOf(item.StoreID))
+		cs.list = append(cs.list, item)
+	}
+	return cities
 }
 
-func (dh *DidiHooker) cityDataDir(city string) string {
-	return filepath.Join(dh.dataDir, city)
+// saveStationDetails saves StoreList entries of a station query.
+func (dh *DidiHooker) saveStationDetails(city string, items []StoreListItem, source string) {
+	if len(items) == 0 {
+		return
+	}
+	now := time.Now()
+	details := make([]StationDetail, 0, len(items))
+	for _, item := range items {
+		details = append(details, StationDetail{StoreListItem: item, CapturedAt: now, Source: source})
+	}
+	if err := dh.store.UpsertStationDetails(city, details); err != nil {
+		log.Warning("save %s station details failed:%v", city, err)
+	}
 }
 
-func (dh *DidiHooker) doCollectData(city string, stores []Store, amChannel int) {
-	dir := dh.cityDataDir(city)
-	currentOrderDir := filepath.Join(dir, "currentorder")
-	repurchaseDir := filepath.Join(dir, "repurchase")
-	os.MkdirAll(currentOrderDir, 0700)
-	os.MkdirAll(repurchaseDir, 0700)
+// recordPrices saves observations whose price changed since last recorded.
+func (dh *DidiHooker) recordPrices(city string, obs []PriceObservation) {
+	obs = dh.prices.filter(obs)
+	if len(obs) == 0 {
+		return
+	}
+	if err := dh.store.AddPriceObservations(city, obs); err != nil {
+		log.Warning("save %s price observations failed:%v", city, err)
+	}
+}
 
+// doCollectData fetches current orders and repurchase drivers of stores,
+// meta is the provenance of the station query shared by all stores.
+func (dh *DidiHooker) doCollectData(city string, stores []Store, meta CaptureMeta) {
 	// current order
 	for _, store := range stores {
-		fn := filepath.Join(currentOrderDir, fmt.Sprintf("%s.json", store.StoreID))
-		fi, err := os.Lstat(fn)
-		v := map[string]CurrentOrderItem{}
-		if err == nil {
-			if time.Since(fi.ModTime()) < 5*time.Second {
-				continue
-			} else {
-				if err := encodingutil.UnmarshalJSONFromFile(fn, &v); err != nil {
-					log.Warning("unmarshal from file %s failed:%v", err)
-				}
-			}
+		if t, ok := dh.store.UpdatedAt(city, kindCurrentOrder, store.StoreID); ok && time.Since(t) < dh.didi.FetchInterval {
+			continue
 		}
 
-		currentOrderRsp, err := store.GetCurrentOrder(amChannel)
+		m := meta
+		m.StoreID, m.CapturedAt = store.StoreID, time.Now()
+		currentOrderRsp, err := store.GetCurrentOrder(dh.didi.APIBase+dh.didi.CurrentOrderPath, meta.AmChannel)
+		dh.stats.FetchDone(city, kindCurrentOrder, store.StoreID, err)
 		if err != nil {
 			log.Warning("get [store_id:%s] current order failed:%v", store.StoreID, err)
 			continue
 		}
+
+		records := make([]CurrentOrderRecord, 0, len(currentOrderRsp.Data.Items))
 		for _, item := range currentOrderRsp.Data.Items {
-			v[item.ID] = item
+			records = append(records, CurrentOrderRecord{CurrentOrderItem: item, Capture: &m})
 		}
-
-		dh.dataMtx.Lock()
-		if err := jsonMarshalIndentToFile(fn, &v); err != nil {
-			log.Warning("write json data to %s failed:%v", err)
+		if err := dh.store.MergeCurrentOrders(city, store.StoreID, records); err != nil {
+			log.Warning("save [store_id:%s] current order failed:%v", store.StoreID, err)
 		}
-		dh.dataMtx.Unlock()
-
 	}
-	files, _ := ioutil.ReadDir(currentOrderDir)
-	log.Info("saved %d store currentorder data for %s", len(files), city)
+	n, _ := dh.store.CountStores(city, kindCurrentOrder)
+	log.Info("saved %d store currentorder data for %s", n, city)
 
 	// repurchase
 	for _, store := range stores {
-		fn := filepath.Join(repurchaseDir, fmt.Sprintf("%s.json", store.StoreID))
-		fi, err := os.Lstat(fn)
-		v := map[string]RepurchaseItem{}
-		if err == nil {
-			if time.Since(fi.ModTime()) < 5*time.Second {
-				continue
-			} else {
-				if err := encodingutil.UnmarshalJSONFromFile(fn, &v); err != nil {
-					log.Warning("unmarshal from file %s failed:%v", err)
-				}
-			}
+		if t, ok := dh.store.UpdatedAt(city, kindRepurchase, store.StoreID); ok && time.Since(t) < dh.didi.FetchInterval {
+			continue
 		}
 
-		repurchaseDriverRsp, err := store.GetRepurchaseDriver(amChannel)
+		m := meta
+		m.StoreID, m.CapturedAt = store.StoreID, time.Now()
+		repurchaseDriverRsp, err := store.GetRepurchaseDriver(dh.didi.APIBase+dh.didi.RepurchasePath, meta.AmChannel)
+		dh.stats.FetchDone(city, kindRepurchase, store.StoreID, err)
 		if err != nil {
-			log.Warning("get [store_id:%s] current order failed:%v", store.StoreID, err)
+			log.Warning("get [store_id:%s] repurchase failed:%v", store.StoreID, err)
 			continue
 		}
-		for _, item := range repurchaseDriverRsp.Data.Items {
-			v[item.DriverID] = item
-		}
 
-		dh.dataMtx.Lock()
-		if err := jsonMarshalIndentToFile(fn, &v); err != nil {
-			log.Warning("write json data to %s failed:%v", err)
+		if err := dh.store.SaveRepurchaseSnapshot(city, store.StoreID, m, repurchaseDriverRsp.Data.Items); err != nil {
+			log.Warning("save [store_id:%s] repurchase failed:%v", store.StoreID, err)
 		}
-		dh.dataMtx.Unlock()
-
 	}
-	files, _ = ioutil.ReadDir(repurchaseDir)
-	log.Info("saved %d store repurchase data for %s", len(files), city)
+	n, _ = dh.store.CountStores(city, kindRepurchase)
+	log.Info("saved %d store repurchase data for %s", n, city)
 }
 
 type ListGasstationRsp struct {
@@ -288,53 +466,74 @@ type ListGasstationRsp struct {
 			} `json:"brand_info"`
 		} `json:"gas"`
 	} `json:"filter_condition"`
-	FuelCategoryName      string  `json:"fuel_category_name"`
-	GoodsCategoryName     string  `json:"goods_category_name"`
-	GulfstreamCityID      int     `json:"gulfstream_city_id"`
-	Lat                   float64 `json:"lat"`
-	Lng                   float64 `json:"lng"`
-	PassportUID           string  `json:"passport_uid"`
-	Phone                 string  `json:"phone"`
-	SelectedBrand         string  `json:"selected_brand"`
-	SelectedFuelCategory  string  `json:"selected_fuel_category"`
-	SelectedGoodsCategory string  `json:"selected_goods_category"`
-	StoreCount            int     `json:"store_count"`
-	StoreForMap           []Store `json:"store_for_map"`
-	StoreList             []struct {
-		StoreID            string        `json:"store_id"`
-		Name               string        `json:"name"`
-		Logo               string        `json:"logo"`
-		LogoX              string        `json:"logo_x"`
-		LogoXx             string        `json:"logo_xx"`
-		Lat                float64       `json:"lat"`
-		Lng                float64       `json:"lng"`
-		Price              string        `json:"price"`
-		Discount           string        `json:"discount"`
-		Distance           string        `json:"distance"`
-		Address            string        `json:"address"`
-		MonthOrderCount    string        `json:"month_order_count"`
-		RepurchaseUserRate int           `json:"repurchase_user_rate"`
-		Rank               int           `json:"rank"`
-		RankText           string        `json:"rank_text"`
-		IsNew              int           `json:"is_new"`
-		Rawid              string        `json:"rawid"`
-		ActivityNum        int           `json:"activity_num"`
-		ActivityList       []interface{} `json:"activity_list"`
-		CouponInfo         interface{}   `json:"coupon_info"`
-		PromotionContent   string        `json:"promotion_content"`
-		FreshUser          int           `json:"fresh_user"`
-		TotalScore         string        `json:"total_score"`
-		DidiGuideDiscount  string        `json:"didi_guide_discount"`
-		RankDidiDiscount   string        `json:"rank_didi_discount"`
-		RankGuideDiscount  string        `json:"rank_guide_discount"`
-		RankStoreDiscount  string        `json:"rank_store_discount"`
-		RankPrice          string        `json:"rank_price"`
-	} `json:"store_list"`
-	StoreType    int    `json:"store_type"`
-	Ticket       string `json:"ticket"`
-	UserRank     int    `json:"user_rank"`
-	UserRankImg  string `json:"user_rank_img"`
-	UserRankName string `json:"user_rank_name"`
+	FuelCategoryName      string          `json:"fuel_category_name"`
+	GoodsCategoryName     string          `json:"goods_category_name"`
+	GulfstreamCityID      int             `json:"gulfstream_city_id"`
+	Lat                   float64         `json:"lat"`
+	Lng                   float64         `json:"lng"`
+	PassportUID           string          `json:"passport_uid"`
+	Phone                 string          `json:"phone"`
+	SelectedBrand         string          `json:"selected_brand"`
+	SelectedFuelCategory  string          `json:"selected_fuel_category"`
+	SelectedGoodsCategory string          `json:"selected_goods_category"`
+	StoreCount            int             `json:"store_count"`
+	StoreForMap           []Store         `json:"store_for_map"`
+	StoreList             []StoreListItem `json:"store_list"`
+	StoreType             int             `json:"store_type"`
+	Ticket                string          `json:"ticket"`
+	UserRank              int             `json:"user_rank"`
+	UserRankImg           string          `json:"user_rank_img"`
+	UserRankName          string          `json:"user_rank_name"`
+}
+
+// listPriceObservations returns prices of stores in StoreList, and stores only in StoreForMap.
+func listPriceObservations(list []StoreListItem, stores []Store, fuelCategory, fuelCategoryName, source string, t time.Time) []PriceObservation {
+	obs := []PriceObservation{}
+	listed := map[string]bool{}
+	for _, s := range list {
+		listed[s.StoreID] = true
+		if s.Price == "" {
+			continue
+		}
+		obs = append(obs, PriceObservation{
+			StoreID:          s.StoreID,
+			Name:             s.Name,
+			FuelCategory:     fuelCategory,
+			FuelCategoryName: fuelCategoryName,
+			Price:            s.Price,
+			Discount:         s.Discount,
+			RankPrice:        s.RankPrice,
+			TotalScore:       s.TotalScore,
+			ObservedAt:       t,
+			Source:           source,
+		})
+	}
+	for _, o := range storePriceObservations(stores, fuelCategory, fuelCategoryName, source, t) {
+		if !listed[o.StoreID] {
+			obs = append(obs, o)
+		}
+	}
+	return obs
+}
+
+// storePriceObservations returns prices of stores, stores without price are skipped.
+func storePriceObservations(stores []Store, fuelCategory, fuelCategoryName, source string, t time.Time) []PriceObservation {
+	obs := []PriceObservation{}
+	for _, s := range stores {
+		if s.Price == "" {
+			continue
+		}
+		obs = append(obs, PriceObservation{
+			StoreID:          s.StoreID,
+			Name:             s.Name,
+			FuelCategory:     fuelCategory,
+			FuelCategoryName: fuelCategoryName,
+			Price:            s.Price,
+			ObservedAt:       t,
+			Source:           source,
+		})
+	}
+	return obs
 }
 
 type Store struct {
@@ -350,28 +549,6 @@ type Store struct {
 	Price    string  `json:"price"`
 }
 
-func (rsp *ListGasstationRsp) updateToFile(dir string) error {
-	if err := os.MkdirAll(dir, 0700); err != nil {
-		return err
-	}
-	fn := filepath.Join(dir, "gasstations.json")
-
-	v := map[string]Store{}
-	if _, err := os.Lstat(fn); err == nil {
-		if err := encodingutil.UnmarshalJSONFromFile(fn, &v); err != nil {
-			log.Warning("unmarshal failed:%v", err)
-			return err
-		}
-	}
-
-	for _, store := range rsp.StoreForMap {
-		v[store.StoreID] = store
-	}
-
-	return jsonMarshalIndentToFile(fn, &v)
-
-}
-
 type CurrentOrderRsp struct {
 	Status int    `json:"status"`
 	Msg    string `json:"msg"`
@@ -400,9 +577,7 @@ type CurrentOrderItem struct {
 	SavePriceFmt string `json:"save_price_fmt"`
 }
 
-func (store Store) GetCurrentOrder(amChannel int) (*CurrentOrderRsp, error) {
-	addr := "https://devcon-go.am.xiaojukeji.com/front/statistic/currentorder"
-
+func (store Store) GetCurrentOrder(addr string, amChannel int) (*CurrentOrderRsp, error) {
 	rsp := &CurrentOrderRsp{}
 	data, err := netutil.DefaultHttpClient().UserAgent(netutil.UA_CHROME).
 		RequestForm("GET", addr, map[string]interface{}{
@@ -439,8 +614,7 @@ type RepurchaseItem struct {
 	OrderDiscount1MFmt string `json:"order_discount_1m_fmt"`
 }
 
-func (store Store) GetRepurchaseDriver(amChannel int) (*RepurchaseDriverRsp, error) {
-	addr := "https://devcon-go.am.xiaojukeji.com/front/statistic/repurchase"
+func (store Store) GetRepurchaseDriver(addr string, amChannel int) (*RepurchaseDriverRsp, error) {
 	rsp := &RepurchaseDriverRsp{}
 	data, err := netutil.DefaultHttpClient().UserAgent(netutil.UA_CHROME).
 		RequestForm("GET", addr, map[string]interface{}{
@@ -448,7 +622,7 @@ func (store Store) GetRepurchaseDriver(amChannel int) (*RepurchaseDriverRsp, err
 			"store_id":   store.StoreID,
 		}).DoJSON(rsp)
 	if err != nil {
-		log.Error("get currentorder [store_id:%s] failed:[data:%s]%v", store.StoreID, data, err)
+		log.Error("get repurchase [store_id:%s] failed:[data:%s]%v", store.StoreID, data, err)
 		return nil, err
 	}
 
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/liudanking/goutil/logutil"
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v3"
+)
+
+// configEnvPrefix is the prefix of environment variables overriding config file,
+// e.g. DIDI_CAR_RANK_DIDI_HOST overrides didi.host and DIDI_CAR_RANK_FLAGS_DIR overrides flags.dir.
+const configEnvPrefix = "DIDI_CAR_RANK_"
+
+// Config is loaded from the YAML file of --config, values not set keep defaults
+// and environment variables override the file.
+type Config struct {
+	Didi  DidiConfig  `yaml:"didi"`
+	Gaode GaodeConfig `yaml:"gaode"`
+	// Flags are default values of command line flags of all commands, keyed by long flag name
+	Flags map[string]string `yaml:"flags"`
+}
+
+// DidiConfig is the didi API intercepted and requested by collect_data.
+type DidiConfig struct {
+	// Host is the host:port intercepted
+	Host string `yaml:"host"`
+	// APIBase is the URL prefix of current order and repurchase requests
+	APIBase          string `yaml:"api_base"`
+	GasstationPath   string `yaml:"gasstation_path"`
+	NearStorePath    string `yaml:"near_store_path"`
+	CurrentOrderPath string `yaml:"current_order_path"`
+	RepurchasePath   string `yaml:"repurchase_path"`
+	// AmChannel is used if the intercepted response has none
+	AmChannel int `yaml:"am_channel"`
+	// FetchInterval is the time stores are not fetched again after saved
+	FetchInterval time.Duration `yaml:"fetch_interval"`
+}
+
+type GaodeConfig struct {
+	// Key is used if --gaode-key is not set
+	Key      string `yaml:"key"`
+	RegeoURL string `yaml:"regeo_url"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Didi: DidiConfig{
+			Host:             "devcon-go.am.xiaojukeji.com:443",
+			APIBase:          "https://devcon-go.am.xiaojukeji.com",
+			GasstationPath:   "/front/gasstation/index",
+			NearStorePath:    "/map/store/near",
+			CurrentOrderPath: "/front/statistic/currentorder",
+			RepurchasePath:   "/front/statistic/repurchase",
+			AmChannel:        10001,
+			FetchInterval:    5 * time.Second,
+		},
+		Gaode: GaodeConfig{
+			RegeoURL: "http://restapi.amap.com/v3/geocode/regeo",
+		},
+		Flags: map[string]string{},
+	}
+}
+
+var configFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:   "config",
+		Usage:  "YAML config file",
+		EnvVar: configEnvPrefix + "CONFIG",
+	},
+}
+
+// loadConfig reads fn over defaults, fn may be empty, then applies environment variables.
+func loadConfig(fn string) (*Config, error) {
+	cfg := defaultConfig()
+	if fn != "" {
+		data, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("parse config %s failed:%v", fn, err)
+		}
+		if cfg.Flags == nil {
+			cfg.Flags = map[string]string{}
+		}
+	}
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+	return cfg, cfg.validate()
+}
+
+func (cfg *Config) applyEnv() error {
+	vars := []struct {
+		name  string
+		value interface{}
+	}{
+		{"DIDI_HOST", &cfg.Didi.Host},
+		{"DIDI_API_BASE", &cfg.Didi.APIBase},
+		{"DIDI_GASSTATION_PATH", &cfg.Didi.GasstationPath},
+		{"DIDI_NEAR_STORE_PATH", &cfg.Didi.NearStorePath},
+		{"DIDI_CURRENT_ORDER_PATH", &cfg.Didi.CurrentOrderPath},
+		{"DIDI_REPURCHASE_PATH", &cfg.Didi.RepurchasePath},
+		{"DIDI_AM_CHANNEL", &cfg.Didi.AmChannel},
+		{"DIDI_FETCH_INTERVAL", &cfg.Didi.FetchInterval},
+		{"GAODE_KEY", &cfg.Gaode.Key},
+		{"GAODE_REGEO_URL", &cfg.Gaode.RegeoURL},
+	}
+	for _, v := range vars {
+		s, ok := os.LookupEnv(configEnvPrefix + v.name)
+		if !ok {
+			continue
+		}
+		var err error
+		switch p := v.value.(type) {
+		case *string:
+			*p = s
+		case *int:
+			*p, err = strconv.Atoi(s)
+		case *time.Duration:
+			*p, err = time.ParseDuration(s)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid %s%s:%v", configEnvPrefix, v.name, err)
+		}
+	}
+
+	flagsPrefix := configEnvPrefix + "FLAGS_"
+	for _, env := range os.Environ() {
+		kv := strings.SplitN(env, "=", 2)
+		if len(kv) == 2 && strings.HasPrefix(kv[0], flagsPrefix) {
+			name := strings.ToLower(strings.Replace(strings.TrimPrefix(kv[0], flagsPrefix), "_", "-", -1))
+			cfg.Flags[name] = kv[1]
+		}
+	}
+	return nil
+}
+
+func (cfg *Config) validate() error {
+	if cfg.Didi.Host == "" || cfg.Didi.APIBase == "" {
+		return fmt.Errorf("didi host and api_base must not be empty")
+	}
+	paths := []struct {
+		name, value string
+	}{
+		{"gasstation_path", cfg.Didi.GasstationPath},
+		{"near_store_path", cfg.Didi.NearStorePath},
+		{"current_order_path", cfg.Didi.CurrentOrderPath},
+		{"repurchase_path", cfg.Didi.RepurchasePath},
+	}
+	for _, p := range paths {
+		if p.value == "" {
+			return fmt.Errorf("didi %s must not be empty", p.name)
+		}
+	}
+	if cfg.Didi.AmChannel <= 0 {
+		return fmt.Errorf("invalid didi am_channel %d", cfg.Didi.AmChannel)
+	}
+	if cfg.Didi.FetchInterval < 0 {
+		return fmt.Errorf("invalid didi fetch_interval %v", cfg.Didi.FetchInterval)
+	}
+	if cfg.Gaode.Key != "" && cfg.Gaode.RegeoURL == "" {
+		return fmt.Errorf("gaode regeo_url must not be empty if key is set")
+	}
+	return nil
+}
+
+// configMetadataKey is the key of loaded Config in cli.App.Metadata
+const configMetadataKey = "config"
+
+// setupConfig loads config before any command runs and checks flags of config
+// are defined by some command.
+func setupConfig(c *cli.Context) error {
+	cfg, err := loadConfig(c.GlobalString("config"))
+	if err != nil {
+		return err
+	}
+	known := map[string]bool{}
+	collectFlagNames(c.App.Commands, known)
+	unknown := []string{}
+	for name := range cfg.Flags {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown flags in config: %s", strings.Join(unknown, ", "))
+	}
+	if c.App.Metadata == nil {
+		c.App.Metadata = map[string]interface{}{}
+	}
+	c.App.Metadata[configMetadataKey] = cfg
+	return nil
+}
+
+func collectFlagNames(commands []cli.Command, names map[string]bool) {
+	for _, cmd := range commands {
+		for _, f := range cmd.Flags {
+			names[strings.TrimSpace(strings.Split(f.GetName(), ",")[0])] = true
+		}
+		collectFlagNames(cmd.Subcommands, names)
+	}
+}
+
+// configFromContext returns config loaded by setupConfig, defaults if not loaded.
+func configFromContext(c *cli.Context) *Config {
+	if cfg, ok := c.App.Metadata[configMetadataKey].(*Config); ok {
+		return cfg
+	}
+	return defaultConfig()
+}
+
+// withConfigFlags wraps actions of commands to set flags not given on command line
+// to values of config.
+func withConfigFlags(commands []cli.Command) []cli.Command {
+	for i := range commands {
+		commands[i].Subcommands = withConfigFlags(commands[i].Subcommands)
+		action, ok := commands[i].Action.(func(*cli.Context) error)
+		if !ok {
+			continue
+		}
+		commands[i].Action = func(c *cli.Context) error {
+			if err := applyConfigFlags(c, configFromContext(c)); err != nil {
+				return err
+			}
+			return action(c)
+		}
+	}
+	return commands
+}
+
+func applyConfigFlags(c *cli.Context, cfg *Config) error {
+	defined := map[string]bool{}
+	for _, name := range c.FlagNames() {
+		defined[name] = true
+	}
+	names := make([]string, 0, len(cfg.Flags))
+	for name := range cfg.Flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := cfg.Flags[name]
+		if !defined[name] || c.IsSet(name) {
+			continue
+		}
+		if err := c.Set(name, value); err != nil {
+			return fmt.Errorf("invalid config flag %s:%v", name, err)
+		}
+		log.Info("flag %s=%s from config", name, value)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(cfg *Config)
+		ok     bool
+	}{
+		{"default", func(cfg *Config) {}, true},
+		{"empty host", func(cfg *Config) { cfg.Didi.Host = "" }, false},
+		{"empty gasstation_path", func(cfg *Config) { cfg.Didi.GasstationPath = "" }, false},
+		{"empty near_store_path", func(cfg *Config) { cfg.Didi.NearStorePath = "" }, false},
+		{"empty current_order_path", func(cfg *Config) { cfg.Didi.CurrentOrderPath = "" }, false},
+		{"empty repurchase_path", func(cfg *Config) { cfg.Didi.RepurchasePath = "" }, false},
+		{"zero am_channel", func(cfg *Config) { cfg.Didi.AmChannel = 0 }, false},
+		{"negative am_channel", func(cfg *Config) { cfg.Didi.AmChannel = -1 }, false},
+		{"negative fetch_interval", func(cfg *Config) { cfg.Didi.FetchInterval = -1 }, false},
+		{"gaode key without regeo_url", func(cfg *Config) { cfg.Gaode.Key, cfg.Gaode.RegeoURL = "key", "" }, false},
+		{"no gaode key nor regeo_url", func(cfg *Config) { cfg.Gaode.RegeoURL = "" }, true},
+	}
+	for _, tt := range tests {
+		cfg := defaultConfig()
+		tt.modify(cfg)
+		if err := cfg.validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: validate() = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "didi-car-rank")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(fn, []byte(`
+didi:
+  host: file.example.com:443
+  fetch_interval: 1m
+gaode:
+  key: file-key
+flags:
+  top: "5"
+  city: 上海市
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{
+		configEnvPrefix + "DIDI_HOST":       "env.example.com:443",
+		configEnvPrefix + "DIDI_AM_CHANNEL": "20002",
+		configEnvPrefix + "FLAGS_CITY":      "成都市",
+		configEnvPrefix + "FLAGS_GROUP_BY":  "brand",
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	cfg, err := loadConfig(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// defaults < file < environment
+	if cfg.Didi.Host != "env.example.com:443" || cfg.Didi.AmChannel != 20002 || cfg.Didi.FetchInterval != time.Minute ||
+		cfg.Gaode.Key != "file-key" || cfg.Didi.APIBase != defaultConfig().Didi.APIBase {
+		t.Errorf("config = %+v", cfg)
+	}
+	want := map[string]string{"top": "5", "city": "成都市", "group-by": "brand"}
+	for name, value := range want {
+		if cfg.Flags[name] != value {
+			t.Errorf("flag %s = %q, want %q", name, cfg.Flags[name], value)
+		}
+	}
+
+	// config < command line
+	tests := []struct {
+		args      []string
+		top       int
+		city, dir string
+	}{
+		{nil, 5, "成都市", "./data"},
+		{[]string{"-t", "3", "-c", "all"}, 3, "all", "./data"},
+		{[]string{"--top", "7", "-d", "other"}, 7, "成都市", "other"},
+	}
+	for _, tt := range tests {
+		var top int
+		var city, dir string
+		app := cli.NewApp()
+		app.Flags = configFlags
+		app.Before = setupConfig
+		app.Commands = withConfigFlags([]cli.Command{
+			{
+				Name: "rank",
+				Flags: []cli.Flag{
+					cli.IntFlag{Name: "top, t", Value: 10},
+					cli.StringFlag{Name: "city, c", Value: "成都市"},
+					cli.StringFlag{Name: "group-by", Value: "model"},
+					cli.StringFlag{Name: "dir, d", Value: "./data"},
+				},
+				Action: func(c *cli.Context) error {
+					top, city, dir = c.Int("top"), c.String("city"), c.String("dir")
+					return nil
+				},
+			},
+		})
+		args := append([]string{"didi-car-rank", "--config", fn, "rank"}, tt.args...)
+		if err := app.Run(args); err != nil {
+			t.Fatalf("%v: %v", tt.args, err)
+		}
+		if top != tt.top || city != tt.city || dir != tt.dir {
+			t.Errorf("%v: top %d, city %s, dir %s, want %d, %s, %s", tt.args, top, city, dir, tt.top, tt.city, tt.dir)
+		}
+	}
+}
+
+func TestConfigUnknownFlag(t *testing.T) {
+	os.Setenv(configEnvPrefix+"FLAGS_NO_SUCH_FLAG", "1")
+	defer os.Unsetenv(configEnvPrefix + "FLAGS_NO_SUCH_FLAG")
+	app := cli.NewApp()
+	app.Flags = configFlags
+	app.Before = setupConfig
+	app.Commands = withConfigFlags([]cli.Command{
+		{Name: "rank", Action: func(c *cli.Context) error { return nil }},
+	})
+	if err := app.Run([]string{"didi-car-rank", "rank"}); err == nil {
+		t.Error("unknown flag of config is accepted")
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/urfave/cli"
+)
+
+// coordinate reference systems, didi and gaode use GCJ-02
+const (
+	crsWGS84 = "wgs84"
+	crsGCJ02 = "gcj02"
+	crsBD09  = "bd09"
+)
+
+var crsFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "crs",
+		Usage: "coordinate system of output: wgs84 (GPS, OSM), gcj02 (gaode, didi) or bd09 (baidu)",
+		Value: crsWGS84,
+	},
+}
+
+func crsFromContext(c *cli.Context) (string, error) {
+	switch crs := c.String("crs"); crs {
+	case crsWGS84, crsGCJ02, crsBD09:
+		return crs, nil
+	default:
+		return "", fmt.Errorf("unknown crs: %s", crs)
+	}
+}
+
+// parameters of Krasovsky 1940 ellipsoid used by GCJ-02
+const (
+	gcjA  = 6378245.0
+	gcjEE = 0.00669342162296594323
+	bdPi  = math.Pi * 3000.0 / 180.0
+)
+
+// outOfChina reports whether point is outside China, where GCJ-02 equals WGS-84.
+func outOfChina(lng, lat float64) bool {
+	return lng < 72.004 || lng > 137.8347 || lat < 0.8293 || lat > 55.8271
+}
+
+func gcjTransformLat(x, y float64) float64 {
+	ret := -100.0 + 2.0*x + 3.0*y + 0.2*y*y + 0.1*x*y + 0.2*math.Sqrt(math.Abs(x))
+	ret += (20.0*math.Sin(6.0*x*math.Pi) + 20.0*math.Sin(2.0*x*math.Pi)) * 2.0 / 3.0
+	ret += (20.0*math.Sin(y*math.Pi) + 40.0*math.Sin(y/3.0*math.Pi)) * 2.0 / 3.0
+	ret += (160.0*math.Sin(y/12.0*math.Pi) + 320*math.Sin(y*math.Pi/30.0)) * 2.0 / 3.0
+	return ret
+}
+
+func gcjTransformLng(x, y float64) float64 {
+	ret := 300.0 + x + 2.0*y + 0.1*x*x + 0.1*x*y + 0.1*math.Sqrt(math.Abs(x))
+	ret += (20.0*math.Sin(6.0*x*math.Pi) + 20.0*math.Sin(2.0*x*math.Pi)) * 2.0 / 3.0
+	ret += (20.0*math.Sin(x*math.Pi) + 40.0*math.Sin(x/3.0*math.Pi)) * 2.0 / 3.0
+	ret += (150.0*math.Sin(x/12.0*math.Pi) + 300.0*math.Sin(x/30.0*math.Pi)) * 2.0 / 3.0
+	return ret
+}
+
+// gcjOffset returns the offset GCJ-02 adds to WGS-84 point.
+func gcjOffset(lng, lat float64) (dLng, dLat float64) {
+	dLat = gcjTransformLat(lng-105.0, lat-35.0)
+	dLng = gcjTransformLng(lng-105.0, lat-35.0)
+	radLat := lat / 180.0 * math.Pi
+	magic := math.Sin(radLat)
+	magic = 1 - gcjEE*magic*magic
+	sqrtMagic := math.Sqrt(magic)
+	dLat = (dLat * 180.0) / ((gcjA * (1 - gcjEE)) / (magic * sqrtMagic) * math.Pi)
+	dLng = (dLng * 180.0) / (gcjA / sqrtMagic * math.Cos(radLat) * math.Pi)
+	return dLng, dLat
+}
+
+func wgs84ToGCJ02(lng, lat float64) (float64, float64) {
+	if outOfChina(lng, lat) {
+		return lng, lat
+	}
+	dLng, dLat := gcjOffset(lng, lat)
+	return lng + dLng, lat + dLat
+}
+
+// gcj02ToWGS84 inverts wgs84ToGCJ02 iteratively, error is below 1e-7 degree.
+func gcj02ToWGS84(lng, lat float64) (float64, float64) {
+	if outOfChina(lng, lat) {
+		return lng, lat
+	}
+	wLng, wLat := lng, lat
+	for i := 0; i < 10; i++ {
+		gLng, gLat := wgs84ToGCJ02(wLng, wLat)
+		dLng, dLat := gLng-lng, gLat-lat
+		wLng, wLat = wLng-dLng, wLat-dLat
+		if math.Abs(dLng) < 1e-9 && math.Abs(dLat) < 1e-9 {
+			break
+		}
+	}
+	return wLng, wLat
+}
+
+func gcj02ToBD09(lng, lat float64) (float64, float64) {
+	z := math.Sqrt(lng*lng+lat*lat) + 0.00002*math.Sin(lat*bdPi)
+	theta := math.Atan2(lat, lng) + 0.000003*math.Cos(lng*bdPi)
+	return z*math.Cos(theta) + 0.0065, z*math.Sin(theta) + 0.006
+}
+
+func bd09ToGCJ02(lng, lat float64) (float64, float64) {
+	x, y := lng-0.0065, lat-0.006
+	z := math.Sqrt(x*x+y*y) - 0.00002*math.Sin(y*bdPi)
+	theta := math.Atan2(y, x) - 0.000003*math.Cos(x*bdPi)
+	return z * math.Cos(theta), z * math.Sin(theta)
+}
+
+// convertCoord converts point from crs to crs through GCJ-02.
+func convertCoord(lng, lat float64, from, to string) (float64, float64) {
+	if from == to {
+		return lng, lat
+	}
+	switch from {
+	case crsWGS84:
+		lng, lat = wgs84ToGCJ02(lng, lat)
+	case crsBD09:
+		lng, lat = bd09ToGCJ02(lng, lat)
+	}
+	switch to {
+	case crsWGS84:
+		return gcj02ToWGS84(lng, lat)
+	case crsBD09:
+		return gcj02ToBD09(lng, lat)
+	}
+	return lng, lat
+}
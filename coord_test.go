@@ -0,0 +1,57 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestWGS84ToGCJ02(t *testing.T) {
+	tests := []struct {
+		name           string
+		lng, lat       float64
+		gcjLng, gcjLat float64
+		bdLng, bdLat   float64
+	}{
+		{"北京", 116.391275, 39.906217, 116.397516, 39.907618, 116.403890, 39.913962},
+		{"上海", 121.4737, 31.2304, 121.478223, 31.228458, 121.484781, 31.234311},
+		{"成都", 104.0657, 30.6574, 104.068207, 30.654978, 104.074704, 30.661009},
+		{"香港", 114.1588, 22.2810, 114.163793, 22.278280, 114.170321, 22.284050},
+	}
+	near := func(a, b, tolerance float64) bool { return math.Abs(a-b) <= tolerance }
+	for _, tt := range tests {
+		gLng, gLat := wgs84ToGCJ02(tt.lng, tt.lat)
+		if !near(gLng, tt.gcjLng, 1e-6) || !near(gLat, tt.gcjLat, 1e-6) {
+			t.Errorf("%s: wgs84ToGCJ02 = %f, %f, want %f, %f", tt.name, gLng, gLat, tt.gcjLng, tt.gcjLat)
+		}
+		bLng, bLat := gcj02ToBD09(gLng, gLat)
+		if !near(bLng, tt.bdLng, 1e-6) || !near(bLat, tt.bdLat, 1e-6) {
+			t.Errorf("%s: gcj02ToBD09 = %f, %f, want %f, %f", tt.name, bLng, bLat, tt.bdLng, tt.bdLat)
+		}
+
+		// round trips
+		if lng, lat := gcj02ToWGS84(gLng, gLat); !near(lng, tt.lng, 1e-7) || !near(lat, tt.lat, 1e-7) {
+			t.Errorf("%s: gcj02ToWGS84 = %f, %f, want %f, %f", tt.name, lng, lat, tt.lng, tt.lat)
+		}
+		if lng, lat := bd09ToGCJ02(bLng, bLat); !near(lng, gLng, 1e-5) || !near(lat, gLat, 1e-5) {
+			t.Errorf("%s: bd09ToGCJ02 = %f, %f, want %f, %f", tt.name, lng, lat, gLng, gLat)
+		}
+		if lng, lat := convertCoord(bLng, bLat, crsBD09, crsWGS84); !near(lng, tt.lng, 1e-5) || !near(lat, tt.lat, 1e-5) {
+			t.Errorf("%s: convertCoord bd09 to wgs84 = %f, %f, want %f, %f", tt.name, lng, lat, tt.lng, tt.lat)
+		}
+		if lng, lat := convertCoord(tt.lng, tt.lat, crsWGS84, crsBD09); !near(lng, tt.bdLng, 1e-6) || !near(lat, tt.bdLat, 1e-6) {
+			t.Errorf("%s: convertCoord wgs84 to bd09 = %f, %f, want %f, %f", tt.name, lng, lat, tt.bdLng, tt.bdLat)
+		}
+	}
+}
+
+func TestOutOfChina(t *testing.T) {
+	// GCJ-02 equals WGS-84 outside China
+	for _, p := range [][2]float64{{139.6917, 35.6895}, {-0.1276, 51.5072}} {
+		if lng, lat := wgs84ToGCJ02(p[0], p[1]); lng != p[0] || lat != p[1] {
+			t.Errorf("wgs84ToGCJ02(%v) = %f, %f", p, lng, lat)
+		}
+		if lng, lat := gcj02ToWGS84(p[0], p[1]); lng != p[0] || lat != p[1] {
+			t.Errorf("gcj02ToWGS84(%v) = %f, %f", p, lng, lat)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/liudanking/goutil/logutil"
+)
+
+// data kinds fetched for every station
+const (
+	kindCurrentOrder = "currentorder"
+	kindRepurchase   = "repurchase"
+)
+
+type CityStats struct {
+	City                 string    `json:"city"`
+	Stations             int       `json:"stations"`
+	CurrentOrderStations int       `json:"currentorder_stations"`
+	RepurchaseStations   int       `json:"repurchase_stations"`
+	LastFetch            time.Time `json:"last_fetch"`
+	Fetches              int       `json:"fetches"`
+	Errors               int       `json:"errors"`
+	ErrorRate            float64   `json:"error_rate"`
+}
+
+type cityCollectStats struct {
+	stations     map[string]bool
+	currentOrder map[string]bool
+	repurchase   map[string]bool
+	lastFetch    time.Time
+	fetches      int
+	errors       int
+}
+
+// CollectStats records collection progress of current session per city.
+type CollectStats struct {
+	mtx    sync.Mutex
+	cities map[string]*cityCollectStats
+}
+
+func NewCollectStats() *CollectStats {
+	return &CollectStats{
+		cities: map[string]*cityCollectStats{},
+	}
+}
+
+func (cs *CollectStats) city(city string) *cityCollectStats {
+	s, ok := cs.cities[city]
+	if !ok {
+		s = &cityCollectStats{
+			stations:     map[string]bool{},
+			currentOrder: map[string]bool{},
+			repurchase:   map[string]bool{},
+		}
+		cs.cities[city] = s
+	}
+	return s
+}
+
+func (cs *CollectStats) StationsSeen(city string, stores []Store) {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	s := cs.city(city)
+	for _, store := range stores {
+		s.stations[store.StoreID] = true
+	}
+}
+
+func (cs *CollectStats) FetchDone(city, kind, storeID string, err error) {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	s := cs.city(city)
+	s.fetches++
+	s.lastFetch = time.Now()
+	if err != nil {
+		s.errors++
+		return
+	}
+	switch kind {
+	case kindCurrentOrder:
+		s.currentOrder[storeID] = true
+	case kindRepurchase:
+		s.repurchase[storeID] = true
+	}
+}
+
+func (cs *CollectStats) Snapshot() []CityStats {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	list := make([]CityStats, 0, len(cs.cities))
+	for city, s := range cs.cities {
+		stats := CityStats{
+			City:                 city,
+			Stations:             len(s.stations),
+			CurrentOrderStations: len(s.currentOrder),
+			RepurchaseStations:   len(s.repurchase),
+			LastFetch:            s.lastFetch,
+			Fetches:              s.fetches,
+			Errors:               s.errors,
+		}
+		if s.fetches > 0 {
+			stats.ErrorRate = float64(s.errors) / float64(s.fetches)
+		}
+		list = append(list, stats)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].City < list[j].City })
+	return list
+}
+
+// Dashboard serves collection progress over HTTP, updated by Server-Sent Events.
+type Dashboard struct {
+	stats *CollectStats
+	// geocoder is nil if geocoding is not cached
+	geocoder *CachedGeocoder
+	interval time.Duration
+}
+
+func NewDashboard(stats *CollectStats, geocoder *CachedGeocoder) *Dashboard {
+	return &Dashboard{
+		stats:    stats,
+		geocoder: geocoder,
+		interval: time.Second,
+	}
+}
+
+func (d *Dashboard) ListenAndServe(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", d.serveIndex)
+	mux.HandleFunc("/stats", d.serveStats)
+	mux.HandleFunc("/events", d.serveEvents)
+	mux.HandleFunc("/geocode", d.serveGeocodeStats)
+	log.Info("dashboard serving %s", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+func (d *Dashboard) serveIndex(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/" {
+		http.NotFound(w, req)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTmpl.Execute(w, nil); err != nil {
+		log.Warning("render dashboard failed:%v", err)
+	}
+}
+
+func (d *Dashboard) serveStats(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, d.stats.Snapshot())
+}
+
+func (d *Dashboard) serveGeocodeStats(w http.ResponseWriter, req *http.Request) {
+	if d.geocoder == nil {
+		http.NotFound(w, req)
+		return
+	}
+	writeJSON(w, d.geocoder.Stats())
+}
+
+func (d *Dashboard) serveEvents(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		data, err := json.Marshal(d.stats.Snapshot())
+		if err != nil {
+			log.Warning("marshal stats failed:%v", err)
+			return
+		}
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-req.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+var dashboardTmpl = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Didi Car Rank 数据采集</title>
+<style>
+body { font-family: -apple-system, sans-serif; margin: 24px; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 4px 12px; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+.done { background: #e6f6e6; }
+#conn { color: #888; }
+</style>
+</head>
+<body>
+<h2>数据采集进度 <small id="conn">连接中...</small></h2>
+<table>
+<thead>
+<tr><th>城市</th><th>加油站</th><th>实时订单</th><th>回头客</th><th>最近采集</th><th>请求数</th><th>错误率</th></tr>
+</thead>
+<tbody id="rows"></tbody>
+</table>
+<p id="geocode"></p>
+<script>
+function render(list) {
+  var rows = document.getElementById("rows");
+  rows.innerHTML = "";
+  list.forEach(function(s) {
+    var tr = document.createElement("tr");
+    if (s.stations > 0 && s.currentorder_stations >= s.stations && s.repurchase_stations >= s.stations) {
+      tr.className = "done";
+    }
+    var last = new Date(s.last_fetch);
+    [s.city, s.stations, s.currentorder_stations, s.repurchase_stations,
+     last.getFullYear() > 1 ? last.toLocaleTimeString() : "-",
+     s.fetches, (s.error_rate * 100).toFixed(1) + "%"].forEach(function(v) {
+      var td = document.createElement("td");
+      td.textContent = v;
+      tr.appendChild(td);
+    });
+    rows.appendChild(tr);
+  });
+}
+var es = new EventSource("/events");
+es.onopen = function() { document.getElementById("conn").textContent = "实时更新中"; };
+es.onerror = function() { document.getElementById("conn").textContent = "连接断开, 重连中..."; };
+es.onmessage = function(e) {
+  render(JSON.parse(e.data));
+  fetch("/geocode").then(function(rsp) { return rsp.ok ? rsp.json() : null; }).then(function(s) {
+    if (s) {
+      document.getElementById("geocode").textContent = "城市解析缓存: " + s.lookups + " 次查询, 命中率 " +
+        (s.hit_rate * 100).toFixed(1) + "%, 未命中 " + s.misses + " 次, 使用滴滴城市 " + s.didi_city_hits + " 次, 失败 " + s.errors + " 次";
+    }
+  });
+};
+</script>
+</body>
+</html>
+`))
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCollectStats(t *testing.T) {
+	cs := NewCollectStats()
+	cs.StationsSeen("深圳市", []Store{{StoreID: "1"}, {StoreID: "2"}, {StoreID: "3"}})
+	cs.StationsSeen("成都市", []Store{{StoreID: "4"}})
+	// the same station seen again
+	cs.StationsSeen("成都市", []Store{{StoreID: "4"}})
+	cs.FetchDone("深圳市", kindCurrentOrder, "1", nil)
+	cs.FetchDone("深圳市", kindCurrentOrder, "1", nil)
+	cs.FetchDone("深圳市", kindRepurchase, "1", nil)
+	cs.FetchDone("深圳市", kindRepurchase, "2", errors.New("timeout"))
+
+	tests := []CityStats{
+		{City: "成都市", Stations: 1},
+		{City: "深圳市", Stations: 3, CurrentOrderStations: 1, RepurchaseStations: 1, Fetches: 4, Errors: 1, ErrorRate: 0.25},
+	}
+	list := cs.Snapshot()
+	if len(list) != len(tests) {
+		t.Fatalf("Snapshot() = %+v", list)
+	}
+	for i, want := range tests {
+		got := list[i]
+		if got.City != want.City || got.Stations != want.Stations ||
+			got.CurrentOrderStations != want.CurrentOrderStations || got.RepurchaseStations != want.RepurchaseStations ||
+			got.Fetches != want.Fetches || got.Errors != want.Errors || got.ErrorRate != want.ErrorRate {
+			t.Errorf("Snapshot()[%d] = %+v, want %+v", i, got, want)
+		}
+		if (want.Fetches > 0) == got.LastFetch.IsZero() {
+			t.Errorf("%s: LastFetch = %v", want.City, got.LastFetch)
+		}
+	}
+}
+
+func TestDashboardEvents(t *testing.T) {
+	cs := NewCollectStats()
+	cs.StationsSeen("深圳市", []Store{{StoreID: "1"}})
+	d := NewDashboard(cs, nil)
+	d.interval = 10 * time.Millisecond
+	srv := httptest.NewServer(http.HandlerFunc(d.serveEvents))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type = %s", ct)
+	}
+
+	// events keep coming and reflect fetches done after the stream started
+	r := bufio.NewReader(resp.Body)
+	for n := 0; ; n++ {
+		line, err := r.ReadString('\n')
+		for err == nil && !strings.HasPrefix(line, "data: ") {
+			line, err = r.ReadString('\n')
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		list := []CityStats{}
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &list); err != nil {
+			t.Fatal(err)
+		}
+		if len(list) != 1 || list[0].City != "深圳市" || list[0].Stations != 1 {
+			t.Fatalf("event %d = %+v", n, list)
+		}
+		if n == 0 {
+			cs.FetchDone("深圳市", kindCurrentOrder, "1", nil)
+			continue
+		}
+		if list[0].CurrentOrderStations == 1 {
+			break
+		}
+		if n > 100 {
+			t.Fatalf("event %d = %+v, want the fetch done", n, list)
+		}
+	}
+}
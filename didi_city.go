@@ -0,0 +1,117 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/liudanking/goutil/logutil"
+)
+
+// DidiCity is a city didi supplies with gasstation pages, keyed by CityID,
+// GulfstreamCityID is the city ID of didi ride-hailing.
+type DidiCity struct {
+	CityID           string    `json:"city_id"`
+	GulfstreamCityID int       `json:"gulfstream_city_id,omitempty"`
+	Name             string    `json:"name"`
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+// cityNameSuffixes are administrative suffixes of prefecture-level region names,
+// 州 alone is not one of them as in 杭州 and 广州.
+var cityNameSuffixes = []string{"市", "自治州", "地区", "盟", "特别行政区", "特別行政區"}
+
+// sarNames maps names of special administrative regions to the names of gaode
+// and city boundaries.
+var sarNames = map[string]string{
+	"香港":      "香港特別行政區",
+	"香港特别行政区": "香港特別行政區",
+	"澳门":      "澳門特別行政區",
+	"澳門":      "澳門特別行政區",
+	"澳门特别行政区": "澳門特別行政區",
+}
+
+// normalizeCityName appends 市 to didi city name without administrative suffix,
+// so that it matches names of gaode and city boundaries, e.g. 成都 to 成都市.
+// Special administrative regions are mapped by sarNames.
+func normalizeCityName(name string) string {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return ""
+	}
+	if sar, ok := sarNames[name]; ok {
+		return sar
+	}
+	for _, suffix := range cityNameSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return name
+		}
+	}
+	return name + "市"
+}
+
+// DidiCityTable is the mapping of didi city IDs to names learned from gasstation pages,
+// persisted in store so that responses without city name can be resolved.
+type DidiCityTable struct {
+	mtx          sync.Mutex
+	store        DataStore
+	byID         map[string]DidiCity
+	byGulfstream map[int]DidiCity
+}
+
+func NewDidiCityTable(store DataStore) (*DidiCityTable, error) {
+	cities, err := store.DidiCities()
+	if err != nil {
+		return nil, err
+	}
+	t := &DidiCityTable{
+		store:        store,
+		byID:         map[string]DidiCity{},
+		byGulfstream: map[int]DidiCity{},
+	}
+	for _, city := range cities {
+		t.add(city)
+	}
+	log.Info("loaded %d didi cities", len(cities))
+	return t, nil
+}
+
+func (t *DidiCityTable) add(city DidiCity) {
+	t.byID[city.CityID] = city
+	if city.GulfstreamCityID != 0 {
+		t.byGulfstream[city.GulfstreamCityID] = city
+	}
+}
+
+// Learn saves city if it is new or changed.
+func (t *DidiCityTable) Learn(city DidiCity) {
+	city.Name = normalizeCityName(city.Name)
+	if city.CityID == "" || city.Name == "" {
+		return
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if old, ok := t.byID[city.CityID]; ok && old.Name == city.Name && old.GulfstreamCityID == city.GulfstreamCityID {
+		return
+	}
+	city.UpdatedAt = time.Now()
+	t.add(city)
+	if err := t.store.PutDidiCity(city); err != nil {
+		log.Warning("save didi city %s %s failed:%v", city.CityID, city.Name, err)
+		return
+	}
+	log.Info("learned didi city %s: %s", city.CityID, city.Name)
+}
+
+// Name returns name of city ID, or of gulfstream city ID if city ID is unknown.
+func (t *DidiCityTable) Name(cityID string, gulfstreamCityID int) (string, bool) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if city, ok := t.byID[cityID]; ok && cityID != "" {
+		return city.Name, true
+	}
+	if city, ok := t.byGulfstream[gulfstreamCityID]; ok && gulfstreamCityID != 0 {
+		return city.Name, true
+	}
+	return "", false
+}
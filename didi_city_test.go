@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestNormalizeCityName(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"", ""},
+		{" 成都 ", "成都市"},
+		{"成都市", "成都市"},
+		{"杭州", "杭州市"},
+		{"广州", "广州市"},
+		{"恩施土家族苗族自治州", "恩施土家族苗族自治州"},
+		{"阿里地区", "阿里地区"},
+		{"锡林郭勒盟", "锡林郭勒盟"},
+		{"香港", "香港特別行政區"},
+		{"香港特别行政区", "香港特別行政區"},
+		{"香港特別行政區", "香港特別行政區"},
+		{"澳门", "澳門特別行政區"},
+		{"澳門", "澳門特別行政區"},
+		{"澳门特别行政区", "澳門特別行政區"},
+	}
+	for _, tt := range tests {
+		if got := normalizeCityName(tt.name); got != tt.want {
+			t.Errorf("normalizeCityName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
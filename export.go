@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	log "github.com/liudanking/goutil/logutil"
+	"github.com/urfave/cli"
+)
+
+var exportFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "dir, d",
+		Usage: "data directory",
+		Value: "./data",
+	},
+	cli.StringFlag{
+		Name:  "city, c",
+		Usage: "city name, comma-separated list, glob pattern or all",
+		Value: "成都市",
+	},
+	cli.StringFlag{
+		Name:  "output, o",
+		Usage: "output file, default stdout",
+	},
+}
+
+// GeoJSON types of RFC 7946, only points are used.
+type GeoJSONFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []GeoJSONFeature `json:"features"`
+}
+
+type GeoJSONFeature struct {
+	Type       string            `json:"type"`
+	Geometry   GeoJSONGeometry   `json:"geometry"`
+	Properties StationProperties `json:"properties"`
+}
+
+type GeoJSONGeometry struct {
+	Type string `json:"type"`
+	// Coordinates is [lng, lat] in WGS-84 unless exported with other --crs
+	Coordinates []float64 `json:"coordinates"`
+}
+
+// StationProperties is what is known about a station, MonthOrders is 0 if unknown.
+type StationProperties struct {
+	City          string `json:"city"`
+	StoreID       string `json:"store_id"`
+	Name          string `json:"name"`
+	Address       string `json:"address,omitempty"`
+	Brand         string `json:"brand"`
+	Price         string `json:"price,omitempty"`
+	MonthOrders   int    `json:"month_orders,omitempty"`
+	CurrentOrders int    `json:"current_orders"`
+	// DominantModel is the car model with most current orders
+	DominantModel       string  `json:"dominant_model,omitempty"`
+	DominantModelOrders int     `json:"dominant_model_orders,omitempty"`
+	RepurchaseDrivers   int     `json:"repurchase_drivers"`
+	RepurchaseScore     float64 `json:"repurchase_score"`
+}
+
+// stationFeatures builds a feature of every station with coordinates in cities.
+func stationFeatures(c *cli.Context) (*GeoJSONFeatureCollection, error) {
+	store, err := openDataStore(c)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+	cities, err := resolveCities(store, c.String("city"))
+	if err != nil {
+		return nil, err
+	}
+	w, err := timeWindowFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+	sel, err := snapshotSelectorFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+	cn, err := carModelNormalizerFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+	crs, err := crsFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	fc := &GeoJSONFeatureCollection{Type: "FeatureCollection", Features: []GeoJSONFeature{}}
+	for _, city := range cities {
+		features, err := cityStationFeatures(store, city, w, sel, cn, crs)
+		if err != nil {
+			return nil, fmt.Errorf("export %s failed:%v", city, err)
+		}
+		fc.Features = append(fc.Features, features...)
+	}
+	return fc, nil
+}
+
+// cityStationFeatures converts GCJ-02 coordinates of stations to crs.
+func cityStationFeatures(store DataStore, city string, w TimeWindow, sel SnapshotSelector,
+	cn *CarModelNormalizer, crs string) ([]GeoJSONFeature, error) {
+	props := map[string]*StationProperties{}
+	coords := map[string][]float64{}
+	station := func(storeID, name string, lng, lat float64) *StationProperties {
+		p, ok := props[storeID]
+		if !ok {
+			p = &StationProperties{City: city, StoreID: storeID}
+			props[storeID] = p
+		}
+		if name != "" {
+			p.Name, p.Brand = name, stationBrand(name)
+		}
+		if lng != 0 || lat != 0 {
+			lng, lat = convertCoord(lng, lat, crsGCJ02, crs)
+			coords[storeID] = []float64{lng, lat}
+		}
+		return p
+	}
+
+	if err := store.ForEachStation(city, func(s Store) error {
+		station(s.StoreID, s.Name, s.Lng, s.Lat).Price = s.Price
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := store.ForEachStationDetail(city, func(d StationDetail) error {
+		p := station(d.StoreID, d.Name, d.Lng, d.Lat)
+		p.Address = d.Address
+		p.MonthOrders, _ = d.MonthOrders()
+		if d.Price != "" {
+			p.Price = d.Price
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	storeModelCount := map[string]map[string]int{}
+	if err := store.ForEachCurrentOrder(city, func(storeID string, rec CurrentOrderRecord) error {
+		if rec.CarModel == "" || !w.ContainsUnix(int64(rec.PayTime)) {
+			return nil
+		}
+		if storeModelCount[storeID] == nil {
+			storeModelCount[storeID] = map[string]int{}
+		}
+		storeModelCount[storeID][cn.NormalizeName(rec.CarModel)]++
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	for storeID, counts := range storeModelCount {
+		p := station(storeID, "", 0, 0)
+		for model, count := range counts {
+			p.CurrentOrders += count
+			if count > p.DominantModelOrders || (count == p.DominantModelOrders && model < p.DominantModel) {
+				p.DominantModel, p.DominantModelOrders = model, count
+			}
+		}
+	}
+
+	type driverKey struct {
+		storeID  string
+		driverID string
+	}
+	driverSnaps := map[driverKey][]RepurchaseSnapshot{}
+	if err := store.ForEachRepurchaseSnapshot(city, func(storeID string, snap RepurchaseSnapshot) error {
+		if w.Contains(snap.CapturedAt) {
+			key := driverKey{storeID, snap.DriverID}
+			driverSnaps[key] = append(driverSnaps[key], snap)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	for key, snaps := range driverSnaps {
+		if _, score, ok := sel.Select(snaps); ok {
+			p := station(key.storeID, "", 0, 0)
+			p.RepurchaseDrivers++
+			p.RepurchaseScore += score
+		}
+	}
+
+	ids := []string{}
+	for storeID := range props {
+		if _, ok := coords[storeID]; ok {
+			ids = append(ids, storeID)
+		}
+	}
+	if skipped := len(props) - len(ids); skipped > 0 {
+		log.Warning("%d stations of %s have no coordinates", skipped, city)
+	}
+	sort.Strings(ids)
+	features := make([]GeoJSONFeature, 0, len(ids))
+	for _, storeID := range ids {
+		features = append(features, GeoJSONFeature{
+			Type:       "Feature",
+			Geometry:   GeoJSONGeometry{Type: "Point", Coordinates: coords[storeID]},
+			Properties: *props[storeID],
+		})
+	}
+	return features, nil
+}
+
+// createOutput returns file output or stdout if output is empty.
+func createOutput(output string) (io.WriteCloser, error) {
+	if output == "" {
+		return nopWriteCloser{os.Stdout}, nil
+	}
+	return os.Create(output)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func exportGeoJSON(c *cli.Context) error {
+	fc, err := stationFeatures(c)
+	if err != nil {
+		return err
+	}
+	w, err := createOutput(c.String("output"))
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(fc); err != nil {
+		return err
+	}
+	log.Info("exported %d stations", len(fc.Features))
+	return nil
+}
+
+// leafletCDN is used if no local Leaflet is given, the map then needs network.
+const leafletCDN = "https://unpkg.com/leaflet@1.3.1/dist/"
+
+func exportMap(c *cli.Context) error {
+	fc, err := stationFeatures(c)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(fc)
+	if err != nil {
+		return err
+	}
+	params := map[string]interface{}{
+		"Title":    "滴滴加油站分布",
+		"Features": template.JS(data),
+		"Tiles":    c.String("tiles"),
+		"CDN":      leafletCDN,
+	}
+	if dir := c.String("leaflet"); dir != "" {
+		js, err := ioutil.ReadFile(filepath.Join(dir, "leaflet.js"))
+		if err != nil {
+			return fmt.Errorf("read leaflet.js failed:%v", err)
+		}
+		css, err := ioutil.ReadFile(filepath.Join(dir, "leaflet.css"))
+		if err != nil {
+			return fmt.Errorf("read leaflet.css failed:%v", err)
+		}
+		params["LeafletJS"], params["LeafletCSS"] = template.JS(js), template.CSS(css)
+	} else {
+		log.Warning("--leaflet is not set, the map loads Leaflet from %s and needs network", leafletCDN)
+	}
+
+	w, err := createOutput(c.String("output"))
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	if err := mapHTMLTmpl.Execute(w, params); err != nil {
+		return err
+	}
+	log.Info("exported %d stations", len(fc.Features))
+	return nil
+}
+
+// mapHTMLTmpl draws stations as circles sized by current orders and colored by
+// repurchase score, on local tiles if given or a plain background.
+var mapHTMLTmpl = template.Must(template.New("map").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+{{if .LeafletCSS}}<style>{{.LeafletCSS}}</style>{{else}}<link rel="stylesheet" href="{{.CDN}}leaflet.css">{{end}}
+{{if .LeafletJS}}<script>{{.LeafletJS}}</script>{{else}}<script src="{{.CDN}}leaflet.js"></script>{{end}}
+<style>
+html, body, #map { height: 100%; margin: 0; }
+#map { background: #f5f3ef; }
+.legend { background: #fff; padding: 6px 8px; font: 12px sans-serif; }
+</style>
+</head>
+<body>
+<div id="map"></div>
+<script>
+var stations = {{.Features}};
+var map = L.map('map');
+{{if .Tiles}}L.tileLayer({{.Tiles}}, {maxZoom: 18}).addTo(map);{{end}}
+
+var maxOrders = 1, maxScore = 1;
+stations.features.forEach(function (f) {
+	maxOrders = Math.max(maxOrders, f.properties.current_orders);
+	maxScore = Math.max(maxScore, f.properties.repurchase_score);
+});
+function color(score) {
+	var t = Math.sqrt(score / maxScore);
+	return 'hsl(' + Math.round(220 - 220 * t) + ', 80%, 45%)';
+}
+function popup(p) {
+	var rows = [
+		['加油站', p.name], ['地址', p.address], ['品牌', p.brand], ['价格', p.price],
+		['月加油次数', p.month_orders], ['实时订单数', p.current_orders],
+		['主力车型', p.dominant_model ? p.dominant_model + ' (' + p.dominant_model_orders + ')' : ''],
+		['回头客司机', p.repurchase_drivers], ['加油积分', p.repurchase_score]
+	];
+	return rows.filter(function (r) { return r[1]; }).map(function (r) {
+		var v = document.createElement('span');
+		v.textContent = r[1];
+		return '<b>' + r[0] + '</b>: ' + v.innerHTML;
+	}).join('<br>');
+}
+var layer = L.geoJSON(stations, {
+	pointToLayer: function (f, latlng) {
+		return L.circleMarker(latlng, {
+			radius: 4 + 16 * Math.sqrt(f.properties.current_orders / maxOrders),
+			color: color(f.properties.repurchase_score),
+			weight: 1,
+			fillOpacity: 0.6
+		});
+	},
+	onEachFeature: function (f, l) { l.bindPopup(popup(f.properties)); }
+}).addTo(map);
+if (stations.features.length > 0) {
+	map.fitBounds(layer.getBounds());
+} else {
+	map.setView([35, 105], 4);
+}
+
+var legend = L.control({position: 'bottomright'});
+legend.onAdd = function () {
+	var div = L.DomUtil.create('div', 'legend');
+	div.innerHTML = '圆圈大小: 实时订单数<br><span style="color:' + color(0) + '">●</span> 加油积分低 ' +
+		'<span style="color:' + color(maxScore) + '">●</span> 加油积分高';
+	return div;
+};
+legend.addTo(map);
+</script>
+</body>
+</html>
+`))
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCityStationFeatures(t *testing.T) {
+	capturedAt := time.Date(2018, 6, 10, 12, 0, 0, 0, time.Local)
+	forEachBackend(t, func(backend string, store DataStore) {
+		for _, step := range []error{
+			store.UpsertStations("成都市", []Store{
+				{StoreID: "s1", Name: "中石化天府站", Lat: 30.6, Lng: 104.1, Price: "6.80"},
+				{StoreID: "s2", Name: "某某加油站", Lat: 30.7, Lng: 104.0},
+			}),
+			// details win over the map, s3 is only in details
+			store.UpsertStationDetails("成都市", []StationDetail{
+				{StoreListItem: StoreListItem{StoreID: "s1", Name: "中石化天府站", Lat: 30.6, Lng: 104.1, Price: "6.50",
+					Address: "天府大道1号", MonthOrderCount: "1.2万"}},
+				{StoreListItem: StoreListItem{StoreID: "s3", Name: "壳牌", Lat: 30.5, Lng: 104.2}},
+			}),
+			store.MergeCurrentOrders("成都市", "s1", currentOrderRecords([]CurrentOrderItem{
+				{ID: "o1", CarModel: "大众新捷达"}, {ID: "o2", CarModel: "大众捷达"}, {ID: "o3", CarModel: "比亚迪秦"}, {ID: "o4"},
+			})),
+			// ties of dominant model are broken by model name
+			store.MergeCurrentOrders("成都市", "s2", currentOrderRecords([]CurrentOrderItem{
+				{ID: "o5", CarModel: "比亚迪秦"}, {ID: "o6", CarModel: "丰田卡罗拉"},
+			})),
+			// s4 has no coordinates and is left out
+			store.MergeCurrentOrders("成都市", "s4", currentOrderRecords([]CurrentOrderItem{{ID: "o7", CarModel: "比亚迪秦"}})),
+			store.SaveRepurchaseSnapshot("成都市", "s1", CaptureMeta{CapturedAt: capturedAt}, []RepurchaseItem{
+				{DriverID: "d1", CarModel: "比亚迪秦", OrderCount1M: 5}, {DriverID: "d2", CarModel: "大众捷达", OrderCount1M: 3},
+			}),
+			store.SaveRepurchaseSnapshot("成都市", "s1", CaptureMeta{CapturedAt: capturedAt.Add(time.Hour)}, []RepurchaseItem{
+				{DriverID: "d1", CarModel: "比亚迪秦", OrderCount1M: 6},
+			}),
+		} {
+			if step != nil {
+				t.Fatalf("%s: %v", backend, step)
+			}
+		}
+
+		features, err := cityStationFeatures(store, "成都市", TimeWindow{}, SnapshotSelector{Mode: SnapshotLatest}, NewCarModelNormalizer(), crsGCJ02)
+		if err != nil {
+			t.Fatalf("%s: %v", backend, err)
+		}
+		want := []StationProperties{
+			{City: "成都市", StoreID: "s1", Name: "中石化天府站", Address: "天府大道1号", Brand: "中国石化", Price: "6.50", MonthOrders: 12000,
+				CurrentOrders: 3, DominantModel: "大众捷达", DominantModelOrders: 2, RepurchaseDrivers: 2, RepurchaseScore: 9},
+			{City: "成都市", StoreID: "s2", Name: "某某加油站", Brand: stationBrandPrivate,
+				CurrentOrders: 2, DominantModel: "丰田卡罗拉", DominantModelOrders: 1},
+			{City: "成都市", StoreID: "s3", Name: "壳牌", Brand: "壳牌"},
+		}
+		if len(features) != len(want) {
+			t.Fatalf("%s: features = %+v", backend, features)
+		}
+		for i, f := range features {
+			if f.Properties != want[i] {
+				t.Errorf("%s: properties = %+v, want %+v", backend, f.Properties, want[i])
+			}
+		}
+		if g := features[0].Geometry; g.Type != "Point" || len(g.Coordinates) != 2 || g.Coordinates[0] != 104.1 || g.Coordinates[1] != 30.6 {
+			t.Errorf("%s: geometry = %+v", backend, g)
+		}
+
+		// unknown values are omitted, counts are always present
+		data, err := json.Marshal(GeoJSONFeatureCollection{Type: "FeatureCollection", Features: features[2:]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantJSON := `{"type":"FeatureCollection","features":[{"type":"Feature","geometry":{"type":"Point","coordinates":[104.2,30.5]},` +
+			`"properties":{"city":"成都市","store_id":"s3","name":"壳牌","brand":"壳牌","current_orders":0,"repurchase_drivers":0,"repurchase_score":0}}]}`
+		if string(data) != wantJSON {
+			t.Errorf("%s: geojson = %s, want %s", backend, data, wantJSON)
+		}
+	})
+}
+
+func TestMapHTML(t *testing.T) {
+	data, err := json.Marshal(GeoJSONFeatureCollection{Type: "FeatureCollection", Features: []GeoJSONFeature{{
+		Type:       "Feature",
+		Geometry:   GeoJSONGeometry{Type: "Point", Coordinates: []float64{104.1, 30.6}},
+		Properties: StationProperties{StoreID: "s1", Name: "</script><script>alert(1)</script>"},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if err := mapHTMLTmpl.Execute(buf, map[string]interface{}{
+		"Title":    "滴滴加油站分布",
+		"Features": template.JS(data),
+		"CDN":      leafletCDN,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	html := buf.String()
+	if strings.Contains(html, "<script>alert(1)") {
+		t.Errorf("station name is not escaped:\n%s", html)
+	}
+	if !strings.Contains(html, `<script src="`+leafletCDN+`leaflet.js"></script>`) || strings.Contains(html, "L.tileLayer(") {
+		t.Errorf("map without local leaflet and tiles:\n%s", html)
+	}
+}
@@ -2,47 +2,58 @@ package main
 
 import (
 	"errors"
+	"strings"
 
 	"fmt"
 
-	log "github.com/liudanking/goutil/logutil"
 	"github.com/liudanking/goutil/netutil"
 )
 
-const (
-	// Oops, for temporary usage
-	GaodeKey = "YOUR_KEY"
-)
+// gaodeBatchSize is the max number of locations of a batch regeo request
+const gaodeBatchSize = 20
 
-type RegeoRsp struct {
-	Status    string `json:"status"`
-	Info      string `json:"info"`
-	Infocode  string `json:"infocode"`
-	Regeocode struct {
-		AddressComponent struct {
-			Country  string      `json:"country"`
-			Province string      `json:"province"`
-			City     interface{} `json:"city"`
-		} `json:"addressComponent"`
-	} `json:"regeocode"`
+type Regeocode struct {
+	AddressComponent struct {
+		Country  string      `json:"country"`
+		Province string      `json:"province"`
+		City     interface{} `json:"city"`
+	} `json:"addressComponent"`
 }
 
-func (rsp *RegeoRsp) GetCity() string {
-	city, ok := rsp.Regeocode.AddressComponent.City.(string)
+func (r *Regeocode) GetCity() string {
+	city, ok := r.AddressComponent.City.(string)
 	if ok && city != "" {
 		return city
 	}
 	// 直辖市
-	if rsp.Regeocode.AddressComponent.Province != "" {
-		return rsp.Regeocode.AddressComponent.Province
+	if r.AddressComponent.Province != "" {
+		return r.AddressComponent.Province
 	}
-	return "未知"
+	return unknownCity
+}
+
+type RegeoRsp struct {
+	Status    string    `json:"status"`
+	Info      string    `json:"info"`
+	Infocode  string    `json:"infocode"`
+	Regeocode Regeocode `json:"regeocode"`
 }
 
-func GetRegeoInfo(lng string, lat string) (*RegeoRsp, error) {
-	addr := "http://restapi.amap.com/v3/geocode/regeo"
+func (rsp *RegeoRsp) GetCity() string {
+	return rsp.Regeocode.GetCity()
+}
+
+type RegeoBatchRsp struct {
+	Status     string      `json:"status"`
+	Info       string      `json:"info"`
+	Infocode   string      `json:"infocode"`
+	Regeocodes []Regeocode `json:"regeocodes"`
+}
+
+// GetRegeoInfo requests regeo API of addr.
+func GetRegeoInfo(addr, key, lng, lat string) (*RegeoRsp, error) {
 	params := map[string]interface{}{
-		"key":      GaodeKey,
+		"key":      key,
 		"location": fmt.Sprintf("%s,%s", lng, lat),
 	}
 
@@ -59,11 +70,33 @@ func GetRegeoInfo(lng string, lat string) (*RegeoRsp, error) {
 
 }
 
-func GetCityByPosition(lng, lat string) string {
-	rsp, err := GetRegeoInfo(lng, lat)
+// GetRegeoInfoBatch resolves at most gaodeBatchSize points in one request,
+// results are in the order of points.
+func GetRegeoInfoBatch(addr, key string, points []point) (*RegeoBatchRsp, error) {
+	if len(points) > gaodeBatchSize {
+		return nil, fmt.Errorf("too many locations: %d", len(points))
+	}
+	locations := make([]string, 0, len(points))
+	for _, p := range points {
+		locations = append(locations, fmt.Sprintf("%f,%f", p[0], p[1]))
+	}
+	params := map[string]interface{}{
+		"key":      key,
+		"location": strings.Join(locations, "|"),
+		"batch":    "true",
+	}
+
+	rsp := &RegeoBatchRsp{}
+	_, err := netutil.DefaultHttpClient().RequestForm("GET", addr, params).DoJSON(rsp)
 	if err != nil {
-		log.Warning("get regeo [%s, %s] failed:%v", lng, lat, err)
-		return "未知"
+		return nil, err
 	}
-	return rsp.GetCity()
+	if rsp.Status == "0" {
+		return nil, errors.New(rsp.Info)
+	}
+	if len(rsp.Regeocodes) != len(points) {
+		return nil, fmt.Errorf("got %d regeocodes of %d locations", len(rsp.Regeocodes), len(points))
+	}
+
+	return rsp, nil
 }
@@ -0,0 +1,181 @@
+//go:build ignore
+
+// gen_boundaries generates boundaries_builtin.geojson from boundaries_seats.csv,
+// the boundary of a city is approximated by the Voronoi cells of its seats.
+//
+//	go run gen_boundaries.go -seats boundaries_seats.csv -o boundaries_builtin.geojson
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+)
+
+// bbox of generated cells, covering China
+const (
+	minLng, maxLng = 73.0, 136.0
+	minLat, maxLat = 15.0, 54.0
+)
+
+// minSeatDistance is the minimal distance in degrees of two seats
+const minSeatDistance = 0.01
+
+type seat struct {
+	city, province string
+	lng, lat       float64
+}
+
+type point [2]float64
+
+func main() {
+	seatsFile := flag.String("seats", "boundaries_seats.csv", "CSV file of city,province,lng,lat")
+	output := flag.String("o", "boundaries_builtin.geojson", "output GeoJSON file")
+	flag.Parse()
+
+	seats, err := loadSeats(*seatsFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := ioutil.WriteFile(*output, render(seats), 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Printf("generated %s from %d seats\n", *output, len(seats))
+}
+
+func loadSeats(fn string) ([]seat, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	seats := []seat{}
+	for i, record := range records {
+		if i == 0 {
+			// header
+			continue
+		}
+		s := seat{city: record[0], province: record[1]}
+		s.lng, err = strconv.ParseFloat(record[2], 64)
+		if err == nil {
+			s.lat, err = strconv.ParseFloat(record[3], 64)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid seat %v:%v", record, err)
+		}
+		seats = append(seats, s)
+	}
+	for i := range seats {
+		for j := i + 1; j < len(seats); j++ {
+			if math.Hypot(seats[i].lng-seats[j].lng, seats[i].lat-seats[j].lat) < minSeatDistance {
+				return nil, fmt.Errorf("seats %v and %v are too close", seats[i], seats[j])
+			}
+		}
+	}
+	return seats, nil
+}
+
+// cell returns the Voronoi cell of seats[i] clipped to bbox, distances are measured
+// with longitude scaled by cos of latitude.
+func cell(seats []seat, i int) []point {
+	ring := []point{{minLng, minLat}, {maxLng, minLat}, {maxLng, maxLat}, {minLng, maxLat}}
+	si := seats[i]
+	for j, sj := range seats {
+		if j == i {
+			continue
+		}
+		k := math.Cos((si.lat + sj.lat) / 2 * math.Pi / 180)
+		k2 := k * k
+		// points closer to si than sj: a*x + b*y + c >= 0
+		a := 2 * k2 * (si.lng - sj.lng)
+		b := 2 * (si.lat - sj.lat)
+		c := k2*(sj.lng*sj.lng-si.lng*si.lng) + (sj.lat*sj.lat - si.lat*si.lat)
+		ring = clip(ring, a, b, c)
+		if len(ring) == 0 {
+			break
+		}
+	}
+	return ring
+}
+
+// clip is a Sutherland-Hodgman step keeping the part of ring where a*x + b*y + c >= 0.
+func clip(ring []point, a, b, c float64) []point {
+	side := func(p point) float64 { return a*p[0] + b*p[1] + c }
+	clipped := []point{}
+	for n, cur := range ring {
+		prev := ring[(n+len(ring)-1)%len(ring)]
+		sc, sp := side(cur), side(prev)
+		if (sc >= 0) != (sp >= 0) {
+			t := sp / (sp - sc)
+			clipped = append(clipped, point{prev[0] + t*(cur[0]-prev[0]), prev[1] + t*(cur[1]-prev[1])})
+		}
+		if sc >= 0 {
+			clipped = append(clipped, cur)
+		}
+	}
+	return clipped
+}
+
+type feature struct {
+	Type       string            `json:"type"`
+	Properties map[string]string `json:"properties"`
+	Geometry   struct {
+		Type        string      `json:"type"`
+		Coordinates [][][]point `json:"coordinates"`
+	} `json:"geometry"`
+}
+
+// render writes a feature per line, one MultiPolygon of all cells of a city.
+func render(seats []seat) []byte {
+	order := []string{}
+	features := map[string]*feature{}
+	for i, s := range seats {
+		ring := cell(seats, i)
+		if len(ring) < 3 {
+			continue
+		}
+		for n := range ring {
+			ring[n] = point{round(ring[n][0]), round(ring[n][1])}
+		}
+		// GeoJSON rings are closed
+		ring = append(ring, ring[0])
+		f, ok := features[s.city]
+		if !ok {
+			f = &feature{Type: "Feature", Properties: map[string]string{"name": s.city, "province": s.province}}
+			f.Geometry.Type = "MultiPolygon"
+			features[s.city] = f
+			order = append(order, s.city)
+		}
+		f.Geometry.Coordinates = append(f.Geometry.Coordinates, [][]point{ring})
+	}
+
+	buf := bytes.NewBufferString("{\"type\":\"FeatureCollection\",\"features\":[\n")
+	for n, city := range order {
+		data, _ := json.Marshal(features[city])
+		buf.Write(data)
+		if n < len(order)-1 {
+			buf.WriteString(",")
+		}
+		buf.WriteString("\n")
+	}
+	buf.WriteString("]}\n")
+	return buf.Bytes()
+}
+
+func round(x float64) float64 {
+	return math.Round(x*1e4) / 1e4
+}
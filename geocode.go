@@ -0,0 +1,331 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strconv"
+
+	log "github.com/liudanking/goutil/logutil"
+	"github.com/urfave/cli"
+)
+
+// unknownCity is the city of data whose position can not be resolved
+const unknownCity = "未知"
+
+// Region is the administrative region of a point.
+type Region struct {
+	Province string `json:"province"`
+	City     string `json:"city"`
+}
+
+// Geocoder resolves a GCJ-02 point to its region.
+type Geocoder interface {
+	ReverseGeocode(lng, lat float64) (Region, error)
+}
+
+// BatchGeocoder resolves many points at once, regions and errors are in the order of points.
+type BatchGeocoder interface {
+	ReverseGeocodeBatch(points []point) ([]Region, []error)
+}
+
+var errRegionNotFound = errors.New("region not found")
+
+// reverseGeocodeBatch resolves points in batch if g supports it, one by one otherwise.
+func reverseGeocodeBatch(g Geocoder, points []point) ([]Region, []error) {
+	if bg, ok := g.(BatchGeocoder); ok {
+		return bg.ReverseGeocodeBatch(points)
+	}
+	regions, errs := make([]Region, len(points)), make([]error, len(points))
+	for i, p := range points {
+		regions[i], errs[i] = g.ReverseGeocode(p[0], p[1])
+	}
+	return regions, errs
+}
+
+//go:generate go run gen_boundaries.go -seats boundaries_seats.csv -o boundaries_builtin.geojson
+
+// builtinBoundaries approximates prefecture-level boundaries by Voronoi cells of seats of
+// cities and counties in WGS-84, points near a border may be resolved to the neighbour city.
+//
+//go:embed boundaries_builtin.geojson
+var builtinBoundaries []byte
+
+// boundariesNone disables offline geocoding
+const boundariesNone = "none"
+
+var geocodeFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "boundaries",
+		Usage: "GeoJSON file of city boundary polygons for offline geocoding, built-in approximate boundaries if empty, none to disable",
+	},
+	cli.StringFlag{
+		Name:  "boundaries-crs",
+		Usage: "coordinate system of --boundaries file: gcj02 or wgs84",
+		Value: crsGCJ02,
+	},
+	cli.StringFlag{
+		Name:  "gaode-key",
+		Usage: "gaode web service key, used if offline geocoding fails",
+	},
+}
+
+// geocoderFromContext resolves by offline geocoder then gaode, either may be absent,
+// offline geocoder uses built-in boundaries if --boundaries is empty, results are cached in store. Gaode key of config is used if --gaode-key is not set.
+func geocoderFromContext(c *cli.Context, store DataStore) (*CachedGeocoder, error) {
+	cfg := configFromContext(c)
+	var local, remote Geocoder
+	switch fn := c.String("boundaries"); fn {
+	case boundariesNone:
+	case "":
+		og, err := newOfflineGeocoder(builtinBoundaries, "built-in boundaries", crsWGS84)
+		if err != nil {
+			return nil, err
+		}
+		local = og
+	default:
+		og, err := NewOfflineGeocoder(fn, c.String("boundaries-crs"))
+		if err != nil {
+			return nil, err
+		}
+		local = og
+	}
+	key := c.String("gaode-key")
+	if key == "" {
+		key = cfg.Gaode.Key
+	}
+	if key != "" {
+		remote = &GaodeGeocoder{URL: cfg.Gaode.RegeoURL, Key: key}
+	}
+	if local == nil && remote == nil {
+		log.Warning("--boundaries is none and --gaode-key is not set, only city supplied by didi is used")
+	}
+	if c.Float64("geocode-grid") <= 0 {
+		return nil, fmt.Errorf("invalid --geocode-grid %g", c.Float64("geocode-grid"))
+	}
+	return NewCachedGeocoder(local, remote, store, c.Float64("geocode-grid"), c.Duration("geocode-ttl"), c.Int("geocode-lru")), nil
+}
+
+// cityByPosition resolves city of lng and lat query parameters, unknownCity if failed.
+func cityByPosition(g Geocoder, lng, lat string) string {
+	x, errLng := strconv.ParseFloat(lng, 64)
+	y, errLat := strconv.ParseFloat(lat, 64)
+	if errLng != nil || errLat != nil {
+		log.Warning("invalid position [%s, %s]", lng, lat)
+		return unknownCity
+	}
+	region, err := g.ReverseGeocode(x, y)
+	if err != nil {
+		log.Warning("reverse geocode [%s, %s] failed:%v", lng, lat, err)
+		return unknownCity
+	}
+	return region.City
+}
+
+// GaodeGeocoder resolves points by gaode web service.
+type GaodeGeocoder struct {
+	URL string
+	Key string
+}
+
+func (gg *GaodeGeocoder) ReverseGeocode(lng, lat float64) (Region, error) {
+	rsp, err := GetRegeoInfo(gg.URL, gg.Key, strconv.FormatFloat(lng, 'f', -1, 64), strconv.FormatFloat(lat, 'f', -1, 64))
+	if err != nil {
+		return Region{}, err
+	}
+	city := rsp.GetCity()
+	if city == unknownCity {
+		return Region{}, errRegionNotFound
+	}
+	return Region{Province: rsp.Regeocode.AddressComponent.Province, City: city}, nil
+}
+
+// ReverseGeocodeBatch resolves gaodeBatchSize points per request.
+func (gg *GaodeGeocoder) ReverseGeocodeBatch(points []point) ([]Region, []error) {
+	regions, errs := make([]Region, len(points)), make([]error, len(points))
+	for start := 0; start < len(points); start += gaodeBatchSize {
+		end := start + gaodeBatchSize
+		if end > len(points) {
+			end = len(points)
+		}
+		rsp, err := GetRegeoInfoBatch(gg.URL, gg.Key, points[start:end])
+		for i := start; i < end; i++ {
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+			r := &rsp.Regeocodes[i-start]
+			if city := r.GetCity(); city != unknownCity {
+				regions[i] = Region{Province: r.AddressComponent.Province, City: city}
+			} else {
+				errs[i] = errRegionNotFound
+			}
+		}
+	}
+	return regions, errs
+}
+
+// boundaryGridSize is the cell size in degrees of the spatial index of boundaries
+const boundaryGridSize = 0.5
+
+type gridCell struct {
+	x, y int
+}
+
+func gridCellOf(lng, lat float64) gridCell {
+	return gridCell{int(math.Floor(lng / boundaryGridSize)), int(math.Floor(lat / boundaryGridSize))}
+}
+
+// point is [lng, lat]
+type point [2]float64
+
+// boundary is the polygons of a region, every polygon is an outer ring followed by holes.
+type boundary struct {
+	region   Region
+	polygons [][][]point
+	// bounding box
+	minLng, minLat, maxLng, maxLat float64
+}
+
+func (b *boundary) contains(lng, lat float64) bool {
+	if lng < b.minLng || lng > b.maxLng || lat < b.minLat || lat > b.maxLat {
+		return false
+	}
+	for _, polygon := range b.polygons {
+		// even-odd rule over outer ring and holes
+		inside := false
+		for _, ring := range polygon {
+			if ringContains(ring, lng, lat) {
+				inside = !inside
+			}
+		}
+		if inside {
+			return true
+		}
+	}
+	return false
+}
+
+// ringContains casts a ray from point to east and counts crossed edges.
+func ringContains(ring []point, lng, lat float64) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[i], ring[j]
+		if (a[1] > lat) != (b[1] > lat) && lng < (b[0]-a[0])*(lat-a[1])/(b[1]-a[1])+a[0] {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// OfflineGeocoder resolves points by city boundary polygons, indexed by a grid
+// of boundaryGridSize cells holding boundaries whose bounding box overlaps the cell.
+type OfflineGeocoder struct {
+	// crs is the coordinate system of boundaries
+	crs        string
+	boundaries []*boundary
+	grid       map[gridCell][]*boundary
+}
+
+// boundaryFile is a GeoJSON FeatureCollection of Polygon or MultiPolygon features,
+// the city is property city or name, the province is property province.
+type boundaryFile struct {
+	Features []struct {
+		Properties map[string]interface{} `json:"properties"`
+		Geometry   struct {
+			Type        string          `json:"type"`
+			Coordinates json.RawMessage `json:"coordinates"`
+		} `json:"geometry"`
+	} `json:"features"`
+}
+
+func NewOfflineGeocoder(fn, crs string) (*OfflineGeocoder, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	return newOfflineGeocoder(data, fn, crs)
+}
+
+// newOfflineGeocoder parses GeoJSON data of boundaries, fn names data in errors and logs.
+func newOfflineGeocoder(data []byte, fn, crs string) (*OfflineGeocoder, error) {
+	if crs != crsGCJ02 && crs != crsWGS84 {
+		return nil, fmt.Errorf("unsupported boundaries crs: %s", crs)
+	}
+	f := boundaryFile{}
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("load boundaries from %s failed:%v", fn, err)
+	}
+	og := &OfflineGeocoder{crs: crs, grid: map[gridCell][]*boundary{}}
+	for i, feature := range f.Features {
+		property := func(name string) string {
+			s, _ := feature.Properties[name].(string)
+			return s
+		}
+		b := &boundary{region: Region{Province: property("province"), City: property("city")}}
+		if b.region.City == "" {
+			b.region.City = property("name")
+		}
+		if b.region.City == "" {
+			return nil, fmt.Errorf("feature %d of %s has no city name", i, fn)
+		}
+
+		var err error
+		switch feature.Geometry.Type {
+		case "Polygon":
+			polygon := [][]point{}
+			err = json.Unmarshal(feature.Geometry.Coordinates, &polygon)
+			b.polygons = [][][]point{polygon}
+		case "MultiPolygon":
+			err = json.Unmarshal(feature.Geometry.Coordinates, &b.polygons)
+		default:
+			log.Warning("skip %s of %s, geometry %s is not polygon", b.region.City, fn, feature.Geometry.Type)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid geometry of %s in %s:%v", b.region.City, fn, err)
+		}
+		og.add(b)
+	}
+	log.Info("loaded %d city boundaries from %s", len(og.boundaries), fn)
+	return og, nil
+}
+
+func (og *OfflineGeocoder) add(b *boundary) {
+	b.minLng, b.minLat = math.Inf(1), math.Inf(1)
+	b.maxLng, b.maxLat = math.Inf(-1), math.Inf(-1)
+	for _, polygon := range b.polygons {
+		for _, ring := range polygon {
+			for _, p := range ring {
+				b.minLng, b.maxLng = math.Min(b.minLng, p[0]), math.Max(b.maxLng, p[0])
+				b.minLat, b.maxLat = math.Min(b.minLat, p[1]), math.Max(b.maxLat, p[1])
+			}
+		}
+	}
+	if math.IsInf(b.minLng, 1) {
+		return
+	}
+	og.boundaries = append(og.boundaries, b)
+	lo, hi := gridCellOf(b.minLng, b.minLat), gridCellOf(b.maxLng, b.maxLat)
+	for x := lo.x; x <= hi.x; x++ {
+		for y := lo.y; y <= hi.y; y++ {
+			cell := gridCell{x, y}
+			og.grid[cell] = append(og.grid[cell], b)
+		}
+	}
+}
+
+func (og *OfflineGeocoder) ReverseGeocode(lng, lat float64) (Region, error) {
+	if og.crs == crsWGS84 {
+		lng, lat = gcj02ToWGS84(lng, lat)
+	}
+	for _, b := range og.grid[gridCellOf(lng, lat)] {
+		if b.contains(lng, lat) {
+			return b.region, nil
+		}
+	}
+	return Region{}, errRegionNotFound
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	log "github.com/liudanking/goutil/logutil"
+	"github.com/urfave/cli"
+)
+
+var geocodeCacheFlags = []cli.Flag{
+	cli.Float64Flag{
+		Name:  "geocode-grid",
+		Usage: "grid size in degrees of geocode cache, points in one cell share the cached city",
+		Value: 0.01,
+	},
+	cli.DurationFlag{
+		Name:  "geocode-ttl",
+		Usage: "time to live of cached geocode results",
+		Value: 30 * 24 * time.Hour,
+	},
+	cli.IntFlag{
+		Name:  "geocode-lru",
+		Usage: "number of geocode results cached in memory",
+		Value: 4096,
+	},
+}
+
+// GeocodeEntry is a cached reverse geocode result of a grid cell,
+// Lng and Lat are the point actually geocoded.
+type GeocodeEntry struct {
+	CellKey   string    `json:"cell_key"`
+	Lng       float64   `json:"lng"`
+	Lat       float64   `json:"lat"`
+	Province  string    `json:"province"`
+	City      string    `json:"city"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (e GeocodeEntry) region() Region {
+	return Region{Province: e.Province, City: e.City}
+}
+
+// GeocodeCacheStats counts lookups of CachedGeocoder.
+type GeocodeCacheStats struct {
+	Lookups    int `json:"lookups"`
+	MemoryHits int `json:"memory_hits"`
+	StoreHits  int `json:"store_hits"`
+	// Misses are lookups passed to geocoders, DidiCityHits are lookups geocoders failed
+	// and resolved by didi city, not counted in Misses, Errors are misses none resolved
+	Misses       int     `json:"misses"`
+	DidiCityHits int     `json:"didi_city_hits"`
+	Errors       int     `json:"errors"`
+	HitRate      float64 `json:"hit_rate"`
+}
+
+// geocodeStatsLogInterval is the number of lookups between stats logs
+const geocodeStatsLogInterval = 100
+
+// CachedGeocoder resolves points by, in order, cached results of the grid cell,
+// local geocoder and remote geocoder, and city didi supplies with the query.
+// Results of geocoders are cached in memory with LRU eviction and persistently
+// in store, expired entries are used only if both geocoders fail, and didi city
+// only if there is no expired entry either. Either geocoder may be nil.
+type CachedGeocoder struct {
+	local  Geocoder
+	remote Geocoder
+	store  DataStore
+	grid   float64
+	ttl    time.Duration
+
+	mtx   sync.Mutex
+	lru   *lruCache
+	stats GeocodeCacheStats
+}
+
+func NewCachedGeocoder(local, remote Geocoder, store DataStore, grid float64, ttl time.Duration, lruSize int) *CachedGeocoder {
+	return &CachedGeocoder{
+		local:  local,
+		remote: remote,
+		store:  store,
+		grid:   grid,
+		ttl:    ttl,
+		lru:    newLRUCache(lruSize),
+	}
+}
+
+// empty reports whether points can be resolved only by cache and didi city.
+func (cg *CachedGeocoder) empty() bool {
+	return cg.local == nil && cg.remote == nil
+}
+
+// cellKey identifies the grid cell of point, grid size is part of the key
+// so that entries of another grid size are not mixed up.
+func (cg *CachedGeocoder) cellKey(lng, lat float64) string {
+	return fmt.Sprintf("%g:%d:%d", cg.grid, int64(math.Floor(lng/cg.grid)), int64(math.Floor(lat/cg.grid)))
+}
+
+func (cg *CachedGeocoder) fresh(e GeocodeEntry) bool {
+	return time.Since(e.UpdatedAt) < cg.ttl
+}
+
+func (cg *CachedGeocoder) ReverseGeocode(lng, lat float64) (Region, error) {
+	regions, errs := cg.ReverseGeocodeBatch([]point{{lng, lat}})
+	return regions[0], errs[0]
+}
+
+// ReverseGeocodeBatch resolves points without didi city.
+func (cg *CachedGeocoder) ReverseGeocodeBatch(points []point) ([]Region, []error) {
+	return cg.ResolveBatch(points, "")
+}
+
+// ResolveBatch resolves points by their own position in the order:
+//  1. cached result of the grid cell, in memory then in store
+//  2. local geocoder of boundary polygons
+//  3. remote geocoder of gaode
+//  4. expired cached result of the grid cell
+//  5. didiCity, the city didi supplies with the query, if not empty,
+//     it is not cached as it is the city of the query rather than the point
+//
+// Points of cells missed are resolved by geocoders in one batch, one point per cell.
+// Without geocoders points not cached fall back to didiCity.
+func (cg *CachedGeocoder) ResolveBatch(points []point, didiCity string) ([]Region, []error) {
+	regions, errs := make([]Region, len(points)), make([]error, len(points))
+	stale := map[string]GeocodeEntry{}
+	missed := map[string][]int{}
+	missedPoints := []point{}
+	missedKeys := []string{}
+
+	for i, p := range points {
+		key := cg.cellKey(p[0], p[1])
+		if _, ok := missed[key]; ok {
+			cg.countLookup()
+			missed[key] = append(missed[key], i)
+			continue
+		}
+		e, ok := cg.lookup(key)
+		if ok {
+			regions[i] = e.region()
+			continue
+		}
+		if !e.UpdatedAt.IsZero() {
+			stale[key] = e
+		}
+		missed[key] = []int{i}
+		missedPoints = append(missedPoints, p)
+		missedKeys = append(missedKeys, key)
+	}
+	if len(missedPoints) == 0 {
+		return regions, errs
+	}
+
+	results := make([]Region, len(missedPoints))
+	resultErrs := make([]error, len(missedPoints))
+	pending := make([]int, len(missedPoints))
+	for j := range pending {
+		pending[j] = j
+		resultErrs[j] = errRegionNotFound
+	}
+	resolve := func(g Geocoder) {
+		if g == nil || len(pending) == 0 {
+			return
+		}
+		ps := make([]point, len(pending))
+		for k, j := range pending {
+			ps[k] = missedPoints[j]
+		}
+		rs, es := reverseGeocodeBatch(g, ps)
+		failed := []int{}
+		for k, j := range pending {
+			if es[k] != nil {
+				resultErrs[j] = es[k]
+				failed = append(failed, j)
+				continue
+			}
+			results[j], resultErrs[j] = rs[k], nil
+		}
+		pending = failed
+	}
+	resolve(cg.local)
+	resolve(cg.remote)
+
+	now := time.Now()
+	entries := []GeocodeEntry{}
+	misses, didiHits, failures := 0, 0, 0
+	for j, key := range missedKeys {
+		region, err := results[j], resultErrs[j]
+		n := len(missed[key])
+		if err != nil {
+			if e, ok := stale[key]; ok {
+				log.Warning("reverse geocode %s failed, use expired result:%v", key, err)
+				region, err = e.region(), nil
+				misses += n
+			} else if didiCity != "" {
+				region, err = Region{City: didiCity}, nil
+				didiHits += n
+			} else {
+				misses += n
+				failures += n
+			}
+		} else {
+			misses += n
+			p := missedPoints[j]
+			e := GeocodeEntry{CellKey: key, Lng: p[0], Lat: p[1], Province: region.Province, City: region.City, UpdatedAt: now}
+			cg.mtx.Lock()
+			cg.lru.put(key, e)
+			cg.mtx.Unlock()
+			entries = append(entries, e)
+		}
+		for _, i := range missed[key] {
+			regions[i], errs[i] = region, err
+		}
+	}
+	if len(entries) > 0 {
+		if err := cg.store.PutGeocodes(entries); err != nil {
+			log.Warning("save %d geocode cache entries failed:%v", len(entries), err)
+		}
+	}
+	cg.mtx.Lock()
+	cg.stats.Misses += misses
+	cg.stats.DidiCityHits += didiHits
+	cg.stats.Errors += failures
+	cg.mtx.Unlock()
+	return regions, errs
+}
+
+// countLookup counts a lookup and logs stats every geocodeStatsLogInterval lookups.
+func (cg *CachedGeocoder) countLookup() {
+	cg.mtx.Lock()
+	defer cg.mtx.Unlock()
+	cg.stats.Lookups++
+	if cg.stats.Lookups%geocodeStatsLogInterval == 0 {
+		s := cg.statsLocked()
+		log.Info("geocode cache: %d lookups, hit rate %.1f%% (memory %d, store %d), %d misses, %d didi city, %d errors",
+			s.Lookups, s.HitRate*100, s.MemoryHits, s.StoreHits, s.Misses, s.DidiCityHits, s.Errors)
+	}
+}
+
+// lookup returns fresh entry of cell from memory or store, or the expired entry
+// with ok false, zero entry if cell is not cached.
+func (cg *CachedGeocoder) lookup(key string) (e GeocodeEntry, ok bool) {
+	cg.countLookup()
+	cg.mtx.Lock()
+	if e, ok := cg.lru.get(key); ok && cg.fresh(e) {
+		cg.stats.MemoryHits++
+		cg.mtx.Unlock()
+		return e, true
+	}
+	cg.mtx.Unlock()
+
+	e, found, err := cg.store.GetGeocode(key)
+	if err != nil {
+		log.Warning("read geocode cache %s failed:%v", key, err)
+	}
+	if !found {
+		return GeocodeEntry{}, false
+	}
+	if !cg.fresh(e) {
+		return e, false
+	}
+	cg.mtx.Lock()
+	cg.stats.StoreHits++
+	cg.lru.put(key, e)
+	cg.mtx.Unlock()
+	return e, true
+}
+
+func (cg *CachedGeocoder) statsLocked() GeocodeCacheStats {
+	s := cg.stats
+	if s.Lookups > 0 {
+		s.HitRate = float64(s.MemoryHits+s.StoreHits) / float64(s.Lookups)
+	}
+	return s
+}
+
+func (cg *CachedGeocoder) Stats() GeocodeCacheStats {
+	cg.mtx.Lock()
+	defer cg.mtx.Unlock()
+	return cg.statsLocked()
+}
+
+// lruCache is a fixed size cache of geocode entries evicting the least recently used.
+type lruCache struct {
+	size  int
+	order *list.List
+	items map[string]*list.Element
+}
+
+func newLRUCache(size int) *lruCache {
+	return &lruCache{
+		size:  size,
+		order: list.New(),
+		items: map[string]*list.Element{},
+	}
+}
+
+func (c *lruCache) get(key string) (GeocodeEntry, bool) {
+	elem, ok := c.items[key]
+	if !ok {
+		return GeocodeEntry{}, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(GeocodeEntry), true
+}
+
+func (c *lruCache) put(key string, e GeocodeEntry) {
+	if c.size <= 0 {
+		return
+	}
+	if elem, ok := c.items[key]; ok {
+		elem.Value = e
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.items[key] = c.order.PushFront(e)
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(GeocodeEntry).CellKey)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// geocoderFunc counts points it resolves.
+type geocoderFunc struct {
+	calls int
+	fn    func(lng, lat float64) (Region, error)
+}
+
+func (g *geocoderFunc) ReverseGeocode(lng, lat float64) (Region, error) {
+	g.calls++
+	return g.fn(lng, lat)
+}
+
+func tempFileStore(t *testing.T) (*FileStore, func()) {
+	dir, err := ioutil.TempDir("", "didi-car-rank")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewFileStore(dir), func() { os.RemoveAll(dir) }
+}
+
+func TestResolveBatchOrder(t *testing.T) {
+	store, cleanup := tempFileStore(t)
+	defer cleanup()
+	// local resolves points west of 110, remote resolves points west of 130
+	local := &geocoderFunc{fn: func(lng, lat float64) (Region, error) {
+		if lng < 110 {
+			return Region{Province: "四川省", City: "成都市"}, nil
+		}
+		return Region{}, errRegionNotFound
+	}}
+	remote := &geocoderFunc{fn: func(lng, lat float64) (Region, error) {
+		if lng < 130 {
+			return Region{Province: "上海市", City: "上海市"}, nil
+		}
+		return Region{}, errRegionNotFound
+	}}
+	cg := NewCachedGeocoder(local, remote, store, 0.01, time.Hour, 16)
+	points := []point{{104.06, 30.57}, {121.47, 31.23}, {135.0, 20.0}}
+
+	tests := []struct {
+		didiCity      string
+		cities        []string
+		local, remote int
+	}{
+		// own position first, didi city only for points geocoders fail
+		{"滴滴市", []string{"成都市", "上海市", "滴滴市"}, 3, 2},
+		// cached, didi city is not
+		{"", []string{"成都市", "上海市", ""}, 4, 3},
+		{"滴滴市", []string{"成都市", "上海市", "滴滴市"}, 5, 4},
+	}
+	for n, tt := range tests {
+		regions, errs := cg.ResolveBatch(points, tt.didiCity)
+		for i := range points {
+			if (errs[i] != nil) != (tt.cities[i] == "") || regions[i].City != tt.cities[i] {
+				t.Errorf("%d: point %d = %+v, %v, want %s", n, i, regions[i], errs[i], tt.cities[i])
+			}
+		}
+		if local.calls != tt.local || remote.calls != tt.remote {
+			t.Errorf("%d: local calls %d, remote calls %d, want %d, %d", n, local.calls, remote.calls, tt.local, tt.remote)
+		}
+	}
+	// didi city answers are not misses
+	s := cg.Stats()
+	if s.Lookups != 9 || s.MemoryHits != 4 || s.Misses != 3 || s.DidiCityHits != 2 || s.Errors != 1 {
+		t.Errorf("stats = %+v", s)
+	}
+
+	// without geocoders, points not cached fall back to didi city
+	cg = NewCachedGeocoder(nil, nil, store, 0.01, time.Hour, 16)
+	regions, errs := cg.ResolveBatch(points, "滴滴市")
+	for i, want := range []string{"成都市", "上海市", "滴滴市"} {
+		if errs[i] != nil || regions[i].City != want {
+			t.Errorf("without geocoders: point %d = %+v, %v, want %s", i, regions[i], errs[i], want)
+		}
+	}
+	if s := cg.Stats(); s.StoreHits != 2 || s.Misses != 0 || s.DidiCityHits != 1 {
+		t.Errorf("without geocoders: stats = %+v", s)
+	}
+}
+
+func TestLRUCache(t *testing.T) {
+	c := newLRUCache(2)
+	put := func(key string) { c.put(key, GeocodeEntry{CellKey: key, City: key}) }
+	put("a")
+	put("b")
+	// a is used recently, b is evicted
+	if _, ok := c.get("a"); !ok {
+		t.Fatal("a is evicted")
+	}
+	put("c")
+	if _, ok := c.get("b"); ok {
+		t.Error("b is not evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if e, ok := c.get(key); !ok || e.City != key {
+			t.Errorf("get(%s) = %+v, %v", key, e, ok)
+		}
+	}
+	// updating existing entry does not evict
+	c.put("a", GeocodeEntry{CellKey: "a", City: "A"})
+	if e, ok := c.get("a"); !ok || e.City != "A" || c.order.Len() != 2 {
+		t.Errorf("get(a) = %+v, %v, %d entries", e, ok, c.order.Len())
+	}
+
+	disabled := newLRUCache(0)
+	disabled.put("a", GeocodeEntry{CellKey: "a"})
+	if _, ok := disabled.get("a"); ok {
+		t.Error("cache of size 0 keeps entries")
+	}
+}
+
+func TestGeocodeCacheHitRate(t *testing.T) {
+	store, cleanup := tempFileStore(t)
+	defer cleanup()
+	remote := &geocoderFunc{fn: func(lng, lat float64) (Region, error) {
+		return Region{Province: "四川省", City: "成都市"}, nil
+	}}
+	cg := NewCachedGeocoder(nil, remote, store, 0.01, time.Hour, 1)
+	idle := NewCachedGeocoder(nil, remote, store, 0.01, time.Hour, 1)
+	if err := store.PutGeocodes([]GeocodeEntry{
+		{CellKey: cg.cellKey(104.065, 30.575), City: "成都市", UpdatedAt: time.Now()},
+		{CellKey: cg.cellKey(104.075, 30.575), City: "成都市", UpdatedAt: time.Now().Add(-2 * time.Hour)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		lng, lat float64
+		stats    GeocodeCacheStats
+	}{
+		// store hit, then memory hit
+		{104.065, 30.575, GeocodeCacheStats{Lookups: 1, StoreHits: 1}},
+		{104.066, 30.576, GeocodeCacheStats{Lookups: 2, MemoryHits: 1, StoreHits: 1}},
+		// expired entry is resolved again
+		{104.075, 30.575, GeocodeCacheStats{Lookups: 3, MemoryHits: 1, StoreHits: 1, Misses: 1}},
+		{104.076, 30.576, GeocodeCacheStats{Lookups: 4, MemoryHits: 2, StoreHits: 1, Misses: 1}},
+		// the first cell is evicted from memory of size 1
+		{104.065, 30.575, GeocodeCacheStats{Lookups: 5, MemoryHits: 2, StoreHits: 2, Misses: 1}},
+	}
+	for _, tt := range tests {
+		if region, err := cg.ReverseGeocode(tt.lng, tt.lat); err != nil || region.City != "成都市" {
+			t.Errorf("ReverseGeocode(%g, %g) = %+v, %v", tt.lng, tt.lat, region, err)
+		}
+		s := cg.Stats()
+		tt.stats.HitRate = float64(tt.stats.MemoryHits+tt.stats.StoreHits) / float64(tt.stats.Lookups)
+		if s != tt.stats {
+			t.Errorf("after (%g, %g) stats = %+v, want %+v", tt.lng, tt.lat, s, tt.stats)
+		}
+	}
+	if remote.calls != 1 {
+		t.Errorf("remote calls = %d, want 1", remote.calls)
+	}
+	if s := idle.Stats(); s.HitRate != 0 {
+		t.Errorf("hit rate without lookups = %g", s.HitRate)
+	}
+}
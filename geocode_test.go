@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestBuiltinBoundaries(t *testing.T) {
+	og, err := newOfflineGeocoder(builtinBoundaries, "built-in boundaries", crsWGS84)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// GCJ-02 positions of city centers
+	tests := []struct {
+		lng, lat float64
+		region   Region
+	}{
+		{104.0657, 30.6574, Region{"四川省", "成都市"}},
+		{121.4737, 31.2304, Region{"上海市", "上海市"}},
+		{116.3974, 39.9093, Region{"北京市", "北京市"}},
+		{114.0579, 22.5431, Region{"广东省", "深圳市"}},
+		{113.7518, 23.0207, Region{"广东省", "东莞市"}},
+		{113.2644, 23.1291, Region{"广东省", "广州市"}},
+		{113.1214, 23.0215, Region{"广东省", "佛山市"}},
+		{114.1588, 22.2810, Region{"香港特別行政區", "香港特別行政區"}},
+		{113.5439, 22.1987, Region{"澳門特別行政區", "澳門特別行政區"}},
+		{106.5516, 29.5630, Region{"重庆市", "重庆市"}},
+		{87.6168, 43.8256, Region{"新疆维吾尔自治区", "乌鲁木齐市"}},
+		{102.8329, 24.8801, Region{"云南省", "昆明市"}},
+	}
+	for _, tt := range tests {
+		region, err := og.ReverseGeocode(tt.lng, tt.lat)
+		if err != nil || region != tt.region {
+			t.Errorf("ReverseGeocode(%g, %g) = %+v, %v, want %+v", tt.lng, tt.lat, region, err, tt.region)
+		}
+	}
+}
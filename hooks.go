@@ -0,0 +1,186 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	log "github.com/liudanking/goutil/logutil"
+
+	"github.com/elazarl/goproxy"
+)
+
+// HookHandler parses intercepted responses of a didi page into records.
+type HookHandler interface {
+	// Name is used in logs
+	Name() string
+	// Parse parses body of the response to req.
+	Parse(req *http.Request, body []byte) ([]HookRecord, error)
+}
+
+// HookRecord is a typed record parsed from an intercepted response,
+// each record type knows how DidiHooker saves it.
+type HookRecord interface {
+	save(dh *DidiHooker)
+}
+
+// HookRule routes responses of requests to Host (host:port) matching Method and Path
+// to Handler. Empty Method matches any method. Path is a prefix of request path, or a
+// pattern of path.Match if it has any of *?[.
+type HookRule struct {
+	Host    string
+	Method  string
+	Path    string
+	Handler HookHandler
+}
+
+func (r *HookRule) match(req *http.Request) bool {
+	if r.Method != "" && r.Method != req.Method {
+		return false
+	}
+	if strings.ContainsAny(r.Path, "*?[") {
+		ok, _ := path.Match(r.Path, req.URL.Path)
+		return ok
+	}
+	return strings.HasPrefix(req.URL.Path, r.Path)
+}
+
+// hookQueueSize is the number of intercepted responses waiting to be saved,
+// responses are held when the queue is full.
+const hookQueueSize = 256
+
+// HookRegistry dispatches intercepted responses to handlers of the first matching rule.
+type HookRegistry struct {
+	rules []HookRule
+	// logUnmatched logs every new method and path of hosts not matching any rule
+	logUnmatched bool
+
+	mtx       sync.Mutex
+	unmatched map[string]bool
+
+	// records parsed are saved by a single worker in the order intercepted
+	queueMtx sync.Mutex
+	queue    chan []HookRecord
+	closed   bool
+	drained  chan struct{}
+}
+
+func NewHookRegistry(logUnmatched bool) *HookRegistry {
+	return &HookRegistry{
+		logUnmatched: logUnmatched,
+		unmatched:    map[string]bool{},
+	}
+}
+
+func (hr *HookRegistry) Register(rule HookRule) {
+	hr.rules = append(hr.rules, rule)
+}
+
+func (hr *HookRegistry) match(host string, req *http.Request) *HookRule {
+	for i := range hr.rules {
+		if hr.rules[i].Host == host && hr.rules[i].match(req) {
+			return &hr.rules[i]
+		}
+	}
+	return nil
+}
+
+// Install intercepts hosts of rules, records parsed are saved by dh in background
+// so that intercepted responses are returned immediately, Close saves records queued.
+func (hr *HookRegistry) Install(p *goproxy.ProxyHttpServer, dh *DidiHooker) {
+	hr.start(dh)
+	hosts := []string{}
+	seen := map[string]bool{}
+	for _, rule := range hr.rules {
+		if !seen[rule.Host] {
+			seen[rule.Host] = true
+			hosts = append(hosts, rule.Host)
+		}
+	}
+	for _, host := range hosts {
+		host := host
+		p.OnRequest(goproxy.DstHostIs(host)).HandleConnect(goproxy.AlwaysMitm)
+		p.OnResponse(goproxy.DstHostIs(host)).DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+			if resp == nil {
+				return resp
+			}
+			rule := hr.match(host, ctx.Req)
+			if rule == nil {
+				hr.logUnmatchedRequest(host, ctx.Req, resp)
+				return resp
+			}
+			log.Info("%s hook!", rule.Handler.Name())
+			data, err := repeatReadBody(resp)
+			if err != nil {
+				log.Warning("read %s rsp failed:%v", rule.Handler.Name(), err)
+				return resp
+			}
+			records, err := rule.Handler.Parse(ctx.Req, data)
+			if err != nil {
+				log.Warning("parse %s rsp failed:%v", rule.Handler.Name(), err)
+				return resp
+			}
+			// saving requests didi and geocoders, responses are not held by it
+			hr.enqueue(records)
+			return resp
+		})
+	}
+}
+
+// start starts the worker saving queued records by dh.
+func (hr *HookRegistry) start(dh *DidiHooker) {
+	hr.queue = make(chan []HookRecord, hookQueueSize)
+	hr.drained = make(chan struct{})
+	go func() {
+		defer close(hr.drained)
+		for records := range hr.queue {
+			for _, rec := range records {
+				rec.save(dh)
+			}
+		}
+	}()
+}
+
+func (hr *HookRegistry) enqueue(records []HookRecord) {
+	if len(records) == 0 {
+		return
+	}
+	hr.queueMtx.Lock()
+	defer hr.queueMtx.Unlock()
+	if hr.closed {
+		log.Warning("hook registry is closed, drop %d records", len(records))
+		return
+	}
+	hr.queue <- records
+}
+
+// Close stops accepting records and waits until records queued are saved.
+func (hr *HookRegistry) Close() {
+	if hr.queue == nil {
+		return
+	}
+	hr.queueMtx.Lock()
+	if !hr.closed {
+		hr.closed = true
+		close(hr.queue)
+	}
+	hr.queueMtx.Unlock()
+	<-hr.drained
+}
+
+// logUnmatchedRequest logs method and path once, for discovering pages not supported yet.
+func (hr *HookRegistry) logUnmatchedRequest(host string, req *http.Request, resp *http.Response) {
+	if !hr.logUnmatched {
+		return
+	}
+	key := req.Method + " " + host + req.URL.Path
+	hr.mtx.Lock()
+	logged := hr.unmatched[key]
+	hr.unmatched[key] = true
+	hr.mtx.Unlock()
+	if !logged {
+		log.Info("unmatched %s [status:%d] [content-type:%s] [query:%s]", key, resp.StatusCode,
+			resp.Header.Get("Content-Type"), req.URL.RawQuery)
+	}
+}
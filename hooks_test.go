@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+type nopHookHandler string
+
+func (h nopHookHandler) Name() string { return string(h) }
+
+func (h nopHookHandler) Parse(req *http.Request, body []byte) ([]HookRecord, error) { return nil, nil }
+
+func TestHookRuleMatch(t *testing.T) {
+	tests := []struct {
+		rule         HookRule
+		method, path string
+		want         bool
+	}{
+		{HookRule{Path: "/front/gasstation/index"}, "GET", "/front/gasstation/index", true},
+		{HookRule{Path: "/front/gasstation/index"}, "POST", "/front/gasstation/index/v2", true},
+		{HookRule{Path: "/front/gasstation/index"}, "GET", "/front/gasstation", false},
+		{HookRule{Method: "POST", Path: "/map/store/near"}, "GET", "/map/store/near", false},
+		{HookRule{Method: "POST", Path: "/map/store/near"}, "POST", "/map/store/near", true},
+		{HookRule{Path: "/front/*/index"}, "GET", "/front/gasstation/index", true},
+		{HookRule{Path: "/front/*/index"}, "GET", "/front/gasstation/index/v2", false},
+		{HookRule{Path: "/store/[0-9]*"}, "GET", "/store/123", true},
+		{HookRule{Path: "/store/[0-9]*"}, "GET", "/store/abc", false},
+		{HookRule{Path: "/store/?"}, "GET", "/store/1", true},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "https://example.com"+tt.path, nil)
+		if got := tt.rule.match(req); got != tt.want {
+			t.Errorf("%+v match %s %s = %v, want %v", tt.rule, tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestHookRegistryMatch(t *testing.T) {
+	hr := NewHookRegistry(false)
+	hr.Register(HookRule{Host: "a.com:443", Path: "/front/gasstation/index/v2", Handler: nopHookHandler("v2")})
+	hr.Register(HookRule{Host: "a.com:443", Path: "/front/gasstation/index", Handler: nopHookHandler("index")})
+	hr.Register(HookRule{Host: "b.com:443", Path: "/", Handler: nopHookHandler("b")})
+
+	tests := []struct {
+		host, path string
+		want       string
+	}{
+		// the first matching rule wins
+		{"a.com:443", "/front/gasstation/index/v2", "v2"},
+		{"a.com:443", "/front/gasstation/index", "index"},
+		{"a.com:443", "/map/store/near", ""},
+		{"b.com:443", "/front/gasstation/index", "b"},
+		{"c.com:443", "/", ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "https://example.com"+tt.path, nil)
+		got := ""
+		if rule := hr.match(tt.host, req); rule != nil {
+			got = rule.Handler.Name()
+		}
+		if got != tt.want {
+			t.Errorf("match(%s, %s) = %q, want %q", tt.host, tt.path, got, tt.want)
+		}
+	}
+}
+
+// orderedRecord appends its id to saved when saved.
+type orderedRecord struct {
+	id    int
+	saved *[]int
+}
+
+func (r orderedRecord) save(dh *DidiHooker) {
+	*r.saved = append(*r.saved, r.id)
+}
+
+func TestHookRegistrySaveOrder(t *testing.T) {
+	hr := NewHookRegistry(false)
+	// Close before start does nothing
+	hr.Close()
+	hr.start(nil)
+
+	saved := []int{}
+	want := []int{}
+	for i := 0; i < hookQueueSize*2; i += 2 {
+		hr.enqueue([]HookRecord{orderedRecord{i, &saved}, orderedRecord{i + 1, &saved}})
+		want = append(want, i, i+1)
+	}
+	// records queued are saved in order by Close
+	hr.Close()
+	if !reflect.DeepEqual(saved, want) {
+		t.Errorf("saved = %v, want %v", saved, want)
+	}
+
+	// records after Close are dropped
+	hr.enqueue([]HookRecord{orderedRecord{-1, &saved}})
+	hr.Close()
+	if len(saved) != len(want) {
+		t.Errorf("saved after close = %v", saved[len(want):])
+	}
+}
@@ -14,11 +14,13 @@ func main() {
 	app.Version = "0.0.1"
 	app.Usage = "Collect didi gas station data, and rank most popular didi cars"
 	app.EnableBashCompletion = true
-	app.Commands = []cli.Command{
+	app.Flags = configFlags
+	app.Before = setupConfig
+	app.Commands = withConfigFlags([]cli.Command{
 		cli.Command{
 			Name:  "collect_data",
 			Usage: "Collect didi gas station data",
-			Flags: []cli.Flag{
+			Flags: append([]cli.Flag{
 				cli.StringFlag{
 					Name:  "listen, l",
 					Usage: "listen addr",
@@ -29,13 +31,26 @@ func main() {
 					Usage: "directory for saving data",
 					Value: "./data",
 				},
-			},
+				cli.StringFlag{
+					Name:  "ca-dir",
+					Usage: "directory of root CA, generated on first run",
+					Value: "./ca",
+				},
+				cli.StringFlag{
+					Name:  "dashboard",
+					Usage: "listen addr of collection progress dashboard, disabled if empty",
+				},
+				cli.BoolFlag{
+					Name:  "log-unmatched",
+					Usage: "log requests to didi not handled by any hook, for discovering new pages",
+				},
+			}, concatFlags(geocodeFlags, geocodeCacheFlags, storageFlags)...),
 			Action: collectData,
 		},
 		cli.Command{
 			Name:  "analysis",
 			Usage: "Analysis collected data and output most popular didi cars",
-			Flags: []cli.Flag{
+			Flags: append([]cli.Flag{
 				cli.StringFlag{
 					Name:  "dir, d",
 					Usage: "data directory",
@@ -43,7 +58,7 @@ func main() {
 				},
 				cli.StringFlag{
 					Name:  "city, c",
-					Usage: "city name",
+					Usage: "city name, comma-separated list, glob pattern or all",
 					Value: "成都市",
 				},
 				cli.IntFlag{
@@ -51,13 +66,200 @@ func main() {
 					Usage: "output top n",
 					Value: 20,
 				},
-			},
+				cli.StringFlag{
+					Name:  "mode",
+					Usage: "rank: popularity rankings, tco: fuel spend of popular models",
+					Value: modeRank,
+				},
+			}, concatFlags(windowFlags, snapshotFlags, aliasFlags, groupByFlags, weightingFlags, reportFlags, storageFlags)...),
 			Action: analysisCity,
 		},
-	}
+		cli.Command{
+			Name:  "migrate",
+			Usage: "Copy collected data to another storage backend",
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name:  "dir, d",
+					Usage: "data directory",
+					Value: "./data",
+				},
+				cli.StringFlag{
+					Name:  "to",
+					Usage: "destination storage backend: file or sqlite",
+					Value: "sqlite",
+				},
+				cli.StringFlag{
+					Name:  "to-dir",
+					Usage: "destination data directory",
+					Value: "./data",
+				},
+				cli.StringFlag{
+					Name:  "to-db",
+					Usage: "destination sqlite database file, default <to-dir>/didi-car-rank.db",
+				},
+			}, storageFlags...),
+			Action: migrateData,
+		},
+		cli.Command{
+			Name:   "reclassify",
+			Usage:  "Move data of stations to the city of their own coordinates",
+			Flags:  concatFlags(reclassifyFlags, geocodeFlags, geocodeCacheFlags, storageFlags),
+			Action: reclassify,
+		},
+		cli.Command{
+			Name:  "aliases",
+			Usage: "Manage car model aliases used to merge name variants",
+			Subcommands: []cli.Command{
+				cli.Command{
+					Name:  "suggest",
+					Usage: "Cluster similar car model names for review",
+					Flags: append([]cli.Flag{
+						cli.StringFlag{
+							Name:  "dir, d",
+							Usage: "data directory",
+							Value: "./data",
+						},
+						cli.StringFlag{
+							Name:  "city, c",
+							Usage: "city name, comma-separated list, glob pattern or all",
+							Value: "all",
+						},
+						cli.IntFlag{
+							Name:  "max-distance",
+							Usage: "max edit distance of similar names",
+							Value: 2,
+						},
+						cli.StringFlag{
+							Name:  "output, o",
+							Usage: "write suggested aliases to file, in the format of --aliases",
+						},
+						aliasesFlag,
+					}, storageFlags...),
+					Action: suggestAliases,
+				},
+				cli.Command{
+					Name:  "dump",
+					Usage: "Print built-in aliases, edit and pass it with --aliases",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "output, o",
+							Usage: "output file, default stdout",
+						},
+					},
+					Action: dumpAliases,
+				},
+			},
+		},
+		cli.Command{
+			Name:  "prices",
+			Usage: "Analysis gas station prices observed while collecting",
+			Subcommands: []cli.Command{
+				cli.Command{
+					Name:  "cheapest",
+					Usage: "List cheapest stations by latest price",
+					Flags: append([]cli.Flag{
+						cli.IntFlag{
+							Name:  "top, t",
+							Usage: "top n stations of every fuel category",
+							Value: 10,
+						},
+					}, concatFlags(priceFlags, windowFlags, []cli.Flag{formatFlag, outputFlag}, storageFlags)...),
+					Action: priceCheapest,
+				},
+				cli.Command{
+					Name:  "trend",
+					Usage: "Show average price per day or week",
+					Flags: append([]cli.Flag{
+						cli.StringFlag{
+							Name:  "interval",
+							Usage: "day or week",
+							Value: intervalDay,
+						},
+						cli.StringFlag{
+							Name:  "store",
+							Usage: "only show price of station with this store id",
+						},
+					}, concatFlags(priceFlags, windowFlags, []cli.Flag{formatFlag, outputFlag}, storageFlags)...),
+					Action: priceTrend,
+				},
+				cli.Command{
+					Name:   "discounts",
+					Usage:  "Show discount distribution by station brand",
+					Flags:  concatFlags(priceFlags, windowFlags, []cli.Flag{formatFlag, outputFlag}, storageFlags),
+					Action: priceDiscounts,
+				},
+			},
+		},
+		cli.Command{
+			Name:  "export",
+			Usage: "Export stations with their orders and repurchase drivers for maps",
+			Subcommands: []cli.Command{
+				cli.Command{
+					Name:   "geojson",
+					Usage:  "Export stations as GeoJSON points",
+					Flags:  concatFlags(exportFlags, crsFlags, windowFlags, snapshotFlags, aliasFlags, storageFlags),
+					Action: exportGeoJSON,
+				},
+				cli.Command{
+					Name:  "map",
+					Usage: "Export stations as a self-contained HTML map",
+					Flags: append([]cli.Flag{
+						cli.StringFlag{
+							Name:  "leaflet",
+							Usage: "directory of leaflet.js and leaflet.css inlined into the map, default load from CDN",
+						},
+						cli.StringFlag{
+							Name:  "tiles",
+							Usage: "tile URL template, e.g. tiles/{z}/{x}/{y}.png, default plain background",
+						},
+					}, concatFlags(exportFlags, crsFlags, windowFlags, snapshotFlags, aliasFlags, storageFlags)...),
+					Action: exportMap,
+				},
+			},
+		},
+		cli.Command{
+			Name:  "ca",
+			Usage: "Manage root CA used for MITM",
+			Subcommands: []cli.Command{
+				cli.Command{
+					Name:  "init",
+					Usage: "Generate a new root CA and export it in PEM, DER, .mobileconfig and .p12 forms",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "ca-dir",
+							Usage: "directory for saving CA",
+							Value: "./ca",
+						},
+						cli.StringFlag{
+							Name:  "key-type",
+							Usage: "key type: rsa or ecdsa",
+							Value: "ecdsa",
+						},
+						cli.StringFlag{
+							Name:  "p12-password",
+							Usage: "password of exported .p12 file",
+						},
+						cli.BoolFlag{
+							Name:  "force",
+							Usage: "overwrite existing CA",
+						},
+					},
+					Action: initCA,
+				},
+			},
+		},
+	})
 	err := app.Run(os.Args)
 	if err != nil {
 		log.Error(err.Error())
 		return
 	}
 }
+
+func concatFlags(flagSets ...[]cli.Flag) []cli.Flag {
+	flags := []cli.Flag{}
+	for _, set := range flagSets {
+		flags = append(flags, set...)
+	}
+	return flags
+}
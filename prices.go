@@ -0,0 +1,564 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// kindPrice is the data kind of price observations
+const kindPrice = "price"
+
+// PriceObservation is the price of a fuel category at a station seen in a station query.
+// Prices are kept as returned by didi, Price is the didi price per litre
+// and Discount the saving per litre against station list price.
+type PriceObservation struct {
+	StoreID          string    `json:"store_id"`
+	Name             string    `json:"name"`
+	FuelCategory     string    `json:"fuel_category"`
+	FuelCategoryName string    `json:"fuel_category_name"`
+	Price            string    `json:"price"`
+	Discount         string    `json:"discount,omitempty"`
+	RankPrice        string    `json:"rank_price,omitempty"`
+	TotalScore       string    `json:"total_score,omitempty"`
+	ObservedAt       time.Time `json:"observed_at"`
+	// Source is the hook the price is captured from
+	Source string `json:"source"`
+}
+
+var amountRe = regexp.MustCompile(`\d+(\.\d+)?`)
+
+// parseAmount parses the first decimal number in s, e.g. 0.85 of "直降0.85元".
+func parseAmount(s string) (float64, bool) {
+	m := amountRe.FindString(s)
+	if m == "" {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(m, 64)
+	return v, err == nil
+}
+
+// PricePerLitre returns didi price, ok is false if price is not a positive number.
+func (o PriceObservation) PricePerLitre() (float64, bool) {
+	v, ok := parseAmount(o.Price)
+	return v, ok && v > 0
+}
+
+// DiscountPerLitre returns discount, 0 if unknown.
+func (o PriceObservation) DiscountPerLitre() float64 {
+	v, _ := parseAmount(o.Discount)
+	return v
+}
+
+// matchFuel reports whether observation is of fuel category id or name, empty fuel matches all.
+func (o PriceObservation) matchFuel(fuel string) bool {
+	return fuel == "" || fuel == o.FuelCategory || fuel == o.FuelCategoryName
+}
+
+// fuelLabel is the name of fuel category shown in reports.
+func (o PriceObservation) fuelLabel() string {
+	if o.FuelCategoryName != "" {
+		return o.FuelCategoryName
+	}
+	if o.FuelCategory != "" {
+		return o.FuelCategory
+	}
+	return unknownGroup
+}
+
+// priceObserveInterval is the minimal interval of recording an unchanged price again,
+// the same station list is returned many times while user scrolls.
+const priceObserveInterval = 10 * time.Minute
+
+// priceRecorder drops observations whose price has not changed since last recorded.
+type priceRecorder struct {
+	mtx  sync.Mutex
+	last map[string]PriceObservation
+}
+
+func newPriceRecorder() *priceRecorder {
+	return &priceRecorder{
+		last: map[string]PriceObservation{},
+	}
+}
+
+func (pr *priceRecorder) filter(obs []PriceObservation) []PriceObservation {
+	pr.mtx.Lock()
+	defer pr.mtx.Unlock()
+	changed := []PriceObservation{}
+	for _, o := range obs {
+		key := o.StoreID + "|" + o.FuelCategory
+		if last, ok := pr.last[key]; ok && last.Price == o.Price && last.Discount == o.Discount &&
+			last.RankPrice == o.RankPrice && o.ObservedAt.Sub(last.ObservedAt) < priceObserveInterval {
+			continue
+		}
+		pr.last[key] = o
+		changed = append(changed, o)
+	}
+	return changed
+}
+
+// stationBrands maps keywords in station names to station brands, checked in order.
+var stationBrands = []struct {
+	keywords []string
+	brand    string
+}{
+	{[]string{"中石化碧辟", "碧辟"}, "中石化碧辟"},
+	{[]string{"中国石化", "中石化"}, "中国石化"},
+	{[]string{"中国石油", "中石油"}, "中国石油"},
+	{[]string{"中海油", "中海石油"}, "中海油"},
+	{[]string{"中化"}, "中化"},
+	{[]string{"壳牌"}, "壳牌"},
+	{[]string{"道达尔"}, "道达尔"},
+	{[]string{"BP"}, "BP"},
+	{[]string{"美孚", "埃索"}, "埃克森美孚"},
+	{[]string{"延长"}, "延长石油"},
+}
+
+const stationBrandPrivate = "民营"
+
+// stationBrand guesses brand of station from its name, stations of
+// none of the major brands are private.
+func stationBrand(name string) string {
+	upper := strings.ToUpper(name)
+	for _, b := range stationBrands {
+		for _, kw := range b.keywords {
+			if strings.Contains(upper, kw) {
+				return b.brand
+			}
+		}
+	}
+	return stationBrandPrivate
+}
+
+var priceFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "dir, d",
+		Usage: "data directory",
+		Value: "./data",
+	},
+	cli.StringFlag{
+		Name:  "city, c",
+		Usage: "city name, comma-separated list, glob pattern or all",
+		Value: "成都市",
+	},
+	cli.StringFlag{
+		Name:  "fuel",
+		Usage: "fuel category id or name, e.g. 92#, default all",
+	},
+}
+
+// priceData is the price observations of cities with their station details.
+type priceData struct {
+	cities       []string
+	observations []PriceObservation
+	details      map[string]StationDetail
+}
+
+// loadPriceData loads observations of --city and --fuel in --since and --until.
+func loadPriceData(c *cli.Context) (*priceData, error) {
+	store, err := openDataStore(c)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+	cities, err := resolveCities(store, c.String("city"))
+	if err != nil {
+		return nil, err
+	}
+	w, err := timeWindowFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+	fuel := c.String("fuel")
+	pd := &priceData{cities: cities, observations: []PriceObservation{}, details: map[string]StationDetail{}}
+	for _, city := range cities {
+		if err := store.ForEachPriceObservation(city, func(o PriceObservation) error {
+			if _, ok := o.PricePerLitre(); ok && o.matchFuel(fuel) && w.Contains(o.ObservedAt) {
+				pd.observations = append(pd.observations, o)
+			}
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+		details, err := stationDetails(store, city)
+		if err != nil {
+			return nil, err
+		}
+		for storeID, d := range details {
+			pd.details[storeID] = d
+		}
+	}
+	return pd, nil
+}
+
+// latestPrices returns the latest observation of every station and fuel category.
+func latestPrices(obs []PriceObservation) []PriceObservation {
+	latest := map[string]PriceObservation{}
+	for _, o := range obs {
+		key := o.StoreID + "|" + o.FuelCategory
+		if last, ok := latest[key]; !ok || o.ObservedAt.After(last.ObservedAt) {
+			latest[key] = o
+		}
+	}
+	result := make([]PriceObservation, 0, len(latest))
+	for _, o := range latest {
+		result = append(result, o)
+	}
+	return result
+}
+
+// fuelLabels returns fuel categories of observations, most observed first.
+func fuelLabels(obs []PriceObservation) []string {
+	count := map[string]int{}
+	for _, o := range obs {
+		count[o.fuelLabel()]++
+	}
+	labels := []string{}
+	for label := range count {
+		labels = append(labels, label)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		if count[labels[i]] != count[labels[j]] {
+			return count[labels[i]] > count[labels[j]]
+		}
+		return labels[i] < labels[j]
+	})
+	return labels
+}
+
+// CheapestReport lists the cheapest stations of every fuel category by latest price.
+type CheapestReport struct {
+	Cities   []string            `json:"cities"`
+	Stations []StationPriceEntry `json:"stations"`
+}
+
+type StationPriceEntry struct {
+	Rank       int       `json:"rank"`
+	Fuel       string    `json:"fuel"`
+	StoreID    string    `json:"store_id"`
+	Name       string    `json:"name"`
+	Address    string    `json:"address"`
+	Brand      string    `json:"brand"`
+	Price      float64   `json:"price"`
+	Discount   float64   `json:"discount"`
+	ObservedAt time.Time `json:"observed_at"`
+}
+
+func priceCheapest(c *cli.Context) error {
+	pd, err := loadPriceData(c)
+	if err != nil {
+		return err
+	}
+	latest := latestPrices(pd.observations)
+	sort.Slice(latest, func(i, j int) bool {
+		pi, _ := latest[i].PricePerLitre()
+		pj, _ := latest[j].PricePerLitre()
+		if pi != pj {
+			return pi < pj
+		}
+		return latest[i].StoreID < latest[j].StoreID
+	})
+
+	r := &CheapestReport{Cities: pd.cities, Stations: []StationPriceEntry{}}
+	for _, fuel := range fuelLabels(latest) {
+		rank := 0
+		for _, o := range latest {
+			if o.fuelLabel() != fuel || rank >= c.Int("top") {
+				continue
+			}
+			rank++
+			price, _ := o.PricePerLitre()
+			r.Stations = append(r.Stations, StationPriceEntry{
+				Rank:       rank,
+				Fuel:       fuel,
+				StoreID:    o.StoreID,
+				Name:       o.Name,
+				Address:    pd.details[o.StoreID].Address,
+				Brand:      stationBrand(o.Name),
+				Price:      price,
+				Discount:   o.DiscountPerLitre(),
+				ObservedAt: o.ObservedAt,
+			})
+		}
+	}
+	return writeReport(r, c.String("format"), c.String("output"))
+}
+
+func (r *CheapestReport) summary() string {
+	return (&Report{Cities: r.Cities}).summary()
+}
+
+func (r *CheapestReport) tables() []reportTable {
+	tables := []reportTable{}
+	for _, e := range r.Stations {
+		if e.Rank == 1 {
+			tables = append(tables, reportTable{
+				Title:  e.Fuel + "最便宜加油站",
+				Header: []string{"排名", "加油站", "品牌", "滴滴价", "优惠", "地址", "观测时间"},
+			})
+		}
+		t := &tables[len(tables)-1]
+		t.Rows = append(t.Rows, []string{
+			fmt.Sprint(e.Rank),
+			e.Name,
+			e.Brand,
+			fmt.Sprintf("%.02f", e.Price),
+			fmt.Sprintf("%.02f", e.Discount),
+			e.Address,
+			e.ObservedAt.Format("2006-01-02 15:04"),
+		})
+	}
+	return tables
+}
+
+func (r *CheapestReport) renderCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"fuel", "rank", "store_id", "name", "address", "brand", "price", "discount", "observed_at"}); err != nil {
+		return err
+	}
+	for _, e := range r.Stations {
+		if err := cw.Write([]string{e.Fuel, fmt.Sprint(e.Rank), e.StoreID, e.Name, e.Address, e.Brand,
+			formatFloat(e.Price), formatFloat(e.Discount), e.ObservedAt.Format(time.RFC3339)}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// price trend intervals
+const (
+	intervalDay  = "day"
+	intervalWeek = "week"
+)
+
+// PriceTrendReport is the average price of every fuel category per day or week.
+// Every station contributes its latest price of the period.
+type PriceTrendReport struct {
+	Cities   []string          `json:"cities"`
+	StoreID  string            `json:"store_id,omitempty"`
+	Interval string            `json:"interval"`
+	Points   []PriceTrendPoint `json:"points"`
+}
+
+type PriceTrendPoint struct {
+	Period   string  `json:"period"`
+	Fuel     string  `json:"fuel"`
+	Stations int     `json:"stations"`
+	AvgPrice float64 `json:"avg_price"`
+	MinPrice float64 `json:"min_price"`
+	MaxPrice float64 `json:"max_price"`
+	// AvgDiscount is the average discount per litre
+	AvgDiscount float64 `json:"avg_discount"`
+}
+
+// period returns start date of the interval containing t.
+func period(t time.Time, interval string) string {
+	t = t.Local()
+	if interval == intervalWeek {
+		// weeks start on monday
+		t = t.AddDate(0, 0, -(int(t.Weekday())+6)%7)
+	}
+	return t.Format(dateLayout)
+}
+
+func priceTrend(c *cli.Context) error {
+	interval := c.String("interval")
+	if interval != intervalDay && interval != intervalWeek {
+		return fmt.Errorf("unknown interval: %s", interval)
+	}
+	pd, err := loadPriceData(c)
+	if err != nil {
+		return err
+	}
+	storeID := c.String("store")
+
+	type pointKey struct {
+		period, fuel string
+	}
+	periodObs := map[pointKey][]PriceObservation{}
+	for _, o := range pd.observations {
+		if storeID != "" && o.StoreID != storeID {
+			continue
+		}
+		key := pointKey{period(o.ObservedAt, interval), o.fuelLabel()}
+		periodObs[key] = append(periodObs[key], o)
+	}
+
+	r := &PriceTrendReport{Cities: pd.cities, StoreID: storeID, Interval: interval, Points: []PriceTrendPoint{}}
+	for key, obs := range periodObs {
+		latest := latestPrices(obs)
+		prices, discounts := make([]float64, 0, len(latest)), make([]float64, 0, len(latest))
+		for _, o := range latest {
+			price, _ := o.PricePerLitre()
+			prices = append(prices, price)
+			discounts = append(discounts, o.DiscountPerLitre())
+		}
+		sort.Float64s(prices)
+		r.Points = append(r.Points, PriceTrendPoint{
+			Period:      key.period,
+			Fuel:        key.fuel,
+			Stations:    len(latest),
+			AvgPrice:    roundYuan(mean(prices)),
+			MinPrice:    prices[0],
+			MaxPrice:    prices[len(prices)-1],
+			AvgDiscount: roundYuan(mean(discounts)),
+		})
+	}
+	sort.Slice(r.Points, func(i, j int) bool {
+		if r.Points[i].Fuel != r.Points[j].Fuel {
+			return r.Points[i].Fuel < r.Points[j].Fuel
+		}
+		return r.Points[i].Period < r.Points[j].Period
+	})
+	return writeReport(r, c.String("format"), c.String("output"))
+}
+
+func (r *PriceTrendReport) summary() string {
+	summary := (&Report{Cities: r.Cities}).summary()
+	if r.StoreID != "" {
+		summary = strings.TrimSpace(summary + " 加油站: " + r.StoreID)
+	}
+	return summary
+}
+
+func (r *PriceTrendReport) tables() []reportTable {
+	label := map[string]string{intervalDay: "日期", intervalWeek: "周"}[r.Interval]
+	tables := []reportTable{}
+	for i, p := range r.Points {
+		if i == 0 || p.Fuel != r.Points[i-1].Fuel {
+			tables = append(tables, reportTable{
+				Title:  p.Fuel + "价格走势",
+				Header: []string{label, "加油站数", "平均价格", "最低价格", "最高价格", "平均优惠"},
+			})
+		}
+		t := &tables[len(tables)-1]
+		t.Rows = append(t.Rows, []string{
+			p.Period,
+			fmt.Sprint(p.Stations),
+			fmt.Sprintf("%.02f", p.AvgPrice),
+			fmt.Sprintf("%.02f", p.MinPrice),
+			fmt.Sprintf("%.02f", p.MaxPrice),
+			fmt.Sprintf("%.02f", p.AvgDiscount),
+		})
+	}
+	return tables
+}
+
+func (r *PriceTrendReport) renderCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"fuel", "period", "stations", "avg_price", "min_price", "max_price", "avg_discount"}); err != nil {
+		return err
+	}
+	for _, p := range r.Points {
+		if err := cw.Write([]string{p.Fuel, p.Period, fmt.Sprint(p.Stations), formatFloat(p.AvgPrice),
+			formatFloat(p.MinPrice), formatFloat(p.MaxPrice), formatFloat(p.AvgDiscount)}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// DiscountReport is the distribution of latest discounts per litre by station brand.
+type DiscountReport struct {
+	Cities []string             `json:"cities"`
+	Brands []BrandDiscountEntry `json:"brands"`
+}
+
+type BrandDiscountEntry struct {
+	Brand    string  `json:"brand"`
+	Stations int     `json:"stations"`
+	Mean     float64 `json:"mean"`
+	Median   float64 `json:"median"`
+	StdDev   float64 `json:"stddev"`
+	Min      float64 `json:"min"`
+	Max      float64 `json:"max"`
+	// AvgPrice is the average didi price of the brand
+	AvgPrice float64 `json:"avg_price"`
+}
+
+func priceDiscounts(c *cli.Context) error {
+	pd, err := loadPriceData(c)
+	if err != nil {
+		return err
+	}
+	brandDiscounts, brandPrices := map[string][]float64{}, map[string][]float64{}
+	for _, o := range latestPrices(pd.observations) {
+		brand := stationBrand(o.Name)
+		price, _ := o.PricePerLitre()
+		brandDiscounts[brand] = append(brandDiscounts[brand], o.DiscountPerLitre())
+		brandPrices[brand] = append(brandPrices[brand], price)
+	}
+
+	r := &DiscountReport{Cities: pd.cities, Brands: []BrandDiscountEntry{}}
+	for brand, discounts := range brandDiscounts {
+		sort.Float64s(discounts)
+		m := mean(discounts)
+		r.Brands = append(r.Brands, BrandDiscountEntry{
+			Brand:    brand,
+			Stations: len(discounts),
+			Mean:     roundYuan(m),
+			Median:   median(discounts),
+			StdDev:   roundYuan(stddev(discounts, m)),
+			Min:      discounts[0],
+			Max:      discounts[len(discounts)-1],
+			AvgPrice: roundYuan(mean(brandPrices[brand])),
+		})
+	}
+	sort.Slice(r.Brands, func(i, j int) bool {
+		if r.Brands[i].Mean != r.Brands[j].Mean {
+			return r.Brands[i].Mean > r.Brands[j].Mean
+		}
+		return r.Brands[i].Brand < r.Brands[j].Brand
+	})
+	return writeReport(r, c.String("format"), c.String("output"))
+}
+
+func (r *DiscountReport) summary() string {
+	return (&Report{Cities: r.Cities}).summary()
+}
+
+func (r *DiscountReport) tables() []reportTable {
+	t := reportTable{
+		Title:  "加油站品牌优惠分布",
+		Header: []string{"品牌", "加油站数", "平均优惠", "中位数", "标准差", "最低", "最高", "平均滴滴价"},
+	}
+	for _, e := range r.Brands {
+		t.Rows = append(t.Rows, []string{
+			e.Brand,
+			fmt.Sprint(e.Stations),
+			fmt.Sprintf("%.02f", e.Mean),
+			fmt.Sprintf("%.02f", e.Median),
+			fmt.Sprintf("%.02f", e.StdDev),
+			fmt.Sprintf("%.02f", e.Min),
+			fmt.Sprintf("%.02f", e.Max),
+			fmt.Sprintf("%.02f", e.AvgPrice),
+		})
+	}
+	return []reportTable{t}
+}
+
+func (r *DiscountReport) renderCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"brand", "stations", "mean", "median", "stddev", "min", "max", "avg_price"}); err != nil {
+		return err
+	}
+	for _, e := range r.Brands {
+		if err := cw.Write([]string{e.Brand, fmt.Sprint(e.Stations), formatFloat(e.Mean), formatFloat(e.Median),
+			formatFloat(e.StdDev), formatFloat(e.Min), formatFloat(e.Max), formatFloat(e.AvgPrice)}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+func TestPricesDefaultCity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "didi-car-rank")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Now()
+	for city, price := range map[string]string{"成都市": "6.50", "上海市": "6.90"} {
+		if err := NewFileStore(dir).AddPriceObservations(city, []PriceObservation{
+			{StoreID: city, Name: "中石化" + city, FuelCategory: "1", FuelCategoryName: "92#", Price: price, ObservedAt: now},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		args   []string
+		cities []string
+	}{
+		{nil, []string{"成都市"}},
+		{[]string{"-c", "上海市"}, []string{"上海市"}},
+		{[]string{"-c", "all"}, []string{"上海市", "成都市"}},
+	}
+	for _, tt := range tests {
+		output := filepath.Join(dir, "cheapest.json")
+		app := cli.NewApp()
+		app.Commands = []cli.Command{
+			{
+				Name: "cheapest",
+				Flags: append([]cli.Flag{
+					cli.IntFlag{Name: "top, t", Value: 10},
+				}, concatFlags(priceFlags, windowFlags, []cli.Flag{formatFlag, outputFlag}, storageFlags)...),
+				Action: priceCheapest,
+			},
+		}
+		args := append([]string{"didi-car-rank", "cheapest", "-d", dir, "-f", formatJSON, "-o", output}, tt.args...)
+		if err := app.Run(args); err != nil {
+			t.Fatalf("%v: %v", tt.args, err)
+		}
+		r := CheapestReport{}
+		data, err := ioutil.ReadFile(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(data, &r); err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Cities) != len(tt.cities) || len(r.Stations) != len(tt.cities) {
+			t.Errorf("%v: report = %+v, want cities %v", tt.args, r, tt.cities)
+			continue
+		}
+		for i, city := range tt.cities {
+			if r.Cities[i] != city {
+				t.Errorf("%v: cities = %v, want %v", tt.args, r.Cities, tt.cities)
+			}
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"sort"
+
+	log "github.com/liudanking/goutil/logutil"
+	"github.com/urfave/cli"
+)
+
+var reclassifyFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "dir, d",
+		Usage: "data directory",
+		Value: "./data",
+	},
+	cli.StringFlag{
+		Name:  "city, c",
+		Usage: "city name, comma-separated list, glob pattern or all",
+		Value: "all",
+	},
+	cli.BoolFlag{
+		Name:  "dry-run",
+		Usage: "only print stations to move",
+	},
+}
+
+// reclassify moves data of every station to the city of its own position, data
+// collected before stations were geocoded one by one is in the city of the map center.
+func reclassify(c *cli.Context) error {
+	store, err := openDataStore(c)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	geocoder, err := geocoderFromContext(c, store)
+	if err != nil {
+		return err
+	}
+	if geocoder.empty() {
+		return errors.New("reclassify needs --boundaries or --gaode-key")
+	}
+	cities, err := resolveCities(store, c.String("city"))
+	if err != nil {
+		return err
+	}
+
+	positions, err := stationPositions(store)
+	if err != nil {
+		return err
+	}
+
+	dryRun := c.Bool("dry-run")
+	total := 0
+	for _, city := range cities {
+		ids, err := cityStoreIDs(store, city)
+		if err != nil {
+			return err
+		}
+		located := []string{}
+		points := []point{}
+		for _, storeID := range ids {
+			if p, ok := positions[storeID]; ok {
+				located = append(located, storeID)
+				points = append(points, p)
+			}
+		}
+		if skipped := len(ids) - len(located); skipped > 0 {
+			log.Warning("%d of %d stations of %s have no coordinates, kept", skipped, len(ids), city)
+		}
+
+		moves := map[string][]string{}
+		regions, errs := geocoder.ReverseGeocodeBatch(points)
+		for i, storeID := range located {
+			if errs[i] != nil {
+				log.Warning("reverse geocode [store_id:%s] of %s failed, kept:%v", storeID, city, errs[i])
+				continue
+			}
+			if to := regions[i].City; to != city && to != unknownCity {
+				moves[to] = append(moves[to], storeID)
+			}
+		}
+
+		targets := make([]string, 0, len(moves))
+		for to := range moves {
+			targets = append(targets, to)
+		}
+		sort.Strings(targets)
+		for _, to := range targets {
+			storeIDs := moves[to]
+			total += len(storeIDs)
+			if dryRun {
+				log.Info("would move %d stations from %s to %s: %v", len(storeIDs), city, to, storeIDs)
+				continue
+			}
+			if err := store.MoveStores(city, to, storeIDs); err != nil {
+				return err
+			}
+			log.Info("moved %d stations from %s to %s", len(storeIDs), city, to)
+		}
+	}
+	if dryRun {
+		log.Info("%d stations to move", total)
+	} else {
+		log.Info("%d stations moved", total)
+	}
+	return nil
+}
+
+// stationPositions returns position of stations of all cities, station details
+// are used for stations not in station list.
+func stationPositions(store DataStore) (map[string]point, error) {
+	cities, err := store.Cities()
+	if err != nil {
+		return nil, err
+	}
+	positions := map[string]point{}
+	add := func(storeID string, lng, lat float64) {
+		if _, ok := positions[storeID]; !ok && (lng != 0 || lat != 0) {
+			positions[storeID] = point{lng, lat}
+		}
+	}
+	for _, city := range cities {
+		if err := store.ForEachStation(city, func(s Store) error {
+			add(s.StoreID, s.Lng, s.Lat)
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+		if err := store.ForEachStationDetail(city, func(d StationDetail) error {
+			add(d.StoreID, d.Lng, d.Lat)
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return positions, nil
+}
+
+// cityStoreIDs returns sorted IDs of stores having any data in city.
+func cityStoreIDs(store DataStore, city string) ([]string, error) {
+	seen := map[string]bool{}
+	if err := store.ForEachStation(city, func(s Store) error {
+		seen[s.StoreID] = true
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := store.ForEachStationDetail(city, func(d StationDetail) error {
+		seen[d.StoreID] = true
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := store.ForEachCurrentOrder(city, func(storeID string, rec CurrentOrderRecord) error {
+		seen[storeID] = true
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := store.ForEachRepurchaseSnapshot(city, func(storeID string, snap RepurchaseSnapshot) error {
+		seen[storeID] = true
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := store.ForEachPriceObservation(city, func(obs PriceObservation) error {
+		seen[obs.StoreID] = true
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(seen))
+	for storeID := range seen {
+		ids = append(ids, storeID)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
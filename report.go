@@ -0,0 +1,419 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/olekukonko/tablewriter"
+	"github.com/urfave/cli"
+)
+
+// report output formats
+const (
+	formatTable    = "table"
+	formatJSON     = "json"
+	formatCSV      = "csv"
+	formatMarkdown = "markdown"
+	formatHTML     = "html"
+)
+
+var (
+	formatFlag = cli.StringFlag{
+		Name:  "format, f",
+		Usage: "output format: table, json, csv, markdown or html",
+		Value: formatTable,
+	}
+	outputFlag = cli.StringFlag{
+		Name:  "output, o",
+		Usage: "output file, default stdout",
+	}
+	minSamplesFlag = cli.IntFlag{
+		Name:  "min-samples",
+		Usage: "leave out models with less current orders or repurchase drivers than this",
+	}
+)
+
+var reportFlags = []cli.Flag{formatFlag, outputFlag, minSamplesFlag}
+
+// Report is the ranking result of analysis, top n models of each ranking.
+type Report struct {
+	Cities []string `json:"cities"`
+	// GroupBy is the dimension of Model in entries, e.g. brand
+	GroupBy string `json:"group_by"`
+	// Weighting is order or station, Count of entries is estimated monthly orders if station
+	Weighting    string            `json:"weighting"`
+	CurrentOrder []ModelCountEntry `json:"current_order"`
+	Repurchase   []ModelScoreEntry `json:"repurchase"`
+}
+
+// CityEntry is value and rank of a model in one city, only filled when more than one city is analysed.
+type CityEntry struct {
+	Value float64 `json:"value"`
+	Rank  int     `json:"rank"`
+}
+
+type ModelCountEntry struct {
+	Rank  int    `json:"rank"`
+	Model string `json:"model"`
+	Count int    `json:"count"`
+	// Samples is number of sampled current orders
+	Samples int `json:"samples"`
+	// Share is proportion of all current orders, ShareCI is its 95% Wilson interval
+	// over the sampled orders, or over their Kish effective sample size if weighted by station
+	Share   float64              `json:"share"`
+	ShareCI Interval             `json:"share_ci"`
+	Cities  map[string]CityEntry `json:"cities,omitempty"`
+}
+
+type ModelScoreEntry struct {
+	Rank   int                  `json:"rank"`
+	Model  string               `json:"model"`
+	Score  float64              `json:"score"`
+	Stats  ScoreStats           `json:"stats"`
+	Cities map[string]CityEntry `json:"cities,omitempty"`
+}
+
+// Report builds top n of each ranking, models with less than minSamples
+// current orders or repurchase drivers are left out.
+func (ar *AnalysisResult) Report(topn, minSamples int) *Report {
+	breakdown := len(ar.Cities) > 1
+	countRank, scoreRank := ar.cityRanks()
+	r := &Report{
+		Cities:       ar.Cities,
+		GroupBy:      ar.GroupBy,
+		Weighting:    ar.Weighting,
+		CurrentOrder: []ModelCountEntry{},
+		Repurchase:   []ModelScoreEntry{},
+	}
+
+	total, totalSamples := 0, 0
+	for _, count := range ar.ModelCount {
+		total += count
+	}
+	for _, samples := range ar.ModelSamples {
+		totalSamples += samples
+	}
+	// weighted share varies as much as the share of a sample of effective size
+	n := float64(totalSamples)
+	if ar.Weighting == weightingStation {
+		n = ar.SampleWeights.EffectiveN()
+	}
+	for _, mc := range sortModelCount(ar.ModelCount) {
+		if len(r.CurrentOrder) >= topn {
+			break
+		}
+		samples := ar.ModelSamples[mc.Model]
+		if samples < minSamples {
+			continue
+		}
+		share := float64(mc.Count) / float64(total)
+		entry := ModelCountEntry{
+			Rank:    len(r.CurrentOrder) + 1,
+			Model:   mc.Model,
+			Count:   mc.Count,
+			Samples: samples,
+			Share:   share,
+			ShareCI: wilsonIntervalN(share, n),
+		}
+		if breakdown {
+			entry.Cities = map[string]CityEntry{}
+			for _, city := range ar.Cities {
+				if rank := countRank[city][mc.Model]; rank != 0 {
+					entry.Cities[city] = CityEntry{Value: float64(ar.CityCount[city][mc.Model]), Rank: rank}
+				}
+			}
+		}
+		r.CurrentOrder = append(r.CurrentOrder, entry)
+	}
+
+	for _, ms := range sortModelScore(ar.ModelScore) {
+		if len(r.Repurchase) >= topn {
+			break
+		}
+		scores := ar.ModelScores[ms.Model]
+		if len(scores) < minSamples {
+			continue
+		}
+		entry := ModelScoreEntry{
+			Rank:  len(r.Repurchase) + 1,
+			Model: ms.Model,
+			Score: ms.Score,
+			Stats: NewScoreStats(scores),
+		}
+		if breakdown {
+			entry.Cities = map[string]CityEntry{}
+			for _, city := range ar.Cities {
+				if rank := scoreRank[city][ms.Model]; rank != 0 {
+					entry.Cities[city] = CityEntry{Value: ar.CityScore[city][ms.Model], Rank: rank}
+				}
+			}
+		}
+		r.Repurchase = append(r.Repurchase, entry)
+	}
+	return r
+}
+
+// reportRenderer is a report which can be written in every output format,
+// json output marshals the report itself.
+type reportRenderer interface {
+	// summary is printed before tables, may be empty
+	summary() string
+	tables() []reportTable
+	renderCSV(w io.Writer) error
+}
+
+func writeReport(r reportRenderer, format, output string) error {
+	var w io.Writer = os.Stdout
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	switch format {
+	case formatTable, "":
+		return renderTable(w, r)
+	case formatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	case formatCSV:
+		return r.renderCSV(w)
+	case formatMarkdown:
+		return renderMarkdown(w, r)
+	case formatHTML:
+		return reportHTMLTmpl.Execute(w, map[string]interface{}{
+			"Summary": r.summary(),
+			"Tables":  r.tables(),
+		})
+	default:
+		return fmt.Errorf("unknown output format: %s", format)
+	}
+}
+
+// reportTable is a ranking rendered as text cells, shared by table, markdown and html output.
+type reportTable struct {
+	Title  string
+	Header []string
+	Rows   [][]string
+}
+
+func (r *Report) tables() []reportTable {
+	breakdown := len(r.Cities) > 1
+	cityCells := func(cities map[string]CityEntry) []string {
+		cells := []string{}
+		for _, city := range r.Cities {
+			cells = append(cells, cityCell(cities, city))
+		}
+		return cells
+	}
+
+	label := groupByLabels[r.GroupBy]
+	if label == "" {
+		label = groupByLabels[groupByModel]
+	}
+	weighted := r.Weighting == weightingStation
+	countTable := reportTable{
+		Title:  label + "订单数量排名",
+		Header: []string{"排名", label, "实时订单数", "占比", "95%置信区间"},
+	}
+	if weighted {
+		countTable.Header = []string{"排名", label, "估计月订单数", "样本订单数", "占比", "95%置信区间"}
+	}
+	for _, entry := range r.CurrentOrder {
+		row := []string{fmt.Sprint(entry.Rank), entry.Model, fmt.Sprint(entry.Count)}
+		if weighted {
+			row = append(row, fmt.Sprint(entry.Samples))
+		}
+		row = append(row,
+			formatPercent(entry.Share),
+			fmt.Sprintf("%s - %s", formatPercent(entry.ShareCI.Low), formatPercent(entry.ShareCI.High)),
+		)
+		if breakdown {
+			row = append(row, cityCells(entry.Cities)...)
+		}
+		countTable.Rows = append(countTable.Rows, row)
+	}
+
+	scoreTable := reportTable{
+		Title:  label + "加油积分排名",
+		Header: []string{"排名", label, "加油积分", "司机数", "平均积分", "中位数", "标准差", "95%置信区间"},
+	}
+	for _, entry := range r.Repurchase {
+		row := []string{
+			fmt.Sprint(entry.Rank),
+			entry.Model,
+			formatScore(entry.Score),
+			fmt.Sprint(entry.Stats.Drivers),
+			fmt.Sprintf("%.02f", entry.Stats.Mean),
+			formatScore(entry.Stats.Median),
+			fmt.Sprintf("%.02f", entry.Stats.StdDev),
+			fmt.Sprintf("%.02f - %.02f", entry.Stats.MeanCI.Low, entry.Stats.MeanCI.High),
+		}
+		if breakdown {
+			row = append(row, cityCells(entry.Cities)...)
+		}
+		scoreTable.Rows = append(scoreTable.Rows, row)
+	}
+
+	if breakdown {
+		countTable.Header = append(countTable.Header, r.Cities...)
+		scoreTable.Header = append(scoreTable.Header, r.Cities...)
+	}
+	return []reportTable{countTable, scoreTable}
+}
+
+// cityCell formats value of a model in one city together with its rank in that city.
+func cityCell(cities map[string]CityEntry, city string) string {
+	entry, ok := cities[city]
+	if !ok {
+		return "-"
+	}
+	return fmt.Sprintf("%s (#%d)", formatScore(entry.Value), entry.Rank)
+}
+
+func (r *Report) summary() string {
+	if len(r.Cities) > 1 {
+		return fmt.Sprintf("城市: %s", strings.Join(r.Cities, ", "))
+	}
+	return ""
+}
+
+func renderTable(w io.Writer, r reportRenderer) error {
+	if summary := r.summary(); summary != "" {
+		fmt.Fprintf(w, "\n%s\n", summary)
+	}
+	for _, t := range r.tables() {
+		fmt.Fprintf(w, "\n%s:\n", t.Title)
+		table := tablewriter.NewWriter(w)
+		table.SetHeader(t.Header)
+		table.AppendBulk(t.Rows)
+		table.Render()
+	}
+	return nil
+}
+
+func renderMarkdown(w io.Writer, r reportRenderer) error {
+	escape := func(cells []string) string {
+		escaped := make([]string, len(cells))
+		for i, cell := range cells {
+			escaped[i] = strings.Replace(cell, "|", "\\|", -1)
+		}
+		return "| " + strings.Join(escaped, " | ") + " |"
+	}
+	if summary := r.summary(); summary != "" {
+		fmt.Fprintf(w, "%s\n\n", summary)
+	}
+	for _, t := range r.tables() {
+		fmt.Fprintf(w, "## %s\n\n", t.Title)
+		fmt.Fprintln(w, escape(t.Header))
+		fmt.Fprintln(w, "|"+strings.Repeat(" --- |", len(t.Header)))
+		for _, row := range t.Rows {
+			fmt.Fprintln(w, escape(row))
+		}
+		fmt.Fprintln(w)
+	}
+	return nil
+}
+
+// renderCSV writes both rankings into one sheet, distinguished by the ranking column,
+// values are written raw for spreadsheets.
+func (r *Report) renderCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	header := []string{"ranking", "rank", "model", "count", "samples", "share", "share_ci_low", "share_ci_high",
+		"score", "drivers", "mean", "median", "stddev", "mean_ci_low", "mean_ci_high"}
+	if len(r.Cities) > 1 {
+		for _, city := range r.Cities {
+			header = append(header, city, city+"_rank")
+		}
+	}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	cityColumns := func(cities map[string]CityEntry) []string {
+		cells := []string{}
+		if len(r.Cities) <= 1 {
+			return cells
+		}
+		for _, city := range r.Cities {
+			if entry, ok := cities[city]; ok {
+				cells = append(cells, formatFloat(entry.Value), fmt.Sprint(entry.Rank))
+			} else {
+				cells = append(cells, "", "")
+			}
+		}
+		return cells
+	}
+
+	for _, entry := range r.CurrentOrder {
+		row := []string{kindCurrentOrder, fmt.Sprint(entry.Rank), entry.Model, fmt.Sprint(entry.Count),
+			fmt.Sprint(entry.Samples), formatFloat(entry.Share), formatFloat(entry.ShareCI.Low), formatFloat(entry.ShareCI.High),
+			"", "", "", "", "", "", ""}
+		if err := cw.Write(append(row, cityColumns(entry.Cities)...)); err != nil {
+			return err
+		}
+	}
+	for _, entry := range r.Repurchase {
+		st := entry.Stats
+		row := []string{kindRepurchase, fmt.Sprint(entry.Rank), entry.Model, "", "", "", "", "",
+			formatFloat(entry.Score), fmt.Sprint(st.Drivers), formatFloat(st.Mean), formatFloat(st.Median),
+			formatFloat(st.StdDev), formatFloat(st.MeanCI.Low), formatFloat(st.MeanCI.High)}
+		if err := cw.Write(append(row, cityColumns(entry.Cities)...)); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// formatScore prints integral scores without decimals, averaged ones with two.
+func formatScore(score float64) string {
+	if score == math.Trunc(score) {
+		return fmt.Sprintf("%.0f", score)
+	}
+	return fmt.Sprintf("%.02f", score)
+}
+
+func formatPercent(v float64) string {
+	return fmt.Sprintf("%.02f%%", v*100)
+}
+
+func formatFloat(v float64) string {
+	return fmt.Sprintf("%g", v)
+}
+
+var reportHTMLTmpl = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>滴滴司机车型排名</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; }
+td { text-align: right; }
+td:nth-child(2) { text-align: left; }
+th { background: #f0f0f0; }
+</style>
+</head>
+<body>
+{{if .Summary}}<p>{{.Summary}}</p>{{end}}
+{{range .Tables}}
+<h2>{{.Title}}</h2>
+<table>
+<tr>{{range .Header}}<th>{{.}}</th>{{end}}</tr>
+{{range .Rows}}<tr>{{range .}}<td>{{.}}</td>{{end}}</tr>
+{{end}}</table>
+{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testAnalysisResult() *AnalysisResult {
+	ar := NewAnalysisResult([]string{"成都市", "深圳市"}, groupByModel, weightingOrder)
+	ar.Add("成都市", map[string]int{"比亚迪秦": 4, "丰田卡罗拉": 2, "日产轩逸": 1}, map[string]int{"比亚迪秦": 4, "丰田卡罗拉": 2, "日产轩逸": 1}, SampleWeights{}, map[string][]float64{"比亚迪秦": {4, 6}, "宝马|X1": {3}})
+	ar.Add("深圳市", map[string]int{"比亚迪秦": 1}, map[string]int{"比亚迪秦": 1}, SampleWeights{}, map[string][]float64{"比亚迪秦": {5}})
+	return ar
+}
+
+func TestReport(t *testing.T) {
+	r := testAnalysisResult().Report(2, 0)
+	if len(r.CurrentOrder) != 2 || len(r.Repurchase) != 2 {
+		t.Fatalf("report is not limited to top 2: %+v", r)
+	}
+	if e := r.CurrentOrder[0]; e.Rank != 1 || e.Model != "比亚迪秦" || e.Count != 5 || e.Share != 5.0/8 ||
+		e.Cities["成都市"] != (CityEntry{Value: 4, Rank: 1}) || e.Cities["深圳市"] != (CityEntry{Value: 1, Rank: 1}) {
+		t.Errorf("current order #1 = %+v", e)
+	}
+	if e := r.CurrentOrder[0]; e.ShareCI != wilsonInterval(5, 8) {
+		t.Errorf("current order #1 share CI = %+v, want %+v", e.ShareCI, wilsonInterval(5, 8))
+	}
+	if e := r.CurrentOrder[1]; e.Model != "丰田卡罗拉" || len(e.Cities) != 1 {
+		t.Errorf("current order #2 = %+v", e)
+	}
+	if e := r.Repurchase[0]; e.Model != "比亚迪秦" || e.Score != 15 || e.Stats != NewScoreStats([]float64{4, 5, 6}) ||
+		e.Cities["成都市"] != (CityEntry{Value: 10, Rank: 1}) {
+		t.Errorf("repurchase #1 = %+v", e)
+	}
+	if e := r.Repurchase[1]; e.Model != "宝马|X1" || e.Stats.Drivers != 1 {
+		t.Errorf("repurchase #2 = %+v", e)
+	}
+
+	// models with less than 2 orders or drivers are left out and ranks stay continuous
+	r = testAnalysisResult().Report(10, 2)
+	if len(r.CurrentOrder) != 2 || r.CurrentOrder[1].Model != "丰田卡罗拉" || r.CurrentOrder[1].Rank != 2 {
+		t.Errorf("current order with min samples = %+v", r.CurrentOrder)
+	}
+	if len(r.Repurchase) != 1 || r.Repurchase[0].Model != "比亚迪秦" {
+		t.Errorf("repurchase with min samples = %+v", r.Repurchase)
+	}
+
+	single := NewAnalysisResult([]string{"成都市"}, groupByModel, weightingOrder)
+	single.Add("成都市", map[string]int{"比亚迪秦": 4}, map[string]int{"比亚迪秦": 4}, SampleWeights{}, map[string][]float64{"比亚迪秦": {10}})
+	if r := single.Report(10, 0); r.CurrentOrder[0].Cities != nil || r.Repurchase[0].Cities != nil {
+		t.Errorf("single city report has city breakdown: %+v", r)
+	}
+}
+
+func TestWriteReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "didi-car-rank")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	r := testAnalysisResult().Report(10, 0)
+
+	render := func(format string) string {
+		fn := filepath.Join(dir, "report."+format)
+		if err := writeReport(r, format, fn); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		data, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	decoded := Report{}
+	if err := json.Unmarshal([]byte(render(formatJSON)), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.CurrentOrder) != 3 || decoded.CurrentOrder[0].Model != "比亚迪秦" || decoded.Repurchase[0].Stats != r.Repurchase[0].Stats {
+		t.Errorf("json report = %+v", decoded)
+	}
+
+	records, err := csv.NewReader(strings.NewReader(render(formatCSV))).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantHeader := "ranking,rank,model,count,samples,share,share_ci_low,share_ci_high,score,drivers,mean,median,stddev," +
+		"mean_ci_low,mean_ci_high,成都市,成都市_rank,深圳市,深圳市_rank"
+	if len(records) != 1+3+2 || strings.Join(records[0], ",") != wantHeader {
+		t.Fatalf("csv records = %v", records)
+	}
+	if got := strings.Join(append(records[4][:13:13], records[4][15:]...), ","); got != "repurchase,1,比亚迪秦,,,,,,15,3,5,5,1,10,1,5,1" {
+		t.Errorf("csv repurchase #1 = %s", got)
+	}
+
+	md := render(formatMarkdown)
+	for _, want := range []string{"## 车型订单数量排名", "| --- | --- |", "宝马\\|X1", "| 1 | 比亚迪秦 | 5 | 62.50% |", "| 4 (#1) | 1 (#1) |"} {
+		if !strings.Contains(md, want) {
+			t.Errorf("markdown does not contain %q:\n%s", want, md)
+		}
+	}
+
+	html := render(formatHTML)
+	if !strings.Contains(html, "<td>比亚迪秦</td>") || !strings.Contains(html, "<th>深圳市</th>") {
+		t.Errorf("html report:\n%s", html)
+	}
+
+	table := render(formatTable)
+	if !strings.Contains(table, "城市: 成都市, 深圳市") || !strings.Contains(table, "车型加油积分排名") {
+		t.Errorf("table report:\n%s", table)
+	}
+
+	if err := writeReport(r, "xml", ""); err == nil {
+		t.Errorf("unknown format is accepted")
+	}
+	buf := &bytes.Buffer{}
+	if err := renderMarkdown(buf, r); err != nil || buf.String() != md {
+		t.Errorf("renderMarkdown differs from markdown output: %v", err)
+	}
+}
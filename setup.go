@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	log "github.com/liudanking/goutil/logutil"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// setupHost is the magic hostname answered by the proxy itself
+const setupHost = "didi-car-rank.local"
+
+// SetupServer serves CA download and phone setup instructions.
+type SetupServer struct {
+	caCert    *x509.Certificate
+	caCertPEM []byte
+	proxyAddr string
+
+	mtx     sync.Mutex
+	devices map[string]time.Time // client ip -> last intercepted didi request
+}
+
+func NewSetupServer(caCertPEM []byte, listenAddr string) (*SetupServer, error) {
+	block, _ := pem.Decode(caCertPEM)
+	if block == nil {
+		return nil, errors.New("invalid CA certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return &SetupServer{
+		caCert:    cert,
+		caCertPEM: caCertPEM,
+		proxyAddr: advertiseAddr(listenAddr),
+		devices:   map[string]time.Time{},
+	}, nil
+}
+
+// advertiseAddr guesses the LAN address phones should use to reach listenAddr.
+func advertiseAddr(listenAddr string) string {
+	host, port, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return listenAddr
+	}
+	if ip := net.ParseIP(host); host != "" && (ip == nil || !ip.IsUnspecified()) {
+		return listenAddr
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Warning("get interface addrs failed:%v", err)
+		return listenAddr
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() || ipnet.IP.To4() == nil {
+			continue
+		}
+		return net.JoinHostPort(ipnet.IP.String(), port)
+	}
+	return listenAddr
+}
+
+func (ss *SetupServer) SetupURL() string {
+	return fmt.Sprintf("http://%s/", ss.proxyAddr)
+}
+
+// RegisterHook serves setupHost and marks devices whose requests to didiHost are intercepted.
+func (ss *SetupServer) RegisterHook(p *goproxy.ProxyHttpServer, didiHost string) {
+	isSetupHost := goproxy.ReqConditionFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		return hostWithoutPort(req.URL.Host) == setupHost || hostWithoutPort(req.Host) == setupHost
+	})
+	p.OnRequest(goproxy.DstHostIs(setupHost + ":443")).HandleConnect(goproxy.AlwaysMitm)
+	p.OnRequest(isSetupHost).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		rec := httptest.NewRecorder()
+		ss.serve(rec, req, true)
+		resp := rec.Result()
+		resp.Request = req
+		return req, resp
+	})
+	p.OnResponse(goproxy.DstHostIs(didiHost)).DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		ss.markIntercepted(ctx.Req.RemoteAddr)
+		return resp
+	})
+	p.NonproxyHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ss.serve(w, req, false)
+	})
+}
+
+func hostWithoutPort(hostport string) string {
+	if host, _, err := net.SplitHostPort(hostport); err == nil {
+		return host
+	}
+	return hostport
+}
+
+func (ss *SetupServer) markIntercepted(remoteAddr string) {
+	ss.mtx.Lock()
+	ss.devices[hostWithoutPort(remoteAddr)] = time.Now()
+	ss.mtx.Unlock()
+}
+
+func (ss *SetupServer) lastIntercepted(remoteAddr string) (time.Time, bool) {
+	ss.mtx.Lock()
+	defer ss.mtx.Unlock()
+	t, ok := ss.devices[hostWithoutPort(remoteAddr)]
+	return t, ok
+}
+
+// serve handles setup requests, proxied tells whether req came through the proxy.
+func (ss *SetupServer) serve(w http.ResponseWriter, req *http.Request, proxied bool) {
+	switch req.URL.Path {
+	case "/":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := setupPageTmpl.Execute(w, map[string]interface{}{
+			"CAName":    ss.caCert.Subject.CommonName,
+			"ProxyAddr": ss.proxyAddr,
+			"SetupURL":  ss.SetupURL(),
+			"CheckURL":  fmt.Sprintf("https://%s/mitm-check", setupHost),
+		}); err != nil {
+			log.Warning("render setup page failed:%v", err)
+		}
+	case "/" + caCertPEMFile:
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		w.Header().Set("Content-Disposition", "attachment; filename="+caCertPEMFile)
+		w.Write(ss.caCertPEM)
+	case "/" + caCertDERFile:
+		w.Header().Set("Content-Type", "application/x-x509-ca-cert")
+		w.Write(ss.caCert.Raw)
+	case "/" + caMobileconfigFile:
+		data, err := caMobileconfig(ss.caCert)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-apple-aspen-config")
+		w.Write(data)
+	case "/qr.png":
+		png, err := qrcode.Encode(ss.SetupURL(), qrcode.Medium, 256)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(png)
+	case "/mitm-check":
+		// only reachable over https when the phone trusts our CA
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		writeJSON(w, map[string]interface{}{
+			"ok":     req.URL.Scheme == "https",
+			"client": hostWithoutPort(req.RemoteAddr),
+		})
+	case "/status":
+		status := map[string]interface{}{
+			"client":  hostWithoutPort(req.RemoteAddr),
+			"proxied": proxied,
+		}
+		if t, ok := ss.lastIntercepted(req.RemoteAddr); ok {
+			status["last_intercepted"] = t.Format("2006-01-02 15:04:05")
+		}
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		writeJSON(w, status)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warning("write json failed:%v", err)
+	}
+}
+
+var setupPageTmpl = template.Must(template.New("setup").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Didi Car Rank 手机设置</title>
+<style>
+body { font-family: -apple-system, sans-serif; max-width: 640px; margin: 0 auto; padding: 16px; }
+li { margin: 8px 0; }
+.ok { color: #2a8a2a; }
+.bad { color: #c0392b; }
+code { background: #f2f2f2; padding: 2px 4px; }
+</style>
+</head>
+<body>
+<h2>Didi Car Rank 手机设置</h2>
+<p><img src="/qr.png" width="200" height="200" alt="{{.SetupURL}}"><br>手机扫码打开本页面: <code>{{.SetupURL}}</code></p>
+<ol>
+<li>下载并安装根证书 <b>{{.CAName}}</b>:
+  <a href="/ca.mobileconfig">iOS 描述文件</a> |
+  <a href="/ca.crt">DER (Android)</a> |
+  <a href="/ca.pem">PEM</a></li>
+<li>iOS 需要在 <code>设置->通用->关于本机->证书信任设置</code> 中启用完全信任</li>
+<li>设置手机 HTTP 代理: 服务器 <code>{{.ProxyAddr}}</code></li>
+<li>打开 <code>滴滴车主 APP</code> 的 <code>滴滴加油</code> 页面, 随便移动一下地图</li>
+</ol>
+<h3>状态</h3>
+<ul>
+<li>代理: <span id="proxied">检测中...</span></li>
+<li>HTTPS 解密: <span id="mitm">检测中...</span></li>
+<li>滴滴加油数据: <span id="didi">检测中...</span></li>
+</ul>
+<script>
+function mark(id, ok, text) {
+  var el = document.getElementById(id);
+  el.className = ok ? "ok" : "bad";
+  el.textContent = text;
+}
+function refresh() {
+  fetch("/status").then(function(r) { return r.json(); }).then(function(s) {
+    mark("proxied", s.proxied, s.proxied ? "已通过代理访问 (" + s.client + ")" : "未设置代理, 当前为直接访问");
+    mark("didi", !!s.last_intercepted, s.last_intercepted ? "最近一次采集于 " + s.last_intercepted : "尚未采集到数据");
+  });
+  fetch("{{.CheckURL}}").then(function(r) { return r.json(); }).then(function(s) {
+    mark("mitm", s.ok, s.ok ? "证书已信任" : "证书未生效");
+  }).catch(function() {
+    mark("mitm", false, "证书未安装或未信任");
+  });
+}
+refresh();
+setInterval(refresh, 3000);
+</script>
+</body>
+</html>
+`))
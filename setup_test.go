@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSetupServe(t *testing.T) {
+	certPEM, _, err := generateCA("ecdsa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, err := NewSetupServer(certPEM, "192.168.1.2:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ss.SetupURL() != "http://192.168.1.2:8080/" {
+		t.Errorf("SetupURL() = %s", ss.SetupURL())
+	}
+
+	tests := []struct {
+		path        string
+		status      int
+		contentType string
+	}{
+		{"/", http.StatusOK, "text/html; charset=utf-8"},
+		{"/" + caCertPEMFile, http.StatusOK, "application/x-pem-file"},
+		{"/" + caCertDERFile, http.StatusOK, "application/x-x509-ca-cert"},
+		{"/" + caMobileconfigFile, http.StatusOK, "application/x-apple-aspen-config"},
+		{"/qr.png", http.StatusOK, "image/png"},
+		{"/status", http.StatusOK, "application/json; charset=utf-8"},
+		{"/charles.p12", http.StatusNotFound, "text/plain; charset=utf-8"},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		ss.serve(rec, httptest.NewRequest("GET", tt.path, nil), false)
+		if rec.Code != tt.status || rec.Header().Get("Content-Type") != tt.contentType {
+			t.Errorf("%s: status = %d, content type = %s, want %d, %s", tt.path, rec.Code,
+				rec.Header().Get("Content-Type"), tt.status, tt.contentType)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	ss.serve(rec, httptest.NewRequest("GET", "/"+caCertPEMFile, nil), false)
+	if !bytes.Equal(rec.Body.Bytes(), certPEM) {
+		t.Errorf("served CA differs from loaded CA")
+	}
+}
+
+func TestSetupStatus(t *testing.T) {
+	certPEM, _, err := generateCA("ecdsa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, err := NewSetupServer(certPEM, "192.168.1.2:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status := func(proxied bool) map[string]interface{} {
+		req := httptest.NewRequest("GET", "/status", nil)
+		req.RemoteAddr = "192.168.1.9:50000"
+		rec := httptest.NewRecorder()
+		ss.serve(rec, req, proxied)
+		s := map[string]interface{}{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &s); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	s := status(false)
+	if s["client"] != "192.168.1.9" || s["proxied"] != false || s["last_intercepted"] != nil {
+		t.Errorf("status before interception = %v", s)
+	}
+	// another connection of the same phone
+	ss.markIntercepted("192.168.1.9:50001")
+	s = status(true)
+	if s["proxied"] != true || s["last_intercepted"] == nil {
+		t.Errorf("status after interception = %v", s)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// RepurchaseSnapshot is a RepurchaseItem fetched at CapturedAt,
+// CapturedAt is zero for data collected before snapshots were kept.
+type RepurchaseSnapshot struct {
+	RepurchaseItem
+	CapturedAt time.Time    `json:"captured_at"`
+	Capture    *CaptureMeta `json:"capture,omitempty"`
+}
+
+// snapshot selection modes
+const (
+	SnapshotLatest = "latest"
+	SnapshotAsOf   = "asof"
+	SnapshotAvg    = "avg"
+)
+
+// SnapshotSelector picks the OrderCount1M of a driver from its snapshots.
+type SnapshotSelector struct {
+	Mode string
+	// At is the exclusive upper bound of capture time for SnapshotAsOf
+	At time.Time
+	// From and To bound capture time for SnapshotAvg, To is exclusive, zero means unbounded
+	From time.Time
+	To   time.Time
+}
+
+var snapshotFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "snapshot",
+		Usage: "repurchase snapshot: latest, asof (snapshot as of --at) or avg (average over --from/--to)",
+		Value: SnapshotLatest,
+	},
+	cli.StringFlag{
+		Name:  "at",
+		Usage: "date for asof snapshot, e.g. 2018-06-30",
+	},
+	cli.StringFlag{
+		Name:  "from",
+		Usage: "first date of avg snapshot range, e.g. 2018-06-01",
+	},
+	cli.StringFlag{
+		Name:  "to",
+		Usage: "last date of avg snapshot range, e.g. 2018-06-30",
+	},
+}
+
+func snapshotSelectorFromContext(c *cli.Context) (SnapshotSelector, error) {
+	sel := SnapshotSelector{Mode: c.String("snapshot")}
+	switch sel.Mode {
+	case SnapshotLatest:
+	case SnapshotAsOf:
+		at, err := parseDate(c.String("at"))
+		if err != nil {
+			return sel, err
+		}
+		if at.IsZero() {
+			return sel, fmt.Errorf("--at is required for %s snapshot", SnapshotAsOf)
+		}
+		sel.At = endOfDate(at)
+	case SnapshotAvg:
+		from, err := parseDate(c.String("from"))
+		if err != nil {
+			return sel, err
+		}
+		to, err := parseDate(c.String("to"))
+		if err != nil {
+			return sel, err
+		}
+		sel.From, sel.To = from, endOfDate(to)
+	default:
+		return sel, fmt.Errorf("unknown snapshot mode: %s", sel.Mode)
+	}
+	return sel, nil
+}
+
+// Select returns the car model and score of a driver from all its snapshots,
+// ok is false if no snapshot matches.
+func (sel SnapshotSelector) Select(snaps []RepurchaseSnapshot) (model string, score float64, ok bool) {
+	switch sel.Mode {
+	case SnapshotAvg:
+		var latest time.Time
+		sum, n := 0, 0
+		for _, snap := range snaps {
+			if (!sel.From.IsZero() && snap.CapturedAt.Before(sel.From)) ||
+				(!sel.To.IsZero() && !snap.CapturedAt.Before(sel.To)) {
+				continue
+			}
+			if n == 0 || !snap.CapturedAt.Before(latest) {
+				latest, model = snap.CapturedAt, snap.CarModel
+			}
+			sum += snap.OrderCount1M
+			n++
+		}
+		if n == 0 {
+			return "", 0, false
+		}
+		return model, float64(sum) / float64(n), true
+	default:
+		var picked *RepurchaseSnapshot
+		for i, snap := range snaps {
+			if sel.Mode == SnapshotAsOf && !snap.CapturedAt.Before(sel.At) {
+				continue
+			}
+			if picked == nil || !snap.CapturedAt.Before(picked.CapturedAt) {
+				picked = &snaps[i]
+			}
+		}
+		if picked == nil {
+			return "", 0, false
+		}
+		return picked.CarModel, float64(picked.OrderCount1M), true
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSnapshotSelectorSelect(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2018, 6, d, 12, 0, 0, 0, time.Local) }
+	snap := func(d int, model string, count int) RepurchaseSnapshot {
+		s := RepurchaseSnapshot{CapturedAt: day(d)}
+		s.CarModel, s.OrderCount1M = model, count
+		return s
+	}
+	// out of order as returned by storage
+	snaps := []RepurchaseSnapshot{snap(10, "秦", 20), snap(1, "秦", 10), snap(20, "秦Pro", 30)}
+
+	tests := []struct {
+		name  string
+		sel   SnapshotSelector
+		model string
+		score float64
+		ok    bool
+	}{
+		{"latest", SnapshotSelector{Mode: SnapshotLatest}, "秦Pro", 30, true},
+		{"asof", SnapshotSelector{Mode: SnapshotAsOf, At: day(15)}, "秦", 20, true},
+		{"asof exclusive", SnapshotSelector{Mode: SnapshotAsOf, At: day(10)}, "秦", 10, true},
+		{"asof before all", SnapshotSelector{Mode: SnapshotAsOf, At: day(1)}, "", 0, false},
+		{"avg unbounded", SnapshotSelector{Mode: SnapshotAvg}, "秦Pro", 20, true},
+		{"avg from", SnapshotSelector{Mode: SnapshotAvg, From: day(5)}, "秦Pro", 25, true},
+		{"avg to exclusive", SnapshotSelector{Mode: SnapshotAvg, To: day(20)}, "秦", 15, true},
+		{"avg range", SnapshotSelector{Mode: SnapshotAvg, From: day(5), To: day(15)}, "秦", 20, true},
+		{"avg empty range", SnapshotSelector{Mode: SnapshotAvg, From: day(11), To: day(15)}, "", 0, false},
+	}
+	for _, tt := range tests {
+		model, score, ok := tt.sel.Select(snaps)
+		if model != tt.model || score != tt.score || ok != tt.ok {
+			t.Errorf("%s: Select() = %s, %g, %v, want %s, %g, %v", tt.name, model, score, ok, tt.model, tt.score, tt.ok)
+		}
+	}
+	if _, _, ok := (SnapshotSelector{Mode: SnapshotLatest}).Select(nil); ok {
+		t.Errorf("Select(nil) is ok")
+	}
+}
+
+func TestRepurchaseScoreByModel(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2018, 6, d, 12, 0, 0, 0, time.Local) }
+	tests := []struct {
+		name   string
+		sel    SnapshotSelector
+		scores map[string][]float64
+	}{
+		{"latest", SnapshotSelector{Mode: SnapshotLatest}, map[string][]float64{"比亚迪秦": {30}, "丰田卡罗拉": {4}}},
+		{"asof", SnapshotSelector{Mode: SnapshotAsOf, At: day(15)}, map[string][]float64{"比亚迪秦": {20}, "丰田卡罗拉": {4}}},
+		{"asof before all", SnapshotSelector{Mode: SnapshotAsOf, At: day(1)}, map[string][]float64{}},
+		{"avg", SnapshotSelector{Mode: SnapshotAvg}, map[string][]float64{"比亚迪秦": {20}, "丰田卡罗拉": {4}}},
+		{"avg range", SnapshotSelector{Mode: SnapshotAvg, From: day(5), To: day(25)}, map[string][]float64{"比亚迪秦": {25}, "丰田卡罗拉": {4}}},
+	}
+	forEachBackend(t, func(backend string, store DataStore) {
+		for _, d := range []struct {
+			day   int
+			items []RepurchaseItem
+		}{
+			{1, []RepurchaseItem{{DriverID: "d1", CarModel: "比亚迪秦", OrderCount1M: 10}}},
+			{10, []RepurchaseItem{{DriverID: "d1", CarModel: "比亚迪秦", OrderCount1M: 20}, {DriverID: "d2", CarModel: "丰田卡罗拉", OrderCount1M: 4}}},
+			{20, []RepurchaseItem{{DriverID: "d1", CarModel: "比亚迪秦", OrderCount1M: 30}}},
+		} {
+			if err := store.SaveRepurchaseSnapshot("成都市", "s1", CaptureMeta{CapturedAt: day(d.day)}, d.items); err != nil {
+				t.Fatalf("%s: %v", backend, err)
+			}
+		}
+		for _, tt := range tests {
+			ca := NewCityAnalyzer(store, "成都市", AnalysisOptions{Snapshot: tt.sel})
+			if got := sortedScores(ca.analysisRepurchase()); !reflect.DeepEqual(got, tt.scores) {
+				t.Errorf("%s %s: scores = %v, want %v", backend, tt.name, got, tt.scores)
+			}
+		}
+	})
+}
+
+func TestRepurchaseAvgModel(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2018, 6, d, 12, 0, 0, 0, time.Local) }
+	tests := []struct {
+		name   string
+		sel    SnapshotSelector
+		scores map[string][]float64
+	}{
+		// car model of the latest snapshot averaged, not the greatest name
+		{"avg", SnapshotSelector{Mode: SnapshotAvg}, map[string][]float64{"比亚迪秦": {20}}},
+		{"avg to", SnapshotSelector{Mode: SnapshotAvg, To: day(20)}, map[string][]float64{"秦Pro": {15}}},
+	}
+	forEachBackend(t, func(backend string, store DataStore) {
+		for _, d := range []struct {
+			day   int
+			model string
+			count int
+		}{{1, "秦Pro", 10}, {10, "秦Pro", 20}, {20, "比亚迪秦", 30}} {
+			if err := store.SaveRepurchaseSnapshot("成都市", "s1", CaptureMeta{CapturedAt: day(d.day)},
+				[]RepurchaseItem{{DriverID: "d1", CarModel: d.model, OrderCount1M: d.count}}); err != nil {
+				t.Fatalf("%s: %v", backend, err)
+			}
+		}
+		for _, tt := range tests {
+			ca := NewCityAnalyzer(store, "成都市", AnalysisOptions{Snapshot: tt.sel})
+			if got := sortedScores(ca.analysisRepurchase()); !reflect.DeepEqual(got, tt.scores) {
+				t.Errorf("%s %s: scores = %v, want %v", backend, tt.name, got, tt.scores)
+			}
+		}
+	})
+}
+
+func TestRepurchaseSnapshotSameSecond(t *testing.T) {
+	capturedAt := time.Date(2018, 6, 10, 12, 0, 0, 100, time.Local)
+	forEachBackend(t, func(backend string, store DataStore) {
+		// pages of one store fetched in the same second
+		for i, driverID := range []string{"d1", "d2"} {
+			if err := store.SaveRepurchaseSnapshot("成都市", "s1", CaptureMeta{CapturedAt: capturedAt.Add(time.Duration(i) * 100 * time.Millisecond)},
+				[]RepurchaseItem{{DriverID: driverID, CarModel: "比亚迪秦", OrderCount1M: i + 1}}); err != nil {
+				t.Fatalf("%s: %v", backend, err)
+			}
+		}
+		drivers := map[string]bool{}
+		if err := store.ForEachRepurchaseSnapshot("成都市", func(storeID string, snap RepurchaseSnapshot) error {
+			drivers[snap.DriverID] = true
+			return nil
+		}); err != nil {
+			t.Fatalf("%s: %v", backend, err)
+		}
+		if len(drivers) != 2 {
+			t.Errorf("%s: drivers = %v", backend, drivers)
+		}
+	})
+}
+
+func TestSnapshotFileTime(t *testing.T) {
+	at := time.Date(2018, 6, 10, 12, 0, 0, 123456789, time.Local)
+	tests := []struct {
+		name string
+		at   time.Time
+		ok   bool
+	}{
+		{fmt.Sprintf("%d.json", at.UnixNano()), at, true},
+		// written before in seconds
+		{fmt.Sprintf("%d.json", at.Unix()), at.Truncate(time.Second), true},
+		{"s1.json", time.Time{}, false},
+		{fmt.Sprintf("%d.tmp", at.Unix()), time.Time{}, false},
+	}
+	for _, tt := range tests {
+		if got, ok := snapshotFileTime(tt.name); !got.Equal(tt.at) || ok != tt.ok {
+			t.Errorf("snapshotFileTime(%s) = %v, %v, want %v, %v", tt.name, got, ok, tt.at, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// StoreListItem is a station in the station list of gasstation and near store pages,
+// it is much richer than Store of the map.
+type StoreListItem struct {
+	StoreID            string        `json:"store_id"`
+	Name               string        `json:"name"`
+	Logo               string        `json:"logo"`
+	LogoX              string        `json:"logo_x"`
+	LogoXx             string        `json:"logo_xx"`
+	Lat                float64       `json:"lat"`
+	Lng                float64       `json:"lng"`
+	Price              string        `json:"price"`
+	Discount           string        `json:"discount"`
+	Distance           string        `json:"distance"`
+	Address            string        `json:"address"`
+	MonthOrderCount    string        `json:"month_order_count"`
+	RepurchaseUserRate int           `json:"repurchase_user_rate"`
+	Rank               int           `json:"rank"`
+	RankText           string        `json:"rank_text"`
+	IsNew              int           `json:"is_new"`
+	Rawid              string        `json:"rawid"`
+	ActivityNum        int           `json:"activity_num"`
+	ActivityList       []interface{} `json:"activity_list"`
+	CouponInfo         interface{}   `json:"coupon_info"`
+	PromotionContent   string        `json:"promotion_content"`
+	FreshUser          int           `json:"fresh_user"`
+	TotalScore         string        `json:"total_score"`
+	DidiGuideDiscount  string        `json:"didi_guide_discount"`
+	RankDidiDiscount   string        `json:"rank_didi_discount"`
+	RankGuideDiscount  string        `json:"rank_guide_discount"`
+	RankStoreDiscount  string        `json:"rank_store_discount"`
+	RankPrice          string        `json:"rank_price"`
+}
+
+// MonthOrders parses MonthOrderCount, e.g. "1234", "月加油1234次" or "1.2万",
+// ok is false if it has no number.
+func (item StoreListItem) MonthOrders() (int, bool) {
+	v, ok := parseAmount(item.MonthOrderCount)
+	if !ok {
+		return 0, false
+	}
+	if strings.Contains(item.MonthOrderCount, "万") {
+		v *= 10000
+	}
+	return int(v + 0.5), true
+}
+
+// StationDetail is the latest StoreList entry of a station.
+type StationDetail struct {
+	StoreListItem
+	CapturedAt time.Time `json:"captured_at"`
+	// Source is the hook the entry is captured from
+	Source string `json:"source"`
+}
+
+// stationDetails loads station details of city keyed by store id.
+func stationDetails(store DataStore, city string) (map[string]StationDetail, error) {
+	details := map[string]StationDetail{}
+	err := store.ForEachStationDetail(city, func(d StationDetail) error {
+		details[d.StoreID] = d
+		return nil
+	})
+	return details, err
+}
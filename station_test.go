@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMonthOrders(t *testing.T) {
+	tests := []struct {
+		s  string
+		n  int
+		ok bool
+	}{
+		{"1234", 1234, true},
+		{"月加油1234次", 1234, true},
+		{"1.2万", 12000, true},
+		{"月加油1.25万次", 12500, true},
+		{"0", 0, true},
+		{"", 0, false},
+		{"暂无", 0, false},
+	}
+	for _, tt := range tests {
+		n, ok := StoreListItem{MonthOrderCount: tt.s}.MonthOrders()
+		if n != tt.n || ok != tt.ok {
+			t.Errorf("MonthOrders(%q) = %d, %v, want %d, %v", tt.s, n, ok, tt.n, tt.ok)
+		}
+	}
+}
+
+func TestDecodeNearStoreRsp(t *testing.T) {
+	data := `{"status":0,"msg":"ok","data":{"store_for_map":[{"store_id":"s1","price":"6.80"},{"store_id":"s2","price":"6.90"},{"store_id":"s3"}],
+		"store_list":[{"store_id":"s1","name":"中石化","price":"6.50","discount":"0.30","month_order_count":"1.2万",
+		"activity_list":[{"title":"满减"}],"coupon_info":{"amount":5}},{"store_id":"s2","name":"中石油","price":""}],
+		"selected_fuel_category":"92","fuel_category_name":"92#"}}`
+	rsp := NearStoreRsp{}
+	if err := json.Unmarshal([]byte(data), &rsp); err != nil {
+		t.Fatal(err)
+	}
+	if len(rsp.Data.StoreList) != 2 || rsp.Data.StoreList[0].Name != "中石化" || len(rsp.Data.StoreList[0].ActivityList) != 1 {
+		t.Fatalf("store list = %+v", rsp.Data.StoreList)
+	}
+	if n, ok := rsp.Data.StoreList[0].MonthOrders(); !ok || n != 12000 {
+		t.Errorf("MonthOrders() = %d, %v", n, ok)
+	}
+
+	// listed price wins, listed stores without price and map stores without price are left out
+	obs := listPriceObservations(rsp.Data.StoreList, rsp.Data.StoreForMap, rsp.Data.SelectedFuelCategory,
+		rsp.Data.FuelCategoryName, captureSourceNearStore, time.Now())
+	if len(obs) != 1 || obs[0].StoreID != "s1" || obs[0].Price != "6.50" || obs[0].Discount != "0.30" ||
+		obs[0].FuelCategory != "92" || obs[0].FuelCategoryName != "92#" || obs[0].Source != captureSourceNearStore {
+		t.Errorf("price observations = %+v", obs)
+	}
+}
+
+func TestStationDetails(t *testing.T) {
+	capturedAt := time.Date(2018, 6, 10, 12, 0, 0, 0, time.Local)
+	forEachBackend(t, func(backend string, store DataStore) {
+		s1 := StationDetail{
+			StoreListItem: StoreListItem{
+				StoreID: "s1", Name: "中石化", Lat: 30.6, Lng: 104.1, Price: "6.50", MonthOrderCount: "1.2万",
+				RepurchaseUserRate: 35, ActivityList: []interface{}{"满减"}, CouponInfo: map[string]interface{}{"amount": 5.0},
+			},
+			CapturedAt: capturedAt,
+			Source:     captureSourceGasstation,
+		}
+		s2 := StationDetail{StoreListItem: StoreListItem{StoreID: "s2", Name: "中石油"}, CapturedAt: capturedAt, Source: captureSourceGasstation}
+		if err := store.UpsertStationDetails("成都市", []StationDetail{s1, s2}); err != nil {
+			t.Fatalf("%s: %v", backend, err)
+		}
+		// the latest entry overwrites
+		s2.Name, s2.Source, s2.CapturedAt = "中石油(天府店)", captureSourceNearStore, capturedAt.Add(time.Hour)
+		if err := store.UpsertStationDetails("成都市", []StationDetail{s2}); err != nil {
+			t.Fatalf("%s: %v", backend, err)
+		}
+
+		details, err := stationDetails(store, "成都市")
+		if err != nil {
+			t.Fatalf("%s: %v", backend, err)
+		}
+		if len(details) != 2 {
+			t.Fatalf("%s: details = %+v", backend, details)
+		}
+		for _, want := range []StationDetail{s1, s2} {
+			got := details[want.StoreID]
+			if !got.CapturedAt.Equal(want.CapturedAt) {
+				t.Errorf("%s: %s captured at %v, want %v", backend, want.StoreID, got.CapturedAt, want.CapturedAt)
+			}
+			got.CapturedAt = want.CapturedAt
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: detail = %+v, want %+v", backend, got, want)
+			}
+		}
+		if details, err := stationDetails(store, "深圳市"); err != nil || len(details) != 0 {
+			t.Errorf("%s: details of another city = %+v, %v", backend, details, err)
+		}
+	})
+}
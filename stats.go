@@ -0,0 +1,142 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+)
+
+const (
+	// z value of 95% confidence level
+	confidenceZ = 1.96
+	// resamples of bootstrap confidence interval
+	bootstrapResamples = 2000
+)
+
+// Interval is a confidence interval [Low, High].
+type Interval struct {
+	Low  float64 `json:"low"`
+	High float64 `json:"high"`
+}
+
+// ScoreStats describes distribution of per driver scores of a car model.
+type ScoreStats struct {
+	Drivers int     `json:"drivers"`
+	Mean    float64 `json:"mean"`
+	Median  float64 `json:"median"`
+	StdDev  float64 `json:"stddev"`
+	// MeanCI is 95% bootstrap confidence interval of Mean
+	MeanCI Interval `json:"mean_ci"`
+}
+
+func NewScoreStats(scores []float64) ScoreStats {
+	stats := ScoreStats{Drivers: len(scores)}
+	if len(scores) == 0 {
+		return stats
+	}
+	// sorted so that bootstrap does not depend on order returned by storage
+	sorted := append([]float64{}, scores...)
+	sort.Float64s(sorted)
+	stats.Mean = mean(sorted)
+	stats.Median = median(sorted)
+	stats.StdDev = stddev(sorted, stats.Mean)
+	stats.MeanCI = bootstrapMeanCI(sorted, bootstrapResamples)
+	return stats
+}
+
+func mean(values []float64) float64 {
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
+// median returns median of sorted values.
+func median(sorted []float64) float64 {
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// stddev returns sample standard deviation, 0 if there are less than 2 values.
+func stddev(values []float64, mean float64) float64 {
+	if len(values) < 2 {
+		return 0
+	}
+	sum := 0.0
+	for _, v := range values {
+		sum += (v - mean) * (v - mean)
+	}
+	return math.Sqrt(sum / float64(len(values)-1))
+}
+
+// bootstrapMeanCI returns 95% percentile bootstrap interval of mean of values,
+// a fixed seed is used so that reports are reproducible.
+func bootstrapMeanCI(values []float64, resamples int) Interval {
+	if len(values) < 2 {
+		m := mean(values)
+		return Interval{m, m}
+	}
+	rnd := rand.New(rand.NewSource(1))
+	means := make([]float64, resamples)
+	for i := range means {
+		sum := 0.0
+		for range values {
+			sum += values[rnd.Intn(len(values))]
+		}
+		means[i] = sum / float64(len(values))
+	}
+	sort.Float64s(means)
+	low := int(math.Floor(0.025 * float64(resamples)))
+	high := int(math.Ceil(0.975*float64(resamples))) - 1
+	return Interval{means[low], means[high]}
+}
+
+// wilsonInterval returns 95% Wilson score interval of proportion k/n.
+func wilsonInterval(k, n int) Interval {
+	if n == 0 {
+		return Interval{}
+	}
+	return wilsonIntervalN(float64(k)/float64(n), float64(n))
+}
+
+// wilsonIntervalN returns 95% Wilson score interval of proportion p observed in
+// a sample of size nf, which is not necessarily integral, e.g. effective sample size.
+func wilsonIntervalN(p, nf float64) Interval {
+	if nf <= 0 {
+		return Interval{}
+	}
+	z2 := confidenceZ * confidenceZ
+	center := (p + z2/(2*nf)) / (1 + z2/nf)
+	margin := confidenceZ / (1 + z2/nf) * math.Sqrt(p*(1-p)/nf+z2/(4*nf*nf))
+	return Interval{math.Max(0, center-margin), math.Min(1, center+margin)}
+}
+
+// SampleWeights accumulates weights of observations of a weighted sample.
+type SampleWeights struct {
+	Sum        float64 `json:"sum"`
+	SumSquares float64 `json:"sum_squares"`
+}
+
+// Add adds n observations of weight w.
+func (sw *SampleWeights) Add(w float64, n int) {
+	sw.Sum += w * float64(n)
+	sw.SumSquares += w * w * float64(n)
+}
+
+func (sw *SampleWeights) Merge(other SampleWeights) {
+	sw.Sum += other.Sum
+	sw.SumSquares += other.SumSquares
+}
+
+// EffectiveN returns Kish effective sample size (sum w)^2 / sum w^2, it is the
+// number of observations if all weights are equal and less if they are not.
+func (sw SampleWeights) EffectiveN() float64 {
+	if sw.SumSquares == 0 {
+		return 0
+	}
+	return sw.Sum * sw.Sum / sw.SumSquares
+}
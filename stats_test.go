@@ -0,0 +1,91 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestWilsonInterval(t *testing.T) {
+	tests := []struct {
+		k, n int
+		want Interval
+	}{
+		{0, 0, Interval{0, 0}},
+		{5, 10, Interval{0.2366, 0.7634}},
+		{0, 10, Interval{0, 0.2775}},
+		{10, 10, Interval{0.7225, 1}},
+		{81, 263, Interval{0.2553, 0.3662}},
+	}
+	for _, tt := range tests {
+		got := wilsonInterval(tt.k, tt.n)
+		if math.Abs(got.Low-tt.want.Low) > 1e-4 || math.Abs(got.High-tt.want.High) > 1e-4 {
+			t.Errorf("wilsonInterval(%d, %d) = %+v, want %+v", tt.k, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestBootstrapMeanCI(t *testing.T) {
+	tests := []struct {
+		values []float64
+		want   Interval
+	}{
+		{[]float64{4}, Interval{4, 4}},
+		{[]float64{2, 2, 2}, Interval{2, 2}},
+		// fixed seed makes the interval reproducible
+		{[]float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, Interval{3.7, 7.3}},
+	}
+	for _, tt := range tests {
+		got := bootstrapMeanCI(tt.values, bootstrapResamples)
+		if math.Abs(got.Low-tt.want.Low) > 1e-9 || math.Abs(got.High-tt.want.High) > 1e-9 {
+			t.Errorf("bootstrapMeanCI(%v) = %+v, want %+v", tt.values, got, tt.want)
+		}
+	}
+}
+
+func TestNewScoreStats(t *testing.T) {
+	tests := []struct {
+		scores               []float64
+		mean, median, stddev float64
+	}{
+		{nil, 0, 0, 0},
+		{[]float64{3}, 3, 3, 0},
+		{[]float64{3, 1, 2}, 2, 2, 1},
+		{[]float64{4, 1, 3, 2}, 2.5, 2.5, math.Sqrt(5.0 / 3)},
+	}
+	for _, tt := range tests {
+		s := NewScoreStats(tt.scores)
+		if s.Drivers != len(tt.scores) || s.Mean != tt.mean || s.Median != tt.median || math.Abs(s.StdDev-tt.stddev) > 1e-9 {
+			t.Errorf("NewScoreStats(%v) = %+v", tt.scores, s)
+		}
+		if len(tt.scores) > 0 && (s.MeanCI.Low > s.Mean || s.MeanCI.High < s.Mean) {
+			t.Errorf("NewScoreStats(%v) mean CI %+v does not contain mean", tt.scores, s.MeanCI)
+		}
+	}
+	// order of scores does not change the interval
+	if a, b := NewScoreStats([]float64{5, 1, 9, 3}), NewScoreStats([]float64{9, 3, 1, 5}); a != b {
+		t.Errorf("stats depend on order: %+v, %+v", a, b)
+	}
+}
+
+func TestSampleWeightsEffectiveN(t *testing.T) {
+	tests := []struct {
+		weights []float64
+		n       float64
+	}{
+		{nil, 0},
+		// equal weights of any scale count every observation
+		{[]float64{1, 1, 1, 1}, 4},
+		{[]float64{2.5, 2.5, 2.5, 2.5}, 4},
+		{[]float64{3, 1}, 1.6},
+		{[]float64{100, 1, 1, 1}, 103.0 * 103 / 10003},
+	}
+	for _, tt := range tests {
+		sw := SampleWeights{}
+		for _, w := range tt.weights {
+			sw.Add(w, 1)
+		}
+		if n := sw.EffectiveN(); math.Abs(n-tt.n) > 1e-9 {
+			t.Errorf("EffectiveN(%v) = %g, want %g", tt.weights, n, tt.n)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	log "github.com/liudanking/goutil/logutil"
+	"github.com/urfave/cli"
+)
+
+// DataStore persists collected stations, current orders and repurchase drivers.
+type DataStore interface {
+	// UpsertStations saves stores of city, existing stores are overwritten.
+	UpsertStations(city string, stores []Store) error
+	// UpsertStationDetails saves StoreList entries of city, existing entries are overwritten.
+	UpsertStationDetails(city string, details []StationDetail) error
+	// MergeCurrentOrders merges records into current orders of store, keyed by item ID,
+	// capture of existing records is kept.
+	MergeCurrentOrders(city, storeID string, records []CurrentOrderRecord) error
+	// SaveRepurchaseSnapshot saves items of store fetched at meta.CapturedAt, previous snapshots are kept.
+	SaveRepurchaseSnapshot(city, storeID string, meta CaptureMeta, items []RepurchaseItem) error
+	// AddPriceObservations appends price observations of city, previous observations are kept.
+	AddPriceObservations(city string, obs []PriceObservation) error
+	// MoveStores moves all data of stores from city to city to, merged into data of to.
+	MoveStores(from, to string, storeIDs []string) error
+	// UpdatedAt returns the last time kind data of store was saved.
+	UpdatedAt(city, kind, storeID string) (time.Time, bool)
+	// CountStores returns number of stores in city having kind data.
+	CountStores(city, kind string) (int, error)
+
+	Cities() ([]string, error)
+	ForEachStation(city string, fn func(store Store) error) error
+	ForEachStationDetail(city string, fn func(detail StationDetail) error) error
+	ForEachCurrentOrder(city string, fn func(storeID string, rec CurrentOrderRecord) error) error
+	ForEachRepurchaseSnapshot(city string, fn func(storeID string, snap RepurchaseSnapshot) error) error
+	ForEachPriceObservation(city string, fn func(obs PriceObservation) error) error
+
+	// GetGeocode returns cached geocode result of grid cell, expired entries included.
+	GetGeocode(cellKey string) (GeocodeEntry, bool, error)
+	// PutGeocodes saves entries in one write, existing entries of cells are overwritten.
+	PutGeocodes(entries []GeocodeEntry) error
+	ForEachGeocode(fn func(entry GeocodeEntry) error) error
+	DidiCities() ([]DidiCity, error)
+	PutDidiCity(city DidiCity) error
+
+	Close() error
+}
+
+// ModelAggregator is implemented by stores which aggregate by car model natively,
+// analysis uses it instead of iterating every item.
+type ModelAggregator interface {
+	CountCurrentOrdersByModel(city string, w TimeWindow) (map[string]int, error)
+	// SumCurrentOrderPricesByModel sums prices of orders with valid sale and real price.
+	SumCurrentOrderPricesByModel(city string, w TimeWindow) (map[string]PriceSum, error)
+	// RepurchaseScoresByModel returns score of every driver grouped by car model.
+	RepurchaseScoresByModel(city string, w TimeWindow, sel SnapshotSelector) (map[string][]float64, error)
+}
+
+var storageFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "storage",
+		Usage: "storage backend: file or sqlite",
+		Value: "file",
+	},
+	cli.StringFlag{
+		Name:  "db",
+		Usage: "sqlite database file, default <dir>/didi-car-rank.db",
+	},
+}
+
+func openDataStore(c *cli.Context) (DataStore, error) {
+	return newDataStore(c.String("storage"), c.String("dir"), c.String("db"))
+}
+
+func newDataStore(backend, dir, db string) (DataStore, error) {
+	switch backend {
+	case "file", "":
+		return NewFileStore(dir), nil
+	case "sqlite":
+		if db == "" {
+			db = filepath.Join(dir, "didi-car-rank.db")
+		}
+		return NewSQLiteStore(db)
+	default:
+		return nil, fmt.Errorf("unknown storage backend: %s", backend)
+	}
+}
+
+func migrateData(c *cli.Context) error {
+	src, err := openDataStore(c)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := newDataStore(c.String("to"), c.String("to-dir"), c.String("to-db"))
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	cities, err := src.Cities()
+	if err != nil {
+		return err
+	}
+	for _, city := range cities {
+		if err := copyCityData(src, dst, city); err != nil {
+			return fmt.Errorf("migrate %s failed:%v", city, err)
+		}
+		log.Info("migrated %s", city)
+	}
+
+	didiCities, err := src.DidiCities()
+	if err != nil {
+		return err
+	}
+	for _, city := range didiCities {
+		if err := dst.PutDidiCity(city); err != nil {
+			return fmt.Errorf("migrate didi city %s failed:%v", city.CityID, err)
+		}
+	}
+
+	geocodes := []GeocodeEntry{}
+	if err := src.ForEachGeocode(func(entry GeocodeEntry) error {
+		geocodes = append(geocodes, entry)
+		return nil
+	}); err != nil {
+		return err
+	}
+	if err := dst.PutGeocodes(geocodes); err != nil {
+		return fmt.Errorf("migrate geocode cache failed:%v", err)
+	}
+	log.Info("migrated %d geocode cache entries", len(geocodes))
+	return nil
+}
+
+func copyCityData(src, dst DataStore, city string) error {
+	stores := []Store{}
+	if err := src.ForEachStation(city, func(store Store) error {
+		stores = append(stores, store)
+		return nil
+	}); err != nil {
+		return err
+	}
+	if err := dst.UpsertStations(city, stores); err != nil {
+		return err
+	}
+
+	details := []StationDetail{}
+	if err := src.ForEachStationDetail(city, func(detail StationDetail) error {
+		details = append(details, detail)
+		return nil
+	}); err != nil {
+		return err
+	}
+	if err := dst.UpsertStationDetails(city, details); err != nil {
+		return err
+	}
+
+	currentOrders := map[string][]CurrentOrderRecord{}
+	if err := src.ForEachCurrentOrder(city, func(storeID string, rec CurrentOrderRecord) error {
+		currentOrders[storeID] = append(currentOrders[storeID], rec)
+		return nil
+	}); err != nil {
+		return err
+	}
+	for storeID, records := range currentOrders {
+		if err := dst.MergeCurrentOrders(city, storeID, records); err != nil {
+			return err
+		}
+	}
+
+	type snapshotKey struct {
+		storeID    string
+		capturedAt int64
+	}
+	metas := map[snapshotKey]CaptureMeta{}
+	snapshots := map[snapshotKey][]RepurchaseItem{}
+	if err := src.ForEachRepurchaseSnapshot(city, func(storeID string, snap RepurchaseSnapshot) error {
+		key := snapshotKey{storeID, unixOrZero(snap.CapturedAt)}
+		if _, ok := metas[key]; !ok {
+			meta := CaptureMeta{CapturedAt: snap.CapturedAt, StoreID: storeID}
+			if snap.Capture != nil {
+				meta = *snap.Capture
+			}
+			metas[key] = meta
+		}
+		snapshots[key] = append(snapshots[key], snap.RepurchaseItem)
+		return nil
+	}); err != nil {
+		return err
+	}
+	for key, items := range snapshots {
+		if err := dst.SaveRepurchaseSnapshot(city, key.storeID, metas[key], items); err != nil {
+			return err
+		}
+	}
+
+	prices := []PriceObservation{}
+	if err := src.ForEachPriceObservation(city, func(obs PriceObservation) error {
+		prices = append(prices, obs)
+		return nil
+	}); err != nil {
+		return err
+	}
+	return dst.AddPriceObservations(city, prices)
+}
+
+func hasCity(store DataStore, city string) (bool, error) {
+	cities, err := store.Cities()
+	if err != nil {
+		return false, err
+	}
+	for _, c := range cities {
+		if c == city {
+			return true, nil
+		}
+	}
+	return false, nil
+}
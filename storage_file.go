@@ -0,0 +1,642 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/liudanking/goutil/encodingutil"
+	log "github.com/liudanking/goutil/logutil"
+)
+
+const (
+	gasstationsFile    = "gasstations.json"
+	stationDetailsFile = "stationdetails.json"
+	geocodeCacheFile   = "geocode_cache.json"
+	didiCitiesFile     = "didi_cities.json"
+)
+
+// FileStore keeps data in the layout <dir>/<city>/currentorder/<store_id>.json,
+// <dir>/<city>/repurchase/<store_id>/<unix nano time>.json, <dir>/<city>/price/<store_id>.json
+// plus <dir>/<city>/gasstations.json and <dir>/<city>/stationdetails.json.
+// Geocode cache and didi cities of all cities are <dir>/geocode_cache.json and <dir>/didi_cities.json.
+type FileStore struct {
+	mtx sync.Mutex
+	dir string
+	// geocodes is loaded from geocodeCacheFile on first use
+	geocodes map[string]GeocodeEntry
+}
+
+func NewFileStore(dir string) *FileStore {
+	return &FileStore{
+		dir: dir,
+	}
+}
+
+func (fs *FileStore) cityDataDir(city string) string {
+	return filepath.Join(fs.dir, city)
+}
+
+func (fs *FileStore) storeFile(city, kind, storeID string) string {
+	return filepath.Join(fs.cityDataDir(city), kind, fmt.Sprintf("%s.json", storeID))
+}
+
+func (fs *FileStore) UpsertStations(city string, stores []Store) error {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+
+	dir := fs.cityDataDir(city)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	fn := filepath.Join(dir, gasstationsFile)
+
+	v := map[string]Store{}
+	if _, err := os.Lstat(fn); err == nil {
+		if err := encodingutil.UnmarshalJSONFromFile(fn, &v); err != nil {
+			log.Warning("unmarshal failed:%v", err)
+			return err
+		}
+	}
+
+	for _, store := range stores {
+		v[store.StoreID] = store
+	}
+
+	return jsonMarshalIndentToFile(fn, &v)
+}
+
+func (fs *FileStore) UpsertStationDetails(city string, details []StationDetail) error {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+
+	dir := fs.cityDataDir(city)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	fn := filepath.Join(dir, stationDetailsFile)
+
+	v := map[string]StationDetail{}
+	if _, err := os.Lstat(fn); err == nil {
+		if err := encodingutil.UnmarshalJSONFromFile(fn, &v); err != nil {
+			log.Warning("unmarshal from file %s failed:%v", fn, err)
+			return err
+		}
+	}
+	for _, detail := range details {
+		v[detail.StoreID] = detail
+	}
+	return jsonMarshalIndentToFile(fn, &v)
+}
+
+func (fs *FileStore) MergeCurrentOrders(city, storeID string, records []CurrentOrderRecord) error {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+
+	fn := fs.storeFile(city, kindCurrentOrder, storeID)
+	if err := os.MkdirAll(filepath.Dir(fn), 0700); err != nil {
+		return err
+	}
+	v := map[string]CurrentOrderRecord{}
+	if _, err := os.Lstat(fn); err == nil {
+		if err := encodingutil.UnmarshalJSONFromFile(fn, &v); err != nil {
+			log.Warning("unmarshal from file %s failed:%v", fn, err)
+		}
+	}
+	for _, rec := range records {
+		if old, ok := v[rec.ID]; ok && old.Capture != nil {
+			rec.Capture = old.Capture
+		}
+		v[rec.ID] = rec
+	}
+	return jsonMarshalIndentToFile(fn, &v)
+}
+
+// SaveRepurchaseSnapshot writes items to <dir>/<city>/repurchase/<store_id>/<unix nano time>.json
+// so that snapshots fetched in the same second are kept apart, snapshots without capture
+// time are written to the legacy <store_id>.json.
+func (fs *FileStore) SaveRepurchaseSnapshot(city, storeID string, meta CaptureMeta, items []RepurchaseItem) error {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+
+	fn := filepath.Join(fs.snapshotDir(city, storeID), fmt.Sprintf("%d.json", meta.CapturedAt.UnixNano()))
+	if meta.CapturedAt.IsZero() {
+		fn = fs.storeFile(city, kindRepurchase, storeID)
+	}
+	if err := os.MkdirAll(filepath.Dir(fn), 0700); err != nil {
+		return err
+	}
+	v := map[string]RepurchaseSnapshot{}
+	for _, item := range items {
+		v[item.DriverID] = RepurchaseSnapshot{
+			RepurchaseItem: item,
+			CapturedAt:     meta.CapturedAt,
+			Capture:        meta.orNil(),
+		}
+	}
+	return jsonMarshalIndentToFile(fn, &v)
+}
+
+// AddPriceObservations appends obs to the observation list of every store.
+func (fs *FileStore) AddPriceObservations(city string, obs []PriceObservation) error {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+
+	storeObs := map[string][]PriceObservation{}
+	for _, o := range obs {
+		storeObs[o.StoreID] = append(storeObs[o.StoreID], o)
+	}
+	for storeID, obs := range storeObs {
+		fn := fs.storeFile(city, kindPrice, storeID)
+		if err := os.MkdirAll(filepath.Dir(fn), 0700); err != nil {
+			return err
+		}
+		v := []PriceObservation{}
+		if _, err := os.Lstat(fn); err == nil {
+			if err := encodingutil.UnmarshalJSONFromFile(fn, &v); err != nil {
+				log.Warning("unmarshal from file %s failed:%v", fn, err)
+			}
+		}
+		if err := jsonMarshalIndentToFile(fn, append(v, obs...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MoveStores moves entries of gasstations.json and stationdetails.json and files of stores,
+// files existing in to are merged, empty directories of from are removed.
+func (fs *FileStore) MoveStores(from, to string, storeIDs []string) error {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+
+	if err := os.MkdirAll(fs.cityDataDir(to), 0700); err != nil {
+		return err
+	}
+	for _, name := range []string{gasstationsFile, stationDetailsFile} {
+		if err := moveJSONMapEntries(filepath.Join(fs.cityDataDir(from), name),
+			filepath.Join(fs.cityDataDir(to), name), storeIDs); err != nil {
+			return err
+		}
+	}
+	for _, storeID := range storeIDs {
+		for _, kind := range []string{kindCurrentOrder, kindRepurchase} {
+			if err := moveJSONFile(fs.storeFile(from, kind, storeID), fs.storeFile(to, kind, storeID), mergeJSONMaps); err != nil {
+				return err
+			}
+		}
+		if err := moveJSONFile(fs.storeFile(from, kindPrice, storeID), fs.storeFile(to, kindPrice, storeID), mergeJSONLists); err != nil {
+			return err
+		}
+		snapshots, err := ioutil.ReadDir(fs.snapshotDir(from, storeID))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, fi := range snapshots {
+			if err := moveJSONFile(filepath.Join(fs.snapshotDir(from, storeID), fi.Name()),
+				filepath.Join(fs.snapshotDir(to, storeID), fi.Name()), mergeJSONMaps); err != nil {
+				return err
+			}
+		}
+	}
+	return removeEmptyDirs(fs.cityDataDir(from))
+}
+
+// moveJSONMapEntries moves entries of keys from JSON object file src to dst.
+func moveJSONMapEntries(src, dst string, keys []string) error {
+	if _, err := os.Lstat(src); err != nil {
+		return nil
+	}
+	from, to := map[string]json.RawMessage{}, map[string]json.RawMessage{}
+	if err := encodingutil.UnmarshalJSONFromFile(src, &from); err != nil {
+		return err
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		if err := encodingutil.UnmarshalJSONFromFile(dst, &to); err != nil {
+			return err
+		}
+	}
+	moved := 0
+	for _, key := range keys {
+		if v, ok := from[key]; ok {
+			to[key] = v
+			delete(from, key)
+			moved++
+		}
+	}
+	if moved == 0 {
+		return nil
+	}
+	if err := jsonMarshalIndentToFile(dst, &to); err != nil {
+		return err
+	}
+	if len(from) == 0 {
+		return os.Remove(src)
+	}
+	return jsonMarshalIndentToFile(src, &from)
+}
+
+// moveJSONFile renames src to dst, or merges src into dst by merge if dst exists.
+func moveJSONFile(src, dst string, merge func(src, dst string) error) error {
+	if _, err := os.Lstat(src); err != nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+	if _, err := os.Lstat(dst); err != nil {
+		return os.Rename(src, dst)
+	}
+	if err := merge(src, dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// mergeJSONMaps merges JSON object file src into dst, entries of dst are kept.
+func mergeJSONMaps(src, dst string) error {
+	from, to := map[string]json.RawMessage{}, map[string]json.RawMessage{}
+	if err := encodingutil.UnmarshalJSONFromFile(src, &from); err != nil {
+		return err
+	}
+	if err := encodingutil.UnmarshalJSONFromFile(dst, &to); err != nil {
+		return err
+	}
+	for k, v := range from {
+		if _, ok := to[k]; !ok {
+			to[k] = v
+		}
+	}
+	return jsonMarshalIndentToFile(dst, &to)
+}
+
+// mergeJSONLists appends JSON array file src to dst.
+func mergeJSONLists(src, dst string) error {
+	from, to := []json.RawMessage{}, []json.RawMessage{}
+	if err := encodingutil.UnmarshalJSONFromFile(src, &from); err != nil {
+		return err
+	}
+	if err := encodingutil.UnmarshalJSONFromFile(dst, &to); err != nil {
+		return err
+	}
+	return jsonMarshalIndentToFile(dst, append(to, from...))
+}
+
+// removeEmptyDirs removes dir and its sub directories having no files.
+func removeEmptyDirs(dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	empty := true
+	for _, fi := range files {
+		if !fi.IsDir() {
+			empty = false
+			continue
+		}
+		sub := filepath.Join(dir, fi.Name())
+		if err := removeEmptyDirs(sub); err != nil {
+			return err
+		}
+		if _, err := os.Lstat(sub); err == nil {
+			empty = false
+		}
+	}
+	if empty {
+		return os.Remove(dir)
+	}
+	return nil
+}
+
+// maxSnapshotFileSec bounds snapshot file names in seconds, names in nanoseconds
+// of any time after 1970-01-01 00:16:40 are greater.
+const maxSnapshotFileSec = 1e12
+
+func (fs *FileStore) snapshotDir(city, storeID string) string {
+	return filepath.Join(fs.cityDataDir(city), kindRepurchase, storeID)
+}
+
+// latestSnapshotTime returns capture time of the latest snapshot of store.
+func (fs *FileStore) latestSnapshotTime(city, storeID string) (time.Time, bool) {
+	files, err := ioutil.ReadDir(fs.snapshotDir(city, storeID))
+	if err != nil {
+		return time.Time{}, false
+	}
+	var latest time.Time
+	for _, fi := range files {
+		if t, ok := snapshotFileTime(fi.Name()); ok && t.After(latest) {
+			latest = t
+		}
+	}
+	return latest, !latest.IsZero()
+}
+
+// snapshotFileTime parses capture time of snapshot file name, in nanoseconds or,
+// for snapshots written before, in seconds.
+func snapshotFileTime(name string) (time.Time, bool) {
+	n, err := strconv.ParseInt(strings.TrimSuffix(name, ".json"), 10, 64)
+	if err != nil || filepath.Ext(name) != ".json" {
+		return time.Time{}, false
+	}
+	if n < maxSnapshotFileSec {
+		return time.Unix(n, 0), true
+	}
+	return time.Unix(0, n), true
+}
+
+func (fs *FileStore) UpdatedAt(city, kind, storeID string) (time.Time, bool) {
+	if kind == kindRepurchase {
+		if t, ok := fs.latestSnapshotTime(city, storeID); ok {
+			return t, true
+		}
+	}
+	fi, err := os.Lstat(fs.storeFile(city, kind, storeID))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return fi.ModTime(), true
+}
+
+func (fs *FileStore) CountStores(city, kind string) (int, error) {
+	files, err := ioutil.ReadDir(filepath.Join(fs.cityDataDir(city), kind))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	// repurchase has both legacy <store_id>.json files and <store_id> snapshot dirs
+	stores := map[string]bool{}
+	for _, fi := range files {
+		stores[strings.TrimSuffix(fi.Name(), ".json")] = true
+	}
+	return len(stores), nil
+}
+
+func (fs *FileStore) Cities() ([]string, error) {
+	files, err := ioutil.ReadDir(fs.dir)
+	if err != nil {
+		return nil, err
+	}
+	cities := []string{}
+	for _, fi := range files {
+		if fi.IsDir() {
+			cities = append(cities, fi.Name())
+		}
+	}
+	return cities, nil
+}
+
+func (fs *FileStore) ForEachStation(city string, fn func(store Store) error) error {
+	path := filepath.Join(fs.cityDataDir(city), gasstationsFile)
+	if _, err := os.Lstat(path); err != nil {
+		return nil
+	}
+	stores := map[string]Store{}
+	if err := encodingutil.UnmarshalJSONFromFile(path, &stores); err != nil {
+		return err
+	}
+	for _, store := range stores {
+		if err := fn(store); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *FileStore) ForEachStationDetail(city string, fn func(detail StationDetail) error) error {
+	path := filepath.Join(fs.cityDataDir(city), stationDetailsFile)
+	if _, err := os.Lstat(path); err != nil {
+		return nil
+	}
+	details := map[string]StationDetail{}
+	if err := encodingutil.UnmarshalJSONFromFile(path, &details); err != nil {
+		return err
+	}
+	for _, detail := range details {
+		if err := fn(detail); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkKind calls fn with store ID and path of every kind data file of city.
+func (fs *FileStore) walkKind(city, kind string, fn func(storeID, path string) error) error {
+	dir := filepath.Join(fs.cityDataDir(city), kind)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, fi := range files {
+		if fi.IsDir() || filepath.Ext(fi.Name()) != ".json" {
+			continue
+		}
+		if err := fn(strings.TrimSuffix(fi.Name(), ".json"), filepath.Join(dir, fi.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *FileStore) ForEachCurrentOrder(city string, fn func(storeID string, rec CurrentOrderRecord) error) error {
+	return fs.walkKind(city, kindCurrentOrder, func(storeID, path string) error {
+		records := map[string]CurrentOrderRecord{}
+		if err := encodingutil.UnmarshalJSONFromFile(path, &records); err != nil {
+			log.Warning("unmarshal from %s failed:%v", path, err)
+			return nil
+		}
+		for _, rec := range records {
+			if err := fn(storeID, rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ForEachRepurchaseSnapshot iterates snapshots in repurchase/<store_id>/ and legacy
+// repurchase/<store_id>.json files, the latter with zero capture time.
+func (fs *FileStore) ForEachRepurchaseSnapshot(city string, fn func(storeID string, snap RepurchaseSnapshot) error) error {
+	emit := func(storeID, path string, capturedAt time.Time) error {
+		snaps := map[string]RepurchaseSnapshot{}
+		if err := encodingutil.UnmarshalJSONFromFile(path, &snaps); err != nil {
+			log.Warning("unmarshal from %s failed:%v", path, err)
+			return nil
+		}
+		for _, snap := range snaps {
+			if snap.CapturedAt.IsZero() {
+				snap.CapturedAt = capturedAt
+			}
+			if err := fn(storeID, snap); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := fs.walkKind(city, kindRepurchase, func(storeID, path string) error {
+		return emit(storeID, path, time.Time{})
+	}); err != nil {
+		return err
+	}
+
+	dirs, err := ioutil.ReadDir(filepath.Join(fs.cityDataDir(city), kindRepurchase))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, di := range dirs {
+		if !di.IsDir() {
+			continue
+		}
+		storeID := di.Name()
+		files, err := ioutil.ReadDir(fs.snapshotDir(city, storeID))
+		if err != nil {
+			return err
+		}
+		for _, fi := range files {
+			capturedAt, ok := snapshotFileTime(fi.Name())
+			if !ok {
+				continue
+			}
+			if err := emit(storeID, filepath.Join(fs.snapshotDir(city, storeID), fi.Name()), capturedAt); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (fs *FileStore) ForEachPriceObservation(city string, fn func(obs PriceObservation) error) error {
+	return fs.walkKind(city, kindPrice, func(storeID, path string) error {
+		obs := []PriceObservation{}
+		if err := encodingutil.UnmarshalJSONFromFile(path, &obs); err != nil {
+			log.Warning("unmarshal from %s failed:%v", path, err)
+			return nil
+		}
+		for _, o := range obs {
+			if err := fn(o); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// loadGeocodes loads geocode cache file, fs.mtx must be held.
+func (fs *FileStore) loadGeocodes() error {
+	if fs.geocodes != nil {
+		return nil
+	}
+	geocodes := map[string]GeocodeEntry{}
+	fn := filepath.Join(fs.dir, geocodeCacheFile)
+	if _, err := os.Lstat(fn); err == nil {
+		if err := encodingutil.UnmarshalJSONFromFile(fn, &geocodes); err != nil {
+			return err
+		}
+	}
+	fs.geocodes = geocodes
+	return nil
+}
+
+func (fs *FileStore) GetGeocode(cellKey string) (GeocodeEntry, bool, error) {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	if err := fs.loadGeocodes(); err != nil {
+		return GeocodeEntry{}, false, err
+	}
+	e, ok := fs.geocodes[cellKey]
+	return e, ok, nil
+}
+
+// PutGeocodes rewrites the whole cache file once for all entries.
+func (fs *FileStore) PutGeocodes(entries []GeocodeEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	if err := fs.loadGeocodes(); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		fs.geocodes[entry.CellKey] = entry
+	}
+	if err := os.MkdirAll(fs.dir, 0700); err != nil {
+		return err
+	}
+	return jsonMarshalIndentToFile(filepath.Join(fs.dir, geocodeCacheFile), &fs.geocodes)
+}
+
+func (fs *FileStore) ForEachGeocode(fn func(entry GeocodeEntry) error) error {
+	fs.mtx.Lock()
+	if err := fs.loadGeocodes(); err != nil {
+		fs.mtx.Unlock()
+		return err
+	}
+	entries := make([]GeocodeEntry, 0, len(fs.geocodes))
+	for _, entry := range fs.geocodes {
+		entries = append(entries, entry)
+	}
+	fs.mtx.Unlock()
+	for _, entry := range entries {
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *FileStore) DidiCities() ([]DidiCity, error) {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	fn := filepath.Join(fs.dir, didiCitiesFile)
+	if _, err := os.Lstat(fn); err != nil {
+		return nil, nil
+	}
+	v := map[string]DidiCity{}
+	if err := encodingutil.UnmarshalJSONFromFile(fn, &v); err != nil {
+		return nil, err
+	}
+	cities := make([]DidiCity, 0, len(v))
+	for _, city := range v {
+		cities = append(cities, city)
+	}
+	return cities, nil
+}
+
+func (fs *FileStore) PutDidiCity(city DidiCity) error {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	if err := os.MkdirAll(fs.dir, 0700); err != nil {
+		return err
+	}
+	fn := filepath.Join(fs.dir, didiCitiesFile)
+	v := map[string]DidiCity{}
+	if _, err := os.Lstat(fn); err == nil {
+		if err := encodingutil.UnmarshalJSONFromFile(fn, &v); err != nil {
+			return err
+		}
+	}
+	v[city.CityID] = city
+	return jsonMarshalIndentToFile(fn, &v)
+}
+
+func (fs *FileStore) Close() error {
+	return nil
+}
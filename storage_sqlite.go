@@ -0,0 +1,675 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const sqliteSchemaVersion = 5
+
+// sqliteSchema is the schema of version 1
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS stations (
+	store_id   TEXT PRIMARY KEY,
+	city       TEXT NOT NULL,
+	name       TEXT NOT NULL,
+	logo       TEXT NOT NULL,
+	logo_x     TEXT NOT NULL,
+	logo_xx    TEXT NOT NULL,
+	lat        REAL NOT NULL,
+	lng        REAL NOT NULL,
+	rawid      TEXT NOT NULL,
+	distance   TEXT NOT NULL,
+	price      TEXT NOT NULL,
+	updated_at INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_stations_city ON stations (city);
+
+CREATE TABLE IF NOT EXISTS current_orders (
+	id             TEXT PRIMARY KEY,
+	city           TEXT NOT NULL,
+	store_id       TEXT NOT NULL,
+	uid            TEXT NOT NULL,
+	pid            TEXT NOT NULL,
+	user_name      TEXT NOT NULL,
+	avater         TEXT NOT NULL,
+	sale_price     TEXT NOT NULL,
+	real_price     TEXT NOT NULL,
+	real_price_fmt TEXT NOT NULL,
+	status         INTEGER NOT NULL,
+	pay_time       INTEGER NOT NULL,
+	pay_time_fmt   TEXT NOT NULL,
+	car_model      TEXT NOT NULL,
+	save_price     TEXT NOT NULL,
+	save_price_fmt TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_current_orders_city ON current_orders (city);
+CREATE INDEX IF NOT EXISTS idx_current_orders_car_model ON current_orders (car_model);
+CREATE INDEX IF NOT EXISTS idx_current_orders_store_id ON current_orders (store_id);
+
+CREATE TABLE IF NOT EXISTS repurchase_snapshots (
+	store_id              TEXT NOT NULL,
+	driver_id             TEXT NOT NULL,
+	captured_at           INTEGER NOT NULL,
+	city                  TEXT NOT NULL,
+	avanter               TEXT NOT NULL,
+	driver_name           TEXT NOT NULL,
+	user_name             TEXT NOT NULL,
+	car_model             TEXT NOT NULL,
+	order_count_1m        INTEGER NOT NULL,
+	ordercount_1m         INTEGER NOT NULL,
+	order_discount_1m_fmt TEXT NOT NULL,
+	PRIMARY KEY (store_id, driver_id, captured_at)
+);
+CREATE INDEX IF NOT EXISTS idx_repurchase_snapshots_city ON repurchase_snapshots (city);
+CREATE INDEX IF NOT EXISTS idx_repurchase_snapshots_car_model ON repurchase_snapshots (car_model);
+
+CREATE TABLE IF NOT EXISTS store_fetches (
+	city       TEXT NOT NULL,
+	store_id   TEXT NOT NULL,
+	kind       TEXT NOT NULL,
+	fetched_at INTEGER NOT NULL,
+	PRIMARY KEY (store_id, kind)
+);
+CREATE INDEX IF NOT EXISTS idx_store_fetches_city ON store_fetches (city, kind);
+
+CREATE TABLE IF NOT EXISTS geocode_cache (
+	cell_key   TEXT PRIMARY KEY,
+	lng        REAL NOT NULL,
+	lat        REAL NOT NULL,
+	province   TEXT NOT NULL,
+	city       TEXT NOT NULL,
+	updated_at INTEGER NOT NULL
+);
+`
+
+// sqliteMigrations[i] upgrades schema from version i+1 to i+2
+var sqliteMigrations = []string{
+	// capture provenance
+	`
+ALTER TABLE current_orders ADD COLUMN captured_at INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE current_orders ADD COLUMN capture_source TEXT NOT NULL DEFAULT '';
+ALTER TABLE current_orders ADD COLUMN am_channel INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE current_orders ADD COLUMN query_lng TEXT NOT NULL DEFAULT '';
+ALTER TABLE current_orders ADD COLUMN query_lat TEXT NOT NULL DEFAULT '';
+ALTER TABLE repurchase_snapshots ADD COLUMN capture_source TEXT NOT NULL DEFAULT '';
+ALTER TABLE repurchase_snapshots ADD COLUMN am_channel INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE repurchase_snapshots ADD COLUMN query_lng TEXT NOT NULL DEFAULT '';
+ALTER TABLE repurchase_snapshots ADD COLUMN query_lat TEXT NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS idx_current_orders_captured_at ON current_orders (captured_at);
+`,
+	// price history
+	`
+CREATE TABLE IF NOT EXISTS price_observations (
+	store_id           TEXT NOT NULL,
+	fuel_category      TEXT NOT NULL,
+	observed_at        INTEGER NOT NULL,
+	city               TEXT NOT NULL,
+	name               TEXT NOT NULL,
+	fuel_category_name TEXT NOT NULL,
+	price              TEXT NOT NULL,
+	discount           TEXT NOT NULL,
+	rank_price         TEXT NOT NULL,
+	total_score        TEXT NOT NULL,
+	source             TEXT NOT NULL,
+	PRIMARY KEY (store_id, fuel_category, observed_at)
+);
+CREATE INDEX IF NOT EXISTS idx_price_observations_city ON price_observations (city, observed_at);
+`,
+	// station list details, activity_list and coupon_info are json
+	`
+CREATE TABLE IF NOT EXISTS station_details (
+	store_id             TEXT PRIMARY KEY,
+	city                 TEXT NOT NULL,
+	name                 TEXT NOT NULL,
+	logo                 TEXT NOT NULL,
+	logo_x               TEXT NOT NULL,
+	logo_xx              TEXT NOT NULL,
+	lat                  REAL NOT NULL,
+	lng                  REAL NOT NULL,
+	price                TEXT NOT NULL,
+	discount             TEXT NOT NULL,
+	distance             TEXT NOT NULL,
+	address              TEXT NOT NULL,
+	month_order_count    TEXT NOT NULL,
+	repurchase_user_rate INTEGER NOT NULL,
+	rank                 INTEGER NOT NULL,
+	rank_text            TEXT NOT NULL,
+	is_new               INTEGER NOT NULL,
+	rawid                TEXT NOT NULL,
+	activity_num         INTEGER NOT NULL,
+	activity_list        TEXT NOT NULL,
+	coupon_info          TEXT NOT NULL,
+	promotion_content    TEXT NOT NULL,
+	fresh_user           INTEGER NOT NULL,
+	total_score          TEXT NOT NULL,
+	didi_guide_discount  TEXT NOT NULL,
+	rank_didi_discount   TEXT NOT NULL,
+	rank_guide_discount  TEXT NOT NULL,
+	rank_store_discount  TEXT NOT NULL,
+	rank_price           TEXT NOT NULL,
+	captured_at          INTEGER NOT NULL,
+	source               TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_station_details_city ON station_details (city);
+`,
+	// didi city IDs learned from gasstation pages
+	`
+CREATE TABLE IF NOT EXISTS didi_cities (
+	city_id            TEXT PRIMARY KEY,
+	gulfstream_city_id INTEGER NOT NULL,
+	name               TEXT NOT NULL,
+	updated_at         INTEGER NOT NULL
+);
+`,
+}
+
+// SQLiteStore keeps data in an embedded SQLite database.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+func NewSQLiteStore(fn string) (*SQLiteStore, error) {
+	if err := os.MkdirAll(filepath.Dir(fn), 0700); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite3", fn)
+	if err != nil {
+		return nil, err
+	}
+	// sqlite allows only one writer at a time
+	db.SetMaxOpenConns(1)
+	if err := migrateSQLite(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+func migrateSQLite(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+	if version > sqliteSchemaVersion {
+		return fmt.Errorf("database schema version %d is newer than supported %d", version, sqliteSchemaVersion)
+	}
+	if version == 0 {
+		if _, err := db.Exec(sqliteSchema); err != nil {
+			return err
+		}
+		version = 1
+	}
+	for ; version < sqliteSchemaVersion; version++ {
+		if _, err := db.Exec(sqliteMigrations[version-1]); err != nil {
+			return fmt.Errorf("migrate schema to version %d failed:%v", version+1, err)
+		}
+	}
+	_, err := db.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, sqliteSchemaVersion))
+	return err
+}
+
+// withTx runs fn in a transaction, committed if fn returns nil.
+func (ss *SQLiteStore) withTx(fn func(tx *sql.Tx) error) error {
+	tx, err := ss.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (ss *SQLiteStore) UpsertStations(city string, stores []Store) error {
+	now := time.Now().Unix()
+	return ss.withTx(func(tx *sql.Tx) error {
+		for _, s := range stores {
+			if _, err := tx.Exec(`INSERT OR REPLACE INTO stations
+				(store_id, city, name, logo, logo_x, logo_xx, lat, lng, rawid, distance, price, updated_at)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				s.StoreID, city, s.Name, s.Logo, s.LogoX, s.LogoXx, s.Lat, s.Lng, s.Rawid, s.Distance, s.Price, now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (ss *SQLiteStore) UpsertStationDetails(city string, details []StationDetail) error {
+	return ss.withTx(func(tx *sql.Tx) error {
+		for _, d := range details {
+			activityList, err := json.Marshal(d.ActivityList)
+			if err != nil {
+				return err
+			}
+			couponInfo, err := json.Marshal(d.CouponInfo)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec(`INSERT OR REPLACE INTO station_details
+				(store_id, city, name, logo, logo_x, logo_xx, lat, lng, price, discount, distance, address,
+				month_order_count, repurchase_user_rate, rank, rank_text, is_new, rawid,
+				activity_num, activity_list, coupon_info, promotion_content, fresh_user, total_score,
+				didi_guide_discount, rank_didi_discount, rank_guide_discount, rank_store_discount, rank_price,
+				captured_at, source)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				d.StoreID, city, d.Name, d.Logo, d.LogoX, d.LogoXx, d.Lat, d.Lng, d.Price, d.Discount, d.Distance, d.Address,
+				d.MonthOrderCount, d.RepurchaseUserRate, d.Rank, d.RankText, d.IsNew, d.Rawid,
+				d.ActivityNum, string(activityList), string(couponInfo), d.PromotionContent, d.FreshUser, d.TotalScore,
+				d.DidiGuideDiscount, d.RankDidiDiscount, d.RankGuideDiscount, d.RankStoreDiscount, d.RankPrice,
+				unixOrZero(d.CapturedAt), d.Source); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (ss *SQLiteStore) touchFetch(tx *sql.Tx, city, kind, storeID string, t time.Time) error {
+	_, err := tx.Exec(`INSERT OR REPLACE INTO store_fetches (city, store_id, kind, fetched_at) VALUES (?, ?, ?, ?)`,
+		city, storeID, kind, t.Unix())
+	return err
+}
+
+func (ss *SQLiteStore) MergeCurrentOrders(city, storeID string, records []CurrentOrderRecord) error {
+	return ss.withTx(func(tx *sql.Tx) error {
+		for _, rec := range records {
+			it, meta := rec.CurrentOrderItem, CaptureMeta{}
+			if rec.Capture != nil {
+				meta = *rec.Capture
+			}
+			// capture columns keep the first capture
+			if _, err := tx.Exec(`INSERT INTO current_orders
+				(id, city, store_id, uid, pid, user_name, avater, sale_price, real_price, real_price_fmt,
+				status, pay_time, pay_time_fmt, car_model, save_price, save_price_fmt,
+				captured_at, capture_source, am_channel, query_lng, query_lat)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+				ON CONFLICT (id) DO UPDATE SET city = excluded.city, store_id = excluded.store_id,
+				uid = excluded.uid, pid = excluded.pid, user_name = excluded.user_name, avater = excluded.avater,
+				sale_price = excluded.sale_price, real_price = excluded.real_price, real_price_fmt = excluded.real_price_fmt,
+				status = excluded.status, pay_time = excluded.pay_time, pay_time_fmt = excluded.pay_time_fmt,
+				car_model = excluded.car_model, save_price = excluded.save_price, save_price_fmt = excluded.save_price_fmt`,
+				it.ID, city, storeID, it.UID, it.Pid, it.UserName, it.Avater, it.SalePrice, it.RealPrice, it.RealPriceFmt,
+				it.Status, it.PayTime, it.PayTimeFmt, it.CarModel, it.SavePrice, it.SavePriceFmt,
+				unixOrZero(meta.CapturedAt), meta.Source, meta.AmChannel, meta.QueryLng, meta.QueryLat); err != nil {
+				return err
+			}
+		}
+		return ss.touchFetch(tx, city, kindCurrentOrder, storeID, time.Now())
+	})
+}
+
+func (ss *SQLiteStore) SaveRepurchaseSnapshot(city, storeID string, meta CaptureMeta, items []RepurchaseItem) error {
+	return ss.withTx(func(tx *sql.Tx) error {
+		for _, it := range items {
+			if _, err := tx.Exec(`INSERT OR REPLACE INTO repurchase_snapshots
+				(store_id, driver_id, captured_at, city, avanter, driver_name, user_name, car_model,
+				order_count_1m, ordercount_1m, order_discount_1m_fmt,
+				capture_source, am_channel, query_lng, query_lat)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				storeID, it.DriverID, unixOrZero(meta.CapturedAt), city, it.Avanter, it.DriverName, it.UserName, it.CarModel,
+				it.OrderCount1M, it.Ordercount1M, it.OrderDiscount1MFmt,
+				meta.Source, meta.AmChannel, meta.QueryLng, meta.QueryLat); err != nil {
+				return err
+			}
+		}
+		fetchedAt := meta.CapturedAt
+		if fetchedAt.IsZero() {
+			fetchedAt = time.Now()
+		}
+		return ss.touchFetch(tx, city, kindRepurchase, storeID, fetchedAt)
+	})
+}
+
+func (ss *SQLiteStore) AddPriceObservations(city string, obs []PriceObservation) error {
+	return ss.withTx(func(tx *sql.Tx) error {
+		for _, o := range obs {
+			if _, err := tx.Exec(`INSERT OR REPLACE INTO price_observations
+				(store_id, fuel_category, observed_at, city, name, fuel_category_name,
+				price, discount, rank_price, total_score, source)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				o.StoreID, o.FuelCategory, unixOrZero(o.ObservedAt), city, o.Name, o.FuelCategoryName,
+				o.Price, o.Discount, o.RankPrice, o.TotalScore, o.Source); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// MoveStores only changes city column, tables are keyed by store without city.
+func (ss *SQLiteStore) MoveStores(from, to string, storeIDs []string) error {
+	tables := []string{"stations", "station_details", "current_orders", "repurchase_snapshots", "store_fetches", "price_observations"}
+	return ss.withTx(func(tx *sql.Tx) error {
+		for _, table := range tables {
+			for _, storeID := range storeIDs {
+				if _, err := tx.Exec(fmt.Sprintf(`UPDATE %s SET city = ? WHERE city = ? AND store_id = ?`, table),
+					to, from, storeID); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// unixOrZero converts t to unix seconds, zero time is stored as 0.
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func timeFromUnix(sec int64) time.Time {
+	if sec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
+
+func (ss *SQLiteStore) UpdatedAt(city, kind, storeID string) (time.Time, bool) {
+	var sec int64
+	err := ss.db.QueryRow(`SELECT fetched_at FROM store_fetches WHERE store_id = ? AND kind = ?`, storeID, kind).Scan(&sec)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(sec, 0), true
+}
+
+func (ss *SQLiteStore) CountStores(city, kind string) (int, error) {
+	var n int
+	err := ss.db.QueryRow(`SELECT COUNT(*) FROM store_fetches WHERE city = ? AND kind = ?`, city, kind).Scan(&n)
+	return n, err
+}
+
+func (ss *SQLiteStore) Cities() ([]string, error) {
+	cities := []string{}
+	err := ss.query(`SELECT city FROM stations UNION SELECT city FROM store_fetches UNION SELECT city FROM price_observations`, []interface{}{},
+		func(rows *sql.Rows) error {
+			var city string
+			if err := rows.Scan(&city); err != nil {
+				return err
+			}
+			cities = append(cities, city)
+			return nil
+		})
+	return cities, err
+}
+
+// query calls fn for every row of query.
+func (ss *SQLiteStore) query(query string, args []interface{}, fn func(rows *sql.Rows) error) error {
+	rows, err := ss.db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := fn(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (ss *SQLiteStore) ForEachStation(city string, fn func(store Store) error) error {
+	return ss.query(`SELECT store_id, name, logo, logo_x, logo_xx, lat, lng, rawid, distance, price
+		FROM stations WHERE city = ?`, []interface{}{city},
+		func(rows *sql.Rows) error {
+			s := Store{}
+			if err := rows.Scan(&s.StoreID, &s.Name, &s.Logo, &s.LogoX, &s.LogoXx,
+				&s.Lat, &s.Lng, &s.Rawid, &s.Distance, &s.Price); err != nil {
+				return err
+			}
+			return fn(s)
+		})
+}
+
+func (ss *SQLiteStore) ForEachStationDetail(city string, fn func(detail StationDetail) error) error {
+	return ss.query(`SELECT store_id, name, logo, logo_x, logo_xx, lat, lng, price, discount, distance, address,
+		month_order_count, repurchase_user_rate, rank, rank_text, is_new, rawid,
+		activity_num, activity_list, coupon_info, promotion_content, fresh_user, total_score,
+		didi_guide_discount, rank_didi_discount, rank_guide_discount, rank_store_discount, rank_price,
+		captured_at, source
+		FROM station_details WHERE city = ?`, []interface{}{city},
+		func(rows *sql.Rows) error {
+			var activityList, couponInfo string
+			var capturedAt int64
+			d := StationDetail{}
+			if err := rows.Scan(&d.StoreID, &d.Name, &d.Logo, &d.LogoX, &d.LogoXx, &d.Lat, &d.Lng,
+				&d.Price, &d.Discount, &d.Distance, &d.Address,
+				&d.MonthOrderCount, &d.RepurchaseUserRate, &d.Rank, &d.RankText, &d.IsNew, &d.Rawid,
+				&d.ActivityNum, &activityList, &couponInfo, &d.PromotionContent, &d.FreshUser, &d.TotalScore,
+				&d.DidiGuideDiscount, &d.RankDidiDiscount, &d.RankGuideDiscount, &d.RankStoreDiscount, &d.RankPrice,
+				&capturedAt, &d.Source); err != nil {
+				return err
+			}
+			if err := json.Unmarshal([]byte(activityList), &d.ActivityList); err != nil {
+				return err
+			}
+			if err := json.Unmarshal([]byte(couponInfo), &d.CouponInfo); err != nil {
+				return err
+			}
+			d.CapturedAt = timeFromUnix(capturedAt)
+			return fn(d)
+		})
+}
+
+func (ss *SQLiteStore) ForEachCurrentOrder(city string, fn func(storeID string, rec CurrentOrderRecord) error) error {
+	return ss.query(`SELECT store_id, id, uid, pid, user_name, avater, sale_price, real_price, real_price_fmt,
+		status, pay_time, pay_time_fmt, car_model, save_price, save_price_fmt,
+		captured_at, capture_source, am_channel, query_lng, query_lat
+		FROM current_orders WHERE city = ?`, []interface{}{city},
+		func(rows *sql.Rows) error {
+			var storeID string
+			var capturedAt int64
+			rec, meta := CurrentOrderRecord{}, CaptureMeta{}
+			it := &rec.CurrentOrderItem
+			if err := rows.Scan(&storeID, &it.ID, &it.UID, &it.Pid, &it.UserName, &it.Avater,
+				&it.SalePrice, &it.RealPrice, &it.RealPriceFmt, &it.Status, &it.PayTime, &it.PayTimeFmt,
+				&it.CarModel, &it.SavePrice, &it.SavePriceFmt,
+				&capturedAt, &meta.Source, &meta.AmChannel, &meta.QueryLng, &meta.QueryLat); err != nil {
+				return err
+			}
+			meta.CapturedAt, meta.StoreID = timeFromUnix(capturedAt), storeID
+			rec.Capture = meta.orNil()
+			return fn(storeID, rec)
+		})
+}
+
+func (ss *SQLiteStore) ForEachRepurchaseSnapshot(city string, fn func(storeID string, snap RepurchaseSnapshot) error) error {
+	return ss.query(`SELECT store_id, captured_at, driver_id, avanter, driver_name, user_name, car_model,
+		order_count_1m, ordercount_1m, order_discount_1m_fmt,
+		capture_source, am_channel, query_lng, query_lat
+		FROM repurchase_snapshots WHERE city = ?`, []interface{}{city},
+		func(rows *sql.Rows) error {
+			var storeID string
+			var capturedAt int64
+			snap, meta := RepurchaseSnapshot{}, CaptureMeta{}
+			if err := rows.Scan(&storeID, &capturedAt, &snap.DriverID, &snap.Avanter, &snap.DriverName, &snap.UserName,
+				&snap.CarModel, &snap.OrderCount1M, &snap.Ordercount1M, &snap.OrderDiscount1MFmt,
+				&meta.Source, &meta.AmChannel, &meta.QueryLng, &meta.QueryLat); err != nil {
+				return err
+			}
+			snap.CapturedAt = timeFromUnix(capturedAt)
+			meta.CapturedAt, meta.StoreID = snap.CapturedAt, storeID
+			snap.Capture = meta.orNil()
+			return fn(storeID, snap)
+		})
+}
+
+func (ss *SQLiteStore) ForEachPriceObservation(city string, fn func(obs PriceObservation) error) error {
+	return ss.query(`SELECT store_id, fuel_category, observed_at, name, fuel_category_name,
+		price, discount, rank_price, total_score, source
+		FROM price_observations WHERE city = ? ORDER BY observed_at`, []interface{}{city},
+		func(rows *sql.Rows) error {
+			var observedAt int64
+			o := PriceObservation{}
+			if err := rows.Scan(&o.StoreID, &o.FuelCategory, &observedAt, &o.Name, &o.FuelCategoryName,
+				&o.Price, &o.Discount, &o.RankPrice, &o.TotalScore, &o.Source); err != nil {
+				return err
+			}
+			o.ObservedAt = timeFromUnix(observedAt)
+			return fn(o)
+		})
+}
+
+func (ss *SQLiteStore) GetGeocode(cellKey string) (GeocodeEntry, bool, error) {
+	var updatedAt int64
+	e := GeocodeEntry{CellKey: cellKey}
+	err := ss.db.QueryRow(`SELECT lng, lat, province, city, updated_at FROM geocode_cache WHERE cell_key = ?`, cellKey).
+		Scan(&e.Lng, &e.Lat, &e.Province, &e.City, &updatedAt)
+	if err == sql.ErrNoRows {
+		return e, false, nil
+	}
+	if err != nil {
+		return e, false, err
+	}
+	e.UpdatedAt = timeFromUnix(updatedAt)
+	return e, true, nil
+}
+
+func (ss *SQLiteStore) PutGeocodes(entries []GeocodeEntry) error {
+	return ss.withTx(func(tx *sql.Tx) error {
+		for _, e := range entries {
+			if _, err := tx.Exec(`INSERT OR REPLACE INTO geocode_cache (cell_key, lng, lat, province, city, updated_at)
+				VALUES (?, ?, ?, ?, ?, ?)`,
+				e.CellKey, e.Lng, e.Lat, e.Province, e.City, unixOrZero(e.UpdatedAt)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (ss *SQLiteStore) ForEachGeocode(fn func(entry GeocodeEntry) error) error {
+	return ss.query(`SELECT cell_key, lng, lat, province, city, updated_at FROM geocode_cache`, nil, func(rows *sql.Rows) error {
+		var e GeocodeEntry
+		var updatedAt int64
+		if err := rows.Scan(&e.CellKey, &e.Lng, &e.Lat, &e.Province, &e.City, &updatedAt); err != nil {
+			return err
+		}
+		e.UpdatedAt = timeFromUnix(updatedAt)
+		return fn(e)
+	})
+}
+
+func (ss *SQLiteStore) DidiCities() ([]DidiCity, error) {
+	cities := []DidiCity{}
+	err := ss.query(`SELECT city_id, gulfstream_city_id, name, updated_at FROM didi_cities`, nil, func(rows *sql.Rows) error {
+		var city DidiCity
+		var updatedAt int64
+		if err := rows.Scan(&city.CityID, &city.GulfstreamCityID, &city.Name, &updatedAt); err != nil {
+			return err
+		}
+		city.UpdatedAt = timeFromUnix(updatedAt)
+		cities = append(cities, city)
+		return nil
+	})
+	return cities, err
+}
+
+func (ss *SQLiteStore) PutDidiCity(city DidiCity) error {
+	_, err := ss.db.Exec(`INSERT OR REPLACE INTO didi_cities (city_id, gulfstream_city_id, name, updated_at) VALUES (?, ?, ?, ?)`,
+		city.CityID, city.GulfstreamCityID, city.Name, unixOrZero(city.UpdatedAt))
+	return err
+}
+
+func (ss *SQLiteStore) CountCurrentOrdersByModel(city string, w TimeWindow) (map[string]int, error) {
+	cond, args := w.sqlCondition("pay_time")
+	modelCount := map[string]int{}
+	err := ss.query(`SELECT car_model, COUNT(*) FROM current_orders
+		WHERE city = ? AND car_model != ''`+cond+` GROUP BY car_model`, append([]interface{}{city}, args...),
+		func(rows *sql.Rows) error {
+			var model string
+			var count int
+			if err := rows.Scan(&model, &count); err != nil {
+				return err
+			}
+			modelCount[model] = count
+			return nil
+		})
+	return modelCount, err
+}
+
+func (ss *SQLiteStore) SumCurrentOrderPricesByModel(city string, w TimeWindow) (map[string]PriceSum, error) {
+	cond, args := w.sqlCondition("pay_time")
+	modelPrice := map[string]PriceSum{}
+	err := ss.query(`SELECT car_model, COUNT(*), SUM(CAST(sale_price AS INTEGER)),
+		SUM(CAST(real_price AS INTEGER)), SUM(CAST(save_price AS INTEGER))
+		FROM current_orders
+		WHERE city = ? AND car_model != ''
+		AND CAST(sale_price AS INTEGER) > 0 AND CAST(real_price AS INTEGER) > 0`+cond+`
+		GROUP BY car_model`, append([]interface{}{city}, args...),
+		func(rows *sql.Rows) error {
+			var model string
+			var ps PriceSum
+			if err := rows.Scan(&model, &ps.Orders, &ps.Sale, &ps.Real, &ps.Save); err != nil {
+				return err
+			}
+			modelPrice[model] = ps
+			return nil
+		})
+	return modelPrice, err
+}
+
+// repurchaseScoreQuery builds the query of per driver score picked by sel from
+// snapshots captured in w, result columns are car_model and score.
+func repurchaseScoreQuery(city string, w TimeWindow, sel SnapshotSelector) (string, []interface{}) {
+	cond, args := w.sqlCondition("captured_at")
+	args = append([]interface{}{city}, args...)
+	if sel.Mode == SnapshotAvg {
+		// car model is of the latest snapshot averaged, as SnapshotSelector.Select
+		query := `SELECT car_model,
+				AVG(order_count_1m) OVER (PARTITION BY store_id, driver_id) AS score,
+				ROW_NUMBER() OVER (PARTITION BY store_id, driver_id ORDER BY captured_at DESC) AS n
+			FROM repurchase_snapshots WHERE city = ?` + cond
+		if !sel.From.IsZero() {
+			query += ` AND captured_at >= ?`
+			args = append(args, sel.From.Unix())
+		}
+		if !sel.To.IsZero() {
+			query += ` AND captured_at < ?`
+			args = append(args, sel.To.Unix())
+		}
+		return `SELECT car_model, score FROM (` + query + `) WHERE n = 1`, args
+	}
+
+	latest := `SELECT MAX(captured_at) FROM repurchase_snapshots
+		WHERE store_id = r.store_id AND driver_id = r.driver_id` + cond
+	if sel.Mode == SnapshotAsOf {
+		latest += ` AND captured_at < ?`
+		args = append(args, sel.At.Unix())
+	}
+	return `SELECT r.car_model AS car_model, r.order_count_1m AS score
+		FROM repurchase_snapshots r WHERE r.city = ? AND r.captured_at = (` + latest + `)`, args
+}
+
+func (ss *SQLiteStore) RepurchaseScoresByModel(city string, w TimeWindow, sel SnapshotSelector) (map[string][]float64, error) {
+	query, args := repurchaseScoreQuery(city, w, sel)
+	modelScores := map[string][]float64{}
+	err := ss.query(`SELECT car_model, score FROM (`+query+`)
+		WHERE car_model != ''`, args,
+		func(rows *sql.Rows) error {
+			var model string
+			var score float64
+			if err := rows.Scan(&model, &score); err != nil {
+				return err
+			}
+			modelScores[model] = append(modelScores[model], score)
+			return nil
+		})
+	return modelScores, err
+}
+
+func (ss *SQLiteStore) Close() error {
+	return ss.db.Close()
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func execSQLite(t *testing.T, fn string, stmts ...string) {
+	db, err := sql.Open("sqlite3", fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, stmt := range stmts {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+}
+
+// fillAggregateData saves data of 成都市 and 深圳市, orders and drivers without car model,
+// older snapshots and data of other cities are not counted.
+func fillAggregateData(t *testing.T, store DataStore) {
+	capturedAt := time.Date(2018, 6, 10, 12, 0, 0, 0, time.Local)
+	for _, step := range []error{
+		store.MergeCurrentOrders("成都市", "s1", currentOrderRecords([]CurrentOrderItem{
+			{ID: "o1", CarModel: "比亚迪秦"}, {ID: "o2", CarModel: "丰田卡罗拉"}, {ID: "o3"},
+		})),
+		store.MergeCurrentOrders("成都市", "s2", currentOrderRecords([]CurrentOrderItem{{ID: "o4", CarModel: "比亚迪秦"}})),
+		store.MergeCurrentOrders("深圳市", "s3", currentOrderRecords([]CurrentOrderItem{{ID: "o5", CarModel: "比亚迪秦"}})),
+		store.SaveRepurchaseSnapshot("成都市", "s1", CaptureMeta{CapturedAt: capturedAt}, []RepurchaseItem{
+			{DriverID: "d1", CarModel: "比亚迪秦", OrderCount1M: 5}, {DriverID: "d2", CarModel: "丰田卡罗拉", OrderCount1M: 3},
+		}),
+		// an older snapshot of d1 is not counted
+		store.SaveRepurchaseSnapshot("成都市", "s1", CaptureMeta{CapturedAt: capturedAt.AddDate(0, 0, -7)}, []RepurchaseItem{
+			{DriverID: "d1", CarModel: "比亚迪秦", OrderCount1M: 100},
+		}),
+		store.SaveRepurchaseSnapshot("成都市", "s2", CaptureMeta{CapturedAt: capturedAt}, []RepurchaseItem{
+			{DriverID: "d3", CarModel: "比亚迪秦", OrderCount1M: 7}, {DriverID: "d4", OrderCount1M: 9},
+		}),
+		store.SaveRepurchaseSnapshot("深圳市", "s3", CaptureMeta{CapturedAt: capturedAt}, []RepurchaseItem{{DriverID: "d5", CarModel: "比亚迪秦", OrderCount1M: 20}}),
+	} {
+		if step != nil {
+			t.Fatal(step)
+		}
+	}
+}
+
+func TestSQLiteAggregates(t *testing.T) {
+	wantCount := map[string]int{"比亚迪秦": 2, "丰田卡罗拉": 1}
+	wantScores := map[string][]float64{"比亚迪秦": {5, 7}, "丰田卡罗拉": {3}}
+	forEachBackend(t, func(backend string, store DataStore) {
+		fillAggregateData(t, store)
+		if _, ok := store.(*SQLiteStore); ok {
+			if _, ok := store.(ModelAggregator); !ok {
+				t.Fatalf("SQLiteStore does not aggregate in SQL")
+			}
+		}
+
+		ca := NewCityAnalyzer(store, "成都市", AnalysisOptions{Snapshot: SnapshotSelector{Mode: SnapshotLatest}})
+		if got, _, _ := ca.analysisCurrentOrder(); !reflect.DeepEqual(got, wantCount) {
+			t.Errorf("%s: current order count = %v, want %v", backend, got, wantCount)
+		}
+		if got := sortedScores(ca.analysisRepurchase()); !reflect.DeepEqual(got, wantScores) {
+			t.Errorf("%s: repurchase scores = %v, want %v", backend, got, wantScores)
+		}
+	})
+}
+
+func TestSQLiteSchemaVersion(t *testing.T) {
+	fn, cleanup := tempSQLiteFile(t)
+	defer cleanup()
+	ss, err := NewSQLiteStore(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var version int
+	if err := ss.db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil || version != sqliteSchemaVersion {
+		t.Errorf("user_version = %d, %v, want %d", version, err, sqliteSchemaVersion)
+	}
+	ss.Close()
+
+	// reopening a database of the current version keeps it
+	ss, err = NewSQLiteStore(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss.Close()
+
+	execSQLite(t, fn, fmt.Sprintf(`PRAGMA user_version = %d`, sqliteSchemaVersion+1))
+	if ss, err := NewSQLiteStore(fn); err == nil {
+		ss.Close()
+		t.Errorf("opened a database of a newer schema version")
+	}
+}
+
+func TestMigrateData(t *testing.T) {
+	fn, cleanup := tempSQLiteFile(t)
+	defer cleanup()
+	src := NewFileStore(filepath.Join(filepath.Dir(fn), "data"))
+	fillAggregateData(t, src)
+	dst, err := NewSQLiteStore(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	opts := AnalysisOptions{Snapshot: SnapshotSelector{Mode: SnapshotLatest}}
+	for _, city := range []string{"成都市", "深圳市"} {
+		if err := copyCityData(src, dst, city); err != nil {
+			t.Fatal(err)
+		}
+		for _, kind := range []string{kindCurrentOrder, kindRepurchase} {
+			n, err := src.CountStores(city, kind)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m, err := dst.CountStores(city, kind); err != nil || m != n {
+				t.Errorf("%s: CountStores(%s) = %d, %v, want %d", city, kind, m, err, n)
+			}
+		}
+		srcCA, dstCA := NewCityAnalyzer(src, city, opts), NewCityAnalyzer(dst, city, opts)
+		got, _, _ := dstCA.analysisCurrentOrder()
+		want, _, _ := srcCA.analysisCurrentOrder()
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: migrated current order count = %v, want %v", city, got, want)
+		}
+		if got, want := sortedScores(dstCA.analysisRepurchase()), sortedScores(srcCA.analysisRepurchase()); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: migrated repurchase scores = %v, want %v", city, got, want)
+		}
+	}
+}
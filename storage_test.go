@@ -0,0 +1,171 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func tempSQLiteFile(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "didi-car-rank")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "data.db"), func() { os.RemoveAll(dir) }
+}
+
+// currentOrderRecords returns records of items without provenance.
+func currentOrderRecords(items []CurrentOrderItem) []CurrentOrderRecord {
+	records := make([]CurrentOrderRecord, 0, len(items))
+	for _, item := range items {
+		records = append(records, CurrentOrderRecord{CurrentOrderItem: item})
+	}
+	return records
+}
+
+// forEachBackend calls fn with an empty store of every backend.
+func forEachBackend(t *testing.T, fn func(backend string, store DataStore)) {
+	for _, backend := range []string{"file", "sqlite"} {
+		dbFile, cleanup := tempSQLiteFile(t)
+		var store DataStore
+		if backend == "file" {
+			store = NewFileStore(filepath.Dir(dbFile))
+		} else {
+			ss, err := NewSQLiteStore(dbFile)
+			if err != nil {
+				cleanup()
+				t.Fatal(err)
+			}
+			store = ss
+		}
+		fn(backend, store)
+		store.Close()
+		cleanup()
+	}
+}
+
+func TestDataStore(t *testing.T) {
+	forEachBackend(t, func(backend string, store DataStore) {
+		start := time.Now()
+		if err := store.UpsertStations("成都市", []Store{
+			{StoreID: "s1", Name: "中石化", Lat: 30.6, Lng: 104.1},
+			{StoreID: "s2", Name: "中石油", Lat: 30.7, Lng: 104.0},
+		}); err != nil {
+			t.Fatalf("%s: %v", backend, err)
+		}
+		// existing stations are overwritten
+		if err := store.UpsertStations("成都市", []Store{{StoreID: "s1", Name: "中石化(天府店)", Lat: 30.6, Lng: 104.1}}); err != nil {
+			t.Fatalf("%s: %v", backend, err)
+		}
+		if err := store.UpsertStations("深圳市", []Store{{StoreID: "s3", Name: "壳牌", Lat: 22.5, Lng: 114.1}}); err != nil {
+			t.Fatalf("%s: %v", backend, err)
+		}
+		// current orders are merged by ID
+		for _, items := range [][]CurrentOrderItem{
+			{{ID: "o1", CarModel: "比亚迪秦", RealPrice: "200.00"}, {ID: "o2", CarModel: "丰田卡罗拉", RealPrice: "300.00"}},
+			{{ID: "o2", CarModel: "丰田卡罗拉", RealPrice: "300.00"}, {ID: "o3", CarModel: "比亚迪秦", RealPrice: "150.00"}},
+		} {
+			if err := store.MergeCurrentOrders("成都市", "s1", currentOrderRecords(items)); err != nil {
+				t.Fatalf("%s: %v", backend, err)
+			}
+		}
+		// every repurchase fetch is kept as a snapshot
+		for i, items := range [][]RepurchaseItem{
+			{{DriverID: "d1", CarModel: "比亚迪秦", OrderCount1M: 5}, {DriverID: "d2", CarModel: "丰田卡罗拉", OrderCount1M: 3}},
+			{{DriverID: "d1", CarModel: "比亚迪秦", OrderCount1M: 8}, {DriverID: "d2", CarModel: "丰田卡罗拉", OrderCount1M: 3}},
+		} {
+			capturedAt := start.Truncate(time.Second).Add(time.Duration(i-1) * time.Hour)
+			if err := store.SaveRepurchaseSnapshot("成都市", "s1", CaptureMeta{CapturedAt: capturedAt}, items); err != nil {
+				t.Fatalf("%s: %v", backend, err)
+			}
+		}
+
+		cities, err := store.Cities()
+		sort.Strings(cities)
+		if err != nil || len(cities) != 2 || cities[0] != "成都市" || cities[1] != "深圳市" {
+			t.Errorf("%s: Cities() = %v, %v", backend, cities, err)
+		}
+
+		stations := map[string]string{}
+		if err := store.ForEachStation("成都市", func(s Store) error {
+			stations[s.StoreID] = s.Name
+			return nil
+		}); err != nil {
+			t.Fatalf("%s: %v", backend, err)
+		}
+		if len(stations) != 2 || stations["s1"] != "中石化(天府店)" || stations["s2"] != "中石油" {
+			t.Errorf("%s: stations = %v", backend, stations)
+		}
+
+		orders := map[string]string{}
+		if err := store.ForEachCurrentOrder("成都市", func(storeID string, rec CurrentOrderRecord) error {
+			orders[storeID+"/"+rec.ID] = rec.CarModel
+			return nil
+		}); err != nil {
+			t.Fatalf("%s: %v", backend, err)
+		}
+		if len(orders) != 3 || orders["s1/o3"] != "比亚迪秦" {
+			t.Errorf("%s: current orders = %v", backend, orders)
+		}
+
+		snapshots := map[string][]int{}
+		if err := store.ForEachRepurchaseSnapshot("成都市", func(storeID string, snap RepurchaseSnapshot) error {
+			key := storeID + "/" + snap.DriverID
+			snapshots[key] = append(snapshots[key], snap.OrderCount1M)
+			return nil
+		}); err != nil {
+			t.Fatalf("%s: %v", backend, err)
+		}
+		if len(snapshots) != 2 || len(snapshots["s1/d1"]) != 2 || len(snapshots["s1/d2"]) != 2 {
+			t.Errorf("%s: repurchase snapshots = %v", backend, snapshots)
+		}
+
+		for _, kind := range []string{kindCurrentOrder, kindRepurchase} {
+			updatedAt, ok := store.UpdatedAt("成都市", kind, "s1")
+			if !ok || updatedAt.Before(start.Truncate(time.Second)) || updatedAt.After(time.Now()) {
+				t.Errorf("%s: UpdatedAt(%s) = %v, %v, want between %v and now", backend, kind, updatedAt, ok, start)
+			}
+			if _, ok := store.UpdatedAt("成都市", kind, "s2"); ok {
+				t.Errorf("%s: UpdatedAt(%s) of a store never fetched", backend, kind)
+			}
+			if n, err := store.CountStores("成都市", kind); err != nil || n != 1 {
+				t.Errorf("%s: CountStores(%s) = %d, %v", backend, kind, n, err)
+			}
+		}
+	})
+}
+
+func TestPutGeocodes(t *testing.T) {
+	updatedAt := time.Unix(1600000000, 0)
+	entries := []GeocodeEntry{
+		{CellKey: "0.01:10406:3057", Lng: 104.06, Lat: 30.57, Province: "四川省", City: "成都市", UpdatedAt: updatedAt},
+		{CellKey: "0.01:12147:3123", Lng: 121.47, Lat: 31.23, Province: "上海市", City: "上海市", UpdatedAt: updatedAt},
+	}
+	forEachBackend(t, func(backend string, store DataStore) {
+		if err := store.PutGeocodes(entries); err != nil {
+			t.Fatalf("%s: %v", backend, err)
+		}
+		got := []GeocodeEntry{}
+		if err := store.ForEachGeocode(func(e GeocodeEntry) error {
+			got = append(got, e)
+			return nil
+		}); err != nil {
+			t.Fatalf("%s: %v", backend, err)
+		}
+		sort.Slice(got, func(i, j int) bool { return got[i].CellKey < got[j].CellKey })
+		if len(got) != len(entries) {
+			t.Fatalf("%s: entries = %+v", backend, got)
+		}
+		for i := range got {
+			if got[i].CellKey != entries[i].CellKey || got[i].City != entries[i].City || !got[i].UpdatedAt.Equal(updatedAt) {
+				t.Errorf("%s: entry %d = %+v, want %+v", backend, i, got[i], entries[i])
+			}
+		}
+		if e, ok, err := store.GetGeocode(entries[0].CellKey); err != nil || !ok || e.City != "成都市" {
+			t.Errorf("%s: GetGeocode = %+v, %v, %v", backend, e, ok, err)
+		}
+	})
+}
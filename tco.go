@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+
+	log "github.com/liudanking/goutil/logutil"
+)
+
+// analysis modes
+const (
+	modeRank = "rank"
+	modeTCO  = "tco"
+)
+
+// PriceSum sums prices of current orders in fen, Orders counts orders with valid prices.
+type PriceSum struct {
+	Orders int
+	Sale   int64
+	Real   int64
+	Save   int64
+}
+
+func (ps PriceSum) add(o PriceSum) PriceSum {
+	return PriceSum{
+		Orders: ps.Orders + o.Orders,
+		Sale:   ps.Sale + o.Sale,
+		Real:   ps.Real + o.Real,
+		Save:   ps.Save + o.Save,
+	}
+}
+
+// orderPrice parses prices of item, ok is false if sale or real price is not a positive number.
+func orderPrice(item CurrentOrderItem) (ps PriceSum, ok bool) {
+	sale, err := strconv.ParseInt(item.SalePrice, 10, 64)
+	if err != nil || sale <= 0 {
+		return ps, false
+	}
+	paid, err := strconv.ParseInt(item.RealPrice, 10, 64)
+	if err != nil || paid <= 0 {
+		return ps, false
+	}
+	// save price is missing in some orders
+	save, _ := strconv.ParseInt(item.SavePrice, 10, 64)
+	return PriceSum{Orders: 1, Sale: sale, Real: paid, Save: save}, true
+}
+
+// analysisPrices sums current order prices by car model.
+func (ca *CityAnalyzer) analysisPrices() map[string]PriceSum {
+	modelPrice := map[string]PriceSum{}
+	if agg, ok := ca.store.(ModelAggregator); ok {
+		var err error
+		if modelPrice, err = agg.SumCurrentOrderPricesByModel(ca.cityName, ca.opts.Window); err != nil {
+			log.Warning("sum %s current order prices failed:%v", ca.cityName, err)
+		}
+	} else {
+		err := ca.store.ForEachCurrentOrder(ca.cityName, func(storeID string, rec CurrentOrderRecord) error {
+			if rec.CarModel == "" || !ca.opts.Window.ContainsUnix(int64(rec.PayTime)) {
+				return nil
+			}
+			if ps, ok := orderPrice(rec.CurrentOrderItem); ok {
+				modelPrice[rec.CarModel] = modelPrice[rec.CarModel].add(ps)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Warning("read %s current order failed:%v", ca.cityName, err)
+		}
+	}
+
+	grouped := map[string]PriceSum{}
+	for model, ps := range modelPrice {
+		key := ca.opts.modelKey(model)
+		grouped[key] = grouped[key].add(ps)
+	}
+	return grouped
+}
+
+// TCOResult combines fill-up prices and repurchase frequency of every car model.
+type TCOResult struct {
+	Cities      []string
+	GroupBy     string
+	ModelPrice  map[string]PriceSum
+	ModelScores map[string][]float64
+}
+
+func NewTCOResult(cities []string, groupBy string) *TCOResult {
+	return &TCOResult{
+		Cities:      cities,
+		GroupBy:     groupBy,
+		ModelPrice:  map[string]PriceSum{},
+		ModelScores: map[string][]float64{},
+	}
+}
+
+func (tr *TCOResult) Add(modelPrice map[string]PriceSum, modelScores map[string][]float64) {
+	for model, ps := range modelPrice {
+		tr.ModelPrice[model] = tr.ModelPrice[model].add(ps)
+	}
+	for model, scores := range modelScores {
+		tr.ModelScores[model] = append(tr.ModelScores[model], scores...)
+	}
+}
+
+// TCOReport lists fuel cost of the most popular car models, amounts are in yuan.
+type TCOReport struct {
+	Cities  []string   `json:"cities"`
+	GroupBy string     `json:"group_by"`
+	Models  []TCOEntry `json:"models"`
+}
+
+type TCOEntry struct {
+	Rank   int    `json:"rank"`
+	Model  string `json:"model"`
+	Orders int    `json:"orders"`
+	// AvgFillUp is the average amount before discount, AvgPaid after
+	AvgFillUp    float64 `json:"avg_fill_up"`
+	AvgPaid      float64 `json:"avg_paid"`
+	AvgDiscount  float64 `json:"avg_discount"`
+	DiscountRate float64 `json:"discount_rate"`
+	// Drivers is number of repurchase drivers, FillUpsPerMonth their mean OrderCount1M
+	Drivers         int     `json:"drivers"`
+	FillUpsPerMonth float64 `json:"fill_ups_per_month"`
+	// MonthlySpend and MonthlySaving are nil if model has no repurchase driver
+	MonthlySpend  *float64 `json:"monthly_spend"`
+	MonthlySaving *float64 `json:"monthly_saving"`
+}
+
+// Report takes top n models by priced orders with at least minSamples orders,
+// and sorts them by monthly fuel spend, cheapest first.
+func (tr *TCOResult) Report(topn, minSamples int) *TCOReport {
+	models := []string{}
+	for model, ps := range tr.ModelPrice {
+		if ps.Orders > 0 && ps.Orders >= minSamples {
+			models = append(models, model)
+		}
+	}
+	sort.Slice(models, func(i, j int) bool {
+		oi, oj := tr.ModelPrice[models[i]].Orders, tr.ModelPrice[models[j]].Orders
+		if oi != oj {
+			return oi > oj
+		}
+		return models[i] < models[j]
+	})
+	if len(models) > topn {
+		models = models[:topn]
+	}
+
+	r := &TCOReport{Cities: tr.Cities, GroupBy: tr.GroupBy, Models: []TCOEntry{}}
+	for _, model := range models {
+		ps := tr.ModelPrice[model]
+		n := float64(ps.Orders)
+		entry := TCOEntry{
+			Model:        model,
+			Orders:       ps.Orders,
+			AvgFillUp:    roundYuan(float64(ps.Sale) / n / 100),
+			AvgPaid:      roundYuan(float64(ps.Real) / n / 100),
+			AvgDiscount:  roundYuan(float64(ps.Save) / n / 100),
+			DiscountRate: float64(ps.Save) / float64(ps.Sale),
+		}
+		if scores := tr.ModelScores[model]; len(scores) > 0 {
+			entry.Drivers = len(scores)
+			entry.FillUpsPerMonth = mean(scores)
+			spend := roundYuan(entry.AvgPaid * entry.FillUpsPerMonth)
+			saving := roundYuan(entry.AvgDiscount * entry.FillUpsPerMonth)
+			entry.MonthlySpend, entry.MonthlySaving = &spend, &saving
+		}
+		r.Models = append(r.Models, entry)
+	}
+	sort.SliceStable(r.Models, func(i, j int) bool {
+		si, sj := r.Models[i].MonthlySpend, r.Models[j].MonthlySpend
+		if si == nil || sj == nil {
+			return sj == nil && si != nil
+		}
+		return *si < *sj
+	})
+	for i := range r.Models {
+		r.Models[i].Rank = i + 1
+	}
+	return r
+}
+
+func (r *TCOReport) summary() string {
+	return (&Report{Cities: r.Cities}).summary()
+}
+
+func (r *TCOReport) tables() []reportTable {
+	label := groupByLabels[r.GroupBy]
+	if label == "" {
+		label = groupByLabels[groupByModel]
+	}
+	t := reportTable{
+		Title: label + "加油花费排名",
+		Header: []string{"排名", label, "订单数", "平均加油金额", "平均实付", "平均优惠", "优惠比例",
+			"司机数", "月加油次数", "月油费", "月省"},
+	}
+	for _, e := range r.Models {
+		spend, saving, fillUps := "N/A", "N/A", "N/A"
+		if e.MonthlySpend != nil {
+			spend = fmt.Sprintf("%.0f", *e.MonthlySpend)
+			saving = fmt.Sprintf("%.0f", *e.MonthlySaving)
+			fillUps = fmt.Sprintf("%.02f", e.FillUpsPerMonth)
+		}
+		t.Rows = append(t.Rows, []string{
+			fmt.Sprint(e.Rank),
+			e.Model,
+			fmt.Sprint(e.Orders),
+			fmt.Sprintf("%.02f", e.AvgFillUp),
+			fmt.Sprintf("%.02f", e.AvgPaid),
+			fmt.Sprintf("%.02f", e.AvgDiscount),
+			formatPercent(e.DiscountRate),
+			fmt.Sprint(e.Drivers),
+			fillUps,
+			spend,
+			saving,
+		})
+	}
+	return []reportTable{t}
+}
+
+func (r *TCOReport) renderCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"rank", "model", "orders", "avg_fill_up", "avg_paid", "avg_discount", "discount_rate",
+		"drivers", "fill_ups_per_month", "monthly_spend", "monthly_saving"}); err != nil {
+		return err
+	}
+	optional := func(v *float64) string {
+		if v == nil {
+			return ""
+		}
+		return formatFloat(*v)
+	}
+	for _, e := range r.Models {
+		if err := cw.Write([]string{
+			fmt.Sprint(e.Rank), e.Model, fmt.Sprint(e.Orders),
+			formatFloat(e.AvgFillUp), formatFloat(e.AvgPaid), formatFloat(e.AvgDiscount), formatFloat(e.DiscountRate),
+			fmt.Sprint(e.Drivers), formatFloat(e.FillUpsPerMonth), optional(e.MonthlySpend), optional(e.MonthlySaving),
+		}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// roundYuan rounds amount in yuan to fen.
+func roundYuan(v float64) float64 {
+	return math.Round(v*100) / 100
+}
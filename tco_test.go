@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/csv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOrderPrice(t *testing.T) {
+	tests := []struct {
+		item CurrentOrderItem
+		ps   PriceSum
+		ok   bool
+	}{
+		{CurrentOrderItem{SalePrice: "20000", RealPrice: "18500", SavePrice: "1500"}, PriceSum{Orders: 1, Sale: 20000, Real: 18500, Save: 1500}, true},
+		// save price is missing
+		{CurrentOrderItem{SalePrice: "20000", RealPrice: "20000"}, PriceSum{Orders: 1, Sale: 20000, Real: 20000}, true},
+		{CurrentOrderItem{SalePrice: "0", RealPrice: "18500", SavePrice: "1500"}, PriceSum{}, false},
+		{CurrentOrderItem{SalePrice: "20000", RealPrice: "", SavePrice: "1500"}, PriceSum{}, false},
+		{CurrentOrderItem{SalePrice: "200.00", RealPrice: "185.00"}, PriceSum{}, false},
+		{CurrentOrderItem{SalePrice: "20000", RealPrice: "-1"}, PriceSum{}, false},
+	}
+	for _, tt := range tests {
+		if ps, ok := orderPrice(tt.item); ok != tt.ok || ps != tt.ps {
+			t.Errorf("orderPrice(%+v) = %+v, %v, want %+v, %v", tt.item, ps, ok, tt.ps, tt.ok)
+		}
+	}
+}
+
+func TestAnalysisPrices(t *testing.T) {
+	payTime := int(time.Date(2018, 6, 10, 12, 0, 0, 0, time.Local).Unix())
+	tests := []struct {
+		name   string
+		window TimeWindow
+		prices map[string]PriceSum
+	}{
+		{"all", TimeWindow{}, map[string]PriceSum{
+			"比亚迪秦":  {Orders: 3, Sale: 60000, Real: 55000, Save: 5000},
+			"丰田卡罗拉": {Orders: 1, Sale: 30000, Real: 28000, Save: 2000},
+		}},
+		{"window", TimeWindow{Since: time.Unix(int64(payTime), 0)}, map[string]PriceSum{
+			"比亚迪秦":  {Orders: 2, Sale: 40000, Real: 36000, Save: 4000},
+			"丰田卡罗拉": {Orders: 1, Sale: 30000, Real: 28000, Save: 2000},
+		}},
+	}
+	forEachBackend(t, func(backend string, store DataStore) {
+		if err := store.MergeCurrentOrders("成都市", "s1", currentOrderRecords([]CurrentOrderItem{
+			{ID: "o1", CarModel: "比亚迪秦", SalePrice: "20000", RealPrice: "18000", SavePrice: "2000", PayTime: payTime},
+			{ID: "o2", CarModel: "比亚迪秦", SalePrice: "20000", RealPrice: "18000", SavePrice: "2000", PayTime: payTime + 60},
+			{ID: "o3", CarModel: "比亚迪秦", SalePrice: "20000", RealPrice: "19000", SavePrice: "1000", PayTime: payTime - 86400},
+			{ID: "o4", CarModel: "丰田卡罗拉", SalePrice: "30000", RealPrice: "28000", SavePrice: "2000", PayTime: payTime},
+			// orders without valid price or car model are not counted
+			{ID: "o5", CarModel: "丰田卡罗拉", SalePrice: "0", RealPrice: "28000", PayTime: payTime},
+			{ID: "o6", CarModel: "丰田卡罗拉", SalePrice: "30000", RealPrice: "abc", PayTime: payTime},
+			{ID: "o7", SalePrice: "30000", RealPrice: "28000", PayTime: payTime},
+		})); err != nil {
+			t.Fatalf("%s: %v", backend, err)
+		}
+		for _, tt := range tests {
+			ca := NewCityAnalyzer(store, "成都市", AnalysisOptions{Window: tt.window})
+			if got := ca.analysisPrices(); !reflect.DeepEqual(got, tt.prices) {
+				t.Errorf("%s: %s prices = %+v, want %+v", backend, tt.name, got, tt.prices)
+			}
+		}
+	})
+}
+
+func TestTCOReport(t *testing.T) {
+	tr := NewTCOResult([]string{"成都市", "深圳市"}, groupByModel)
+	tr.Add(map[string]PriceSum{
+		"比亚迪秦":  {Orders: 2, Sale: 40000, Real: 36001, Save: 3999},
+		"丰田卡罗拉": {Orders: 3, Sale: 60000, Real: 57000, Save: 3000},
+		"日产轩逸":  {Orders: 1, Sale: 10000, Real: 10000},
+	}, map[string][]float64{"比亚迪秦": {4, 6}})
+	tr.Add(map[string]PriceSum{
+		"比亚迪秦": {Orders: 1, Sale: 20000, Real: 18000, Save: 2000},
+		"大众捷达": {Orders: 2, Sale: 30000, Real: 29000, Save: 1000},
+	}, map[string][]float64{"比亚迪秦": {8}, "丰田卡罗拉": {10}, "大众捷达": {2}})
+
+	r := tr.Report(3, 2)
+	if len(r.Models) != 3 {
+		t.Fatalf("report is not limited to top 3 with at least 2 orders: %+v", r.Models)
+	}
+	// the cheapest first
+	if e := r.Models[0]; e.Rank != 1 || e.Model != "大众捷达" || e.Orders != 2 || e.AvgFillUp != 150 || e.AvgPaid != 145 ||
+		e.AvgDiscount != 5 || e.Drivers != 1 || e.FillUpsPerMonth != 2 || *e.MonthlySpend != 290 || *e.MonthlySaving != 10 {
+		t.Errorf("tco #1 = %+v", e)
+	}
+	// averages are rounded to fen before multiplied by fill-ups, discount rate is not rounded
+	if e := r.Models[1]; e.Model != "比亚迪秦" || e.Orders != 3 || e.AvgFillUp != 200 || e.AvgPaid != 180 || e.AvgDiscount != 20 ||
+		e.DiscountRate != 5999.0/60000 || e.Drivers != 3 || e.FillUpsPerMonth != 6 || *e.MonthlySpend != 1080 || *e.MonthlySaving != 120 {
+		t.Errorf("tco #2 = %+v", e)
+	}
+	if e := r.Models[2]; e.Model != "丰田卡罗拉" || e.AvgPaid != 190 || *e.MonthlySpend != 1900 || *e.MonthlySaving != 100 {
+		t.Errorf("tco #3 = %+v", e)
+	}
+
+	// models without repurchase drivers are listed last
+	r = tr.Report(10, 0)
+	if e := r.Models[len(r.Models)-1]; e.Model != "日产轩逸" || e.MonthlySpend != nil || e.MonthlySaving != nil || e.Rank != 4 {
+		t.Errorf("tco without drivers = %+v", e)
+	}
+	if r := NewTCOResult([]string{"成都市"}, groupByModel).Report(10, 0); len(r.Models) != 0 {
+		t.Errorf("empty report = %+v", r.Models)
+	}
+}
+
+func TestWriteTCOReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "didi-car-rank")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tr := NewTCOResult([]string{"成都市"}, groupByBrand)
+	tr.Add(map[string]PriceSum{
+		"比亚迪": {Orders: 2, Sale: 40000, Real: 36000, Save: 4000},
+		"丰田":  {Orders: 1, Sale: 30000, Real: 28000, Save: 2000},
+	}, map[string][]float64{"比亚迪": {5}})
+	r := tr.Report(10, 0)
+
+	fn := filepath.Join(dir, "tco.csv")
+	if err := writeReport(r, formatCSV, fn); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(strings.NewReader(string(data))).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"rank", "model", "orders", "avg_fill_up", "avg_paid", "avg_discount", "discount_rate",
+			"drivers", "fill_ups_per_month", "monthly_spend", "monthly_saving"},
+		{"1", "比亚迪", "2", "200", "180", "20", "0.1", "1", "5", "900", "100"},
+		{"2", "丰田", "1", "300", "280", "20", "0.06666666666666667", "0", "0", "", ""},
+	}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("csv records = %v, want %v", records, want)
+	}
+
+	fn = filepath.Join(dir, "tco.md")
+	if err := writeReport(r, formatMarkdown, fn); err != nil {
+		t.Fatal(err)
+	}
+	if data, err = ioutil.ReadFile(fn); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"## 品牌加油花费排名", "| 1 | 比亚迪 | 2 | 200.00 | 180.00 | 20.00 | 10.00% | 1 | 5.00 | 900 | 100 |", "| N/A | N/A | N/A |"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("markdown does not contain %q:\n%s", want, data)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	log "github.com/liudanking/goutil/logutil"
+	"github.com/urfave/cli"
+)
+
+// current order weightings
+const (
+	// weightingOrder counts every sampled order once
+	weightingOrder = "order"
+	// weightingStation scales model share of every station to its monthly orders
+	weightingStation = "station"
+)
+
+var weightingFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "weighting",
+		Usage: "order: count sampled current orders, station: estimate monthly orders by station month_order_count",
+		Value: weightingOrder,
+	},
+}
+
+func weightingFromContext(c *cli.Context) (string, error) {
+	switch w := c.String("weighting"); w {
+	case weightingOrder, weightingStation:
+		return w, nil
+	default:
+		return "", fmt.Errorf("unknown weighting: %s", w)
+	}
+}
+
+// analysisStationWeightedCurrentOrder estimates monthly orders of every car model in city.
+// Sampled orders of a station are a sample of its month_order_count orders, so model k gets
+// month_orders(s) * orders(s, k) / orders(s) from station s. Stations without month_order_count
+// are weighted by the median of stations with it. Raw counts are returned if no station has it.
+// Every sampled order of station s weighs month_orders(s) / orders(s), weights are returned
+// for the effective sample size of shares.
+func (ca *CityAnalyzer) analysisStationWeightedCurrentOrder() (estimate, samples map[string]int, weights SampleWeights) {
+	storeModelCount := map[string]map[string]int{}
+	err := ca.store.ForEachCurrentOrder(ca.cityName, func(storeID string, rec CurrentOrderRecord) error {
+		if rec.CarModel == "" || !ca.opts.Window.ContainsUnix(int64(rec.PayTime)) {
+			return nil
+		}
+		if storeModelCount[storeID] == nil {
+			storeModelCount[storeID] = map[string]int{}
+		}
+		storeModelCount[storeID][rec.CarModel]++
+		return nil
+	})
+	if err != nil {
+		log.Warning("read %s current order failed:%v", ca.cityName, err)
+	}
+
+	modelCount := map[string]int{}
+	for _, counts := range storeModelCount {
+		for model, count := range counts {
+			modelCount[model] += count
+		}
+	}
+	samples = regroupCount(modelCount, ca.opts.modelKey)
+
+	details, err := stationDetails(ca.store, ca.cityName)
+	if err != nil {
+		log.Warning("read %s station details failed:%v", ca.cityName, err)
+	}
+	monthOrders := map[string]float64{}
+	known := []float64{}
+	for storeID := range storeModelCount {
+		if orders, ok := details[storeID].MonthOrders(); ok && orders > 0 {
+			monthOrders[storeID] = float64(orders)
+			known = append(known, float64(orders))
+		}
+	}
+	if len(known) == 0 {
+		log.Warning("no station of %s has month order count, fall back to order weighting", ca.cityName)
+		for _, count := range samples {
+			weights.Add(1, count)
+		}
+		return samples, samples, weights
+	}
+	sort.Float64s(known)
+	fallback := median(known)
+	log.Info("%d of %d stations of %s have month order count", len(known), len(storeModelCount), ca.cityName)
+
+	weighted := map[string]float64{}
+	for storeID, counts := range storeModelCount {
+		weight, ok := monthOrders[storeID]
+		if !ok {
+			weight = fallback
+		}
+		total := 0
+		for _, count := range counts {
+			total += count
+		}
+		for model, count := range counts {
+			weighted[ca.opts.modelKey(model)] += weight * float64(count) / float64(total)
+		}
+		weights.Add(weight/float64(total), total)
+	}
+	estimate = map[string]int{}
+	for model, v := range weighted {
+		estimate[model] = int(math.Round(v))
+	}
+	return estimate, samples, weights
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStationWeightedCurrentOrder(t *testing.T) {
+	forEachBackend(t, func(backend string, store DataStore) {
+		for _, step := range []error{
+			store.MergeCurrentOrders("成都市", "s1", currentOrderRecords([]CurrentOrderItem{
+				{ID: "o1", CarModel: "比亚迪秦"}, {ID: "o2", CarModel: "比亚迪秦"}, {ID: "o3", CarModel: "比亚迪秦"}, {ID: "o4", CarModel: "丰田卡罗拉"},
+			})),
+			store.MergeCurrentOrders("成都市", "s2", currentOrderRecords([]CurrentOrderItem{
+				{ID: "o5", CarModel: "比亚迪秦"}, {ID: "o6", CarModel: "丰田卡罗拉"}, {ID: "o7"},
+			})),
+			// s3 has no month order count and is weighted by the median
+			store.MergeCurrentOrders("成都市", "s3", currentOrderRecords([]CurrentOrderItem{
+				{ID: "o8", CarModel: "丰田卡罗拉"}, {ID: "o9", CarModel: "丰田卡罗拉"},
+			})),
+			store.UpsertStationDetails("成都市", []StationDetail{
+				{StoreListItem: StoreListItem{StoreID: "s1", MonthOrderCount: "1万"}},
+				{StoreListItem: StoreListItem{StoreID: "s2", MonthOrderCount: "月加油2000次"}},
+				{StoreListItem: StoreListItem{StoreID: "s3", MonthOrderCount: "暂无"}},
+			}),
+			// orders of s4 are raw counts as no station of 深圳市 has month order count
+			store.MergeCurrentOrders("深圳市", "s4", currentOrderRecords([]CurrentOrderItem{
+				{ID: "o10", CarModel: "比亚迪秦"}, {ID: "o11", CarModel: "丰田卡罗拉"}, {ID: "o12", CarModel: "丰田卡罗拉"},
+			})),
+		} {
+			if step != nil {
+				t.Fatalf("%s: %v", backend, step)
+			}
+		}
+
+		// every order weighs month orders of its station divided by sampled orders of the station
+		tests := []struct {
+			city     string
+			estimate map[string]int
+			samples  map[string]int
+			weights  SampleWeights
+		}{
+			{"成都市", map[string]int{"比亚迪秦": 8500, "丰田卡罗拉": 9500}, map[string]int{"比亚迪秦": 4, "丰田卡罗拉": 4},
+				SampleWeights{Sum: 18000, SumSquares: 2500*2500*4 + 1000*1000*2 + 3000*3000*2}},
+			{"深圳市", map[string]int{"比亚迪秦": 1, "丰田卡罗拉": 2}, map[string]int{"比亚迪秦": 1, "丰田卡罗拉": 2},
+				SampleWeights{Sum: 3, SumSquares: 3}},
+		}
+		ar := NewAnalysisResult([]string{"成都市", "深圳市"}, groupByModel, weightingStation)
+		for _, tt := range tests {
+			ca := NewCityAnalyzer(store, tt.city, AnalysisOptions{Weighting: weightingStation})
+			estimate, samples, weights := ca.analysisCurrentOrder()
+			if !reflect.DeepEqual(estimate, tt.estimate) || !reflect.DeepEqual(samples, tt.samples) || weights != tt.weights {
+				t.Errorf("%s: %s = %v, %v, %+v, want %v, %v, %+v", backend, tt.city, estimate, samples, weights, tt.estimate, tt.samples, tt.weights)
+			}
+			ar.Add(tt.city, estimate, samples, weights, nil)
+		}
+
+		// min samples filters by sampled orders
+		r := ar.Report(10, 6)
+		if len(r.CurrentOrder) != 1 {
+			t.Fatalf("%s: report = %+v", backend, r.CurrentOrder)
+		}
+		if e := r.CurrentOrder[0]; e.Model != "丰田卡罗拉" || e.Count != 9502 || e.Samples != 6 || e.Share != 9502.0/18003 {
+			t.Errorf("%s: entry = %+v", backend, e)
+		}
+		// interval over effective sample size is wider than over the 11 sampled orders
+		n := 18003.0 * 18003 / 45000003
+		if e := r.CurrentOrder[0]; e.ShareCI != wilsonIntervalN(e.Share, n) || !(n < 8) {
+			t.Errorf("%s: share CI = %+v, want %+v", backend, e.ShareCI, wilsonIntervalN(e.Share, n))
+		}
+		if header := r.tables()[0].Header; !strings.Contains(strings.Join(header, ","), "估计月订单数,样本订单数") {
+			t.Errorf("%s: header = %v", backend, header)
+		}
+	})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+const dateLayout = "2006-01-02"
+
+// parseDate parses a local date, empty string results in zero time.
+func parseDate(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.ParseInLocation(dateLayout, s, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %s, expect format %s", s, dateLayout)
+	}
+	return t, nil
+}
+
+// endOfDate returns the exclusive end of date t, zero time is kept.
+func endOfDate(t time.Time) time.Time {
+	if t.IsZero() {
+		return t
+	}
+	return t.AddDate(0, 0, 1)
+}
+
+// TimeWindow limits analysis to [Since, Until), zero bounds are unbounded.
+type TimeWindow struct {
+	Since time.Time
+	Until time.Time
+}
+
+var windowFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "since",
+		Usage: "only analysis orders paid and snapshots captured since date, e.g. 2018-06-01",
+	},
+	cli.StringFlag{
+		Name:  "until",
+		Usage: "only analysis orders paid and snapshots captured until date (inclusive), e.g. 2018-06-30",
+	},
+}
+
+func timeWindowFromContext(c *cli.Context) (TimeWindow, error) {
+	since, err := parseDate(c.String("since"))
+	if err != nil {
+		return TimeWindow{}, err
+	}
+	until, err := parseDate(c.String("until"))
+	if err != nil {
+		return TimeWindow{}, err
+	}
+	w := TimeWindow{Since: since, Until: endOfDate(until)}
+	if !w.Since.IsZero() && !w.Until.IsZero() && !w.Since.Before(w.Until) {
+		return w, fmt.Errorf("--since %s is after --until %s", c.String("since"), c.String("until"))
+	}
+	return w, nil
+}
+
+func (w TimeWindow) IsZero() bool {
+	return w.Since.IsZero() && w.Until.IsZero()
+}
+
+// Contains reports whether t is in w, unknown (zero) time is only in unbounded window.
+func (w TimeWindow) Contains(t time.Time) bool {
+	if t.IsZero() {
+		return w.IsZero()
+	}
+	if !w.Since.IsZero() && t.Before(w.Since) {
+		return false
+	}
+	if !w.Until.IsZero() && !t.Before(w.Until) {
+		return false
+	}
+	return true
+}
+
+// ContainsUnix is Contains for unix seconds, 0 is unknown time.
+func (w TimeWindow) ContainsUnix(sec int64) bool {
+	return w.Contains(timeFromUnix(sec))
+}
+
+// sqlCondition returns the condition restricting column of unix seconds to w.
+func (w TimeWindow) sqlCondition(column string) (string, []interface{}) {
+	if w.IsZero() {
+		return "", nil
+	}
+	cond, args := fmt.Sprintf(" AND %s != 0", column), []interface{}{}
+	if !w.Since.IsZero() {
+		cond += fmt.Sprintf(" AND %s >= ?", column)
+		args = append(args, w.Since.Unix())
+	}
+	if !w.Until.IsZero() {
+		cond += fmt.Sprintf(" AND %s < ?", column)
+		args = append(args, w.Until.Unix())
+	}
+	return cond, args
+}
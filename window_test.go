@@ -0,0 +1,124 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTimeWindowContains(t *testing.T) {
+	since := time.Date(2018, 6, 1, 0, 0, 0, 0, time.Local)
+	until := time.Date(2018, 7, 1, 0, 0, 0, 0, time.Local)
+	tests := []struct {
+		name string
+		w    TimeWindow
+		t    time.Time
+		want bool
+	}{
+		{"unbounded", TimeWindow{}, since, true},
+		{"unbounded zero time", TimeWindow{}, time.Time{}, true},
+		{"zero time", TimeWindow{Since: since}, time.Time{}, false},
+		{"since inclusive", TimeWindow{Since: since, Until: until}, since, true},
+		{"before since", TimeWindow{Since: since, Until: until}, since.Add(-time.Second), false},
+		{"until exclusive", TimeWindow{Since: since, Until: until}, until, false},
+		{"before until", TimeWindow{Since: since, Until: until}, until.Add(-time.Second), true},
+		{"only until", TimeWindow{Until: until}, since.AddDate(-1, 0, 0), true},
+	}
+	for _, tt := range tests {
+		if got := tt.w.Contains(tt.t); got != tt.want {
+			t.Errorf("%s: Contains(%v) = %v, want %v", tt.name, tt.t, got, tt.want)
+		}
+		if got := tt.w.ContainsUnix(unixOrZero(tt.t)); got != tt.want {
+			t.Errorf("%s: ContainsUnix(%d) = %v, want %v", tt.name, unixOrZero(tt.t), got, tt.want)
+		}
+	}
+}
+
+func TestTimeWindowSQLCondition(t *testing.T) {
+	since := time.Date(2018, 6, 1, 0, 0, 0, 0, time.Local)
+	until := time.Date(2018, 7, 1, 0, 0, 0, 0, time.Local)
+	tests := []struct {
+		w    TimeWindow
+		cond string
+		args []interface{}
+	}{
+		{TimeWindow{}, "", nil},
+		{TimeWindow{Since: since}, " AND pay_time != 0 AND pay_time >= ?", []interface{}{since.Unix()}},
+		{TimeWindow{Until: until}, " AND pay_time != 0 AND pay_time < ?", []interface{}{until.Unix()}},
+		{TimeWindow{Since: since, Until: until}, " AND pay_time != 0 AND pay_time >= ? AND pay_time < ?",
+			[]interface{}{since.Unix(), until.Unix()}},
+	}
+	for _, tt := range tests {
+		cond, args := tt.w.sqlCondition("pay_time")
+		if cond != tt.cond || !reflect.DeepEqual(args, tt.args) {
+			t.Errorf("%+v: sqlCondition() = %q, %v, want %q, %v", tt.w, cond, args, tt.cond, tt.args)
+		}
+	}
+}
+
+func TestParseDate(t *testing.T) {
+	if d, err := parseDate(""); err != nil || !d.IsZero() {
+		t.Errorf("parseDate(\"\") = %v, %v", d, err)
+	}
+	if _, err := parseDate("2018/06/01"); err == nil {
+		t.Errorf("parseDate(2018/06/01) succeeded")
+	}
+	d, err := parseDate("2018-06-30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if end := endOfDate(d); !end.Equal(time.Date(2018, 7, 1, 0, 0, 0, 0, time.Local)) {
+		t.Errorf("endOfDate(%v) = %v", d, end)
+	}
+	if end := endOfDate(time.Time{}); !end.IsZero() {
+		t.Errorf("endOfDate(zero) = %v", end)
+	}
+}
+
+func TestAnalysisTimeWindow(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2018, 6, d, 12, 0, 0, 0, time.Local) }
+	latest := SnapshotSelector{Mode: SnapshotLatest}
+	tests := []struct {
+		name   string
+		w      TimeWindow
+		count  map[string]int
+		scores map[string][]float64
+	}{
+		{"unbounded", TimeWindow{}, map[string]int{"比亚迪秦": 2, "丰田卡罗拉": 2}, map[string][]float64{"比亚迪秦": {30}, "丰田卡罗拉": {6}}},
+		{"since", TimeWindow{Since: day(5)}, map[string]int{"比亚迪秦": 1, "丰田卡罗拉": 1}, map[string][]float64{"比亚迪秦": {30}}},
+		{"until", TimeWindow{Until: day(5)}, map[string]int{"比亚迪秦": 1}, map[string][]float64{"比亚迪秦": {10}}},
+		{"range", TimeWindow{Since: day(5), Until: day(15)}, map[string]int{"丰田卡罗拉": 1}, map[string][]float64{}},
+	}
+	forEachBackend(t, func(backend string, store DataStore) {
+		// o4 and d2 have no time and are only counted without window
+		if err := store.MergeCurrentOrders("成都市", "s1", currentOrderRecords([]CurrentOrderItem{
+			{ID: "o1", CarModel: "比亚迪秦", PayTime: int(day(1).Unix())},
+			{ID: "o2", CarModel: "丰田卡罗拉", PayTime: int(day(10).Unix())},
+			{ID: "o3", CarModel: "比亚迪秦", PayTime: int(day(20).Unix())},
+			{ID: "o4", CarModel: "丰田卡罗拉"},
+		})); err != nil {
+			t.Fatalf("%s: %v", backend, err)
+		}
+		for _, snap := range []struct {
+			capturedAt time.Time
+			items      []RepurchaseItem
+		}{
+			{day(1), []RepurchaseItem{{DriverID: "d1", CarModel: "比亚迪秦", OrderCount1M: 10}}},
+			{day(20), []RepurchaseItem{{DriverID: "d1", CarModel: "比亚迪秦", OrderCount1M: 30}}},
+			{time.Time{}, []RepurchaseItem{{DriverID: "d2", CarModel: "丰田卡罗拉", OrderCount1M: 6}}},
+		} {
+			if err := store.SaveRepurchaseSnapshot("成都市", "s1", CaptureMeta{CapturedAt: snap.capturedAt}, snap.items); err != nil {
+				t.Fatalf("%s: %v", backend, err)
+			}
+		}
+		for _, tt := range tests {
+			ca := NewCityAnalyzer(store, "成都市", AnalysisOptions{Window: tt.w, Snapshot: latest})
+			if got, _, _ := ca.analysisCurrentOrder(); !reflect.DeepEqual(got, tt.count) {
+				t.Errorf("%s %s: count = %v, want %v", backend, tt.name, got, tt.count)
+			}
+			if got := sortedScores(ca.analysisRepurchase()); !reflect.DeepEqual(got, tt.scores) {
+				t.Errorf("%s %s: scores = %v, want %v", backend, tt.name, got, tt.scores)
+			}
+		}
+	})
+}